@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/spencer-p/key-value-store/pkg/handlers"
+	"github.com/spencer-p/key-value-store/pkg/store"
 	"github.com/spencer-p/key-value-store/pkg/types"
 	"github.com/spencer-p/key-value-store/pkg/util"
 
@@ -29,6 +30,51 @@ type Config struct {
 	View       string `envconfig:"VIEW" required:"true"`
 	Address    string `envconfig:"ADDRESS" required:"true"`
 	ReplFactor int    `envconfig:"REPL_FACTOR" required:"true"`
+
+	// Config durability of the store
+	DataDir       string        `envconfig:"DATA_DIR"`
+	FsyncPolicy   string        `envconfig:"FSYNC_POLICY" default:"always"`
+	FsyncBatch    int           `envconfig:"FSYNC_BATCH" default:"64"`
+	FsyncInterval time.Duration `envconfig:"FSYNC_INTERVAL" default:"100ms"`
+	StorageEngine string        `envconfig:"STORAGE_ENGINE" default:"memory"`
+
+	SnapshotInterval time.Duration `envconfig:"SNAPSHOT_INTERVAL" default:"5m"`
+
+	// Config tombstone collection
+	TombstoneInterval time.Duration `envconfig:"TOMBSTONE_INTERVAL" default:"30s"`
+
+	// Config how often expired keys are deleted
+	ExpiryInterval time.Duration `envconfig:"EXPIRY_INTERVAL" default:"1s"`
+
+	// Config how long transactions across shards wait before recovering
+	TxnTimeout time.Duration `envconfig:"TXN_TIMEOUT" default:"30s"`
+
+	// Config how often replicas repair entries that differ
+	AntiEntropyInterval time.Duration `envconfig:"ANTI_ENTROPY_INTERVAL" default:"1m"`
+
+	// Config how many writes queued for each peer are kept in memory
+	GossipQueueSize int `envconfig:"GOSSIP_QUEUE_SIZE" default:"10000"`
+
+	// Config how many writes are gossiped at most in one message, and how
+	// long to wait for that many
+	GossipBatchSize int           `envconfig:"GOSSIP_BATCH_SIZE" default:"100"`
+	GossipLinger    time.Duration `envconfig:"GOSSIP_LINGER" default:"5ms"`
+
+	// Config whether writes to unreachable nodes are held for them, and how
+	// often those nodes are checked
+	HintedHandoff   bool          `envconfig:"HINTED_HANDOFF" default:"false"`
+	HandoffInterval time.Duration `envconfig:"HANDOFF_INTERVAL" default:"1s"`
+
+	// Config how much of the change log is kept
+	ChangeRetention int           `envconfig:"CHANGE_RETENTION" default:"100000"`
+	ChangeMaxAge    time.Duration `envconfig:"CHANGE_MAX_AGE" default:"24h"`
+
+	// Config how concurrent writes are settled, for all keys or by prefix
+	ConflictResolution string `envconfig:"CONFLICT_RESOLUTION" default:"siblings"`
+	ResolutionPrefixes string `envconfig:"RESOLUTION_PREFIXES"`
+
+	// Config how far ahead of ours another node's clock may be
+	MaxClockSkew time.Duration `envconfig:"MAX_CLOCK_SKEW" default:"1m"`
 }
 
 func main() {
@@ -36,16 +82,64 @@ func main() {
 	envconfig.MustProcess("", &env)
 	log.Printf("Configured: %+v\n", env)
 
+	syncPolicy, err := store.ParseSyncPolicy(env.FsyncPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine, err := store.ParseEngineKind(env.StorageEngine)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resolution, err := store.ParseResolution(env.ConflictResolution)
+	if err != nil {
+		log.Fatal(err)
+	}
+	prefixes, err := store.ParseResolutionPrefixes(env.ResolutionPrefixes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Create a cancelable context so we can kill processes
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Create a mux and route handlers
 	r := mux.NewRouter()
 	r.Use(util.WithLog)
-	handlers.NewState(ctx, env.Address, types.View{
+	state, err := handlers.NewState(ctx, env.Address, types.View{
 		Members:    strings.Split(env.View, ","),
 		ReplFactor: env.ReplFactor,
-	}).Route(r)
+	}, handlers.Options{
+		Store: store.Options{
+			Dir:          env.DataDir,
+			Sync:         syncPolicy,
+			SyncBatch:    env.FsyncBatch,
+			SyncInterval: env.FsyncInterval,
+			Engine:       engine,
+
+			ChangeRetention: env.ChangeRetention,
+			ChangeMaxAge:    env.ChangeMaxAge,
+
+			Resolution:         resolution,
+			ResolutionPrefixes: prefixes,
+
+			MaxClockSkew: env.MaxClockSkew,
+		},
+		SnapshotInterval:  env.SnapshotInterval,
+		TombstoneInterval: env.TombstoneInterval,
+		ExpiryInterval:    env.ExpiryInterval,
+		TxnTimeout:        env.TxnTimeout,
+
+		AntiEntropyInterval: env.AntiEntropyInterval,
+		GossipQueueSize:     env.GossipQueueSize,
+		GossipBatchSize:     env.GossipBatchSize,
+		GossipLinger:        env.GossipLinger,
+		HintedHandoff:       env.HintedHandoff,
+		HandoffInterval:     env.HandoffInterval,
+	})
+	if err != nil {
+		log.Fatal("Failed to recover store: ", err)
+	}
+	state.Route(r)
 
 	srv := &http.Server{
 		Handler:      r,
@@ -71,4 +165,7 @@ func main() {
 
 	cancel()
 	srv.Shutdown(context.Background())
+	if err := state.Close(); err != nil {
+		log.Println("Failed to close store:", err)
+	}
 }
@@ -92,3 +92,55 @@ func TestVectorClock(t *testing.T) {
 		}
 	}
 }
+
+func TestMinMax(t *testing.T) {
+	a := VectorClock{"a": 1, "b": 5}
+	b := VectorClock{"a": 3, "c": 2}
+
+	max := a.Copy()
+	max.Max(b)
+	if got, want := max, (VectorClock{"a": 3, "b": 5, "c": 2}); got.Compare(want) != Equal {
+		t.Errorf("max of %v and %v is %v, wanted %v", a, b, got, want)
+	}
+
+	min := a.Copy()
+	min.Min(b)
+	if got, want := min, (VectorClock{"a": 1, "b": 0, "c": 0}); got.Compare(want) != Equal {
+		t.Errorf("min of %v and %v is %v, wanted %v", a, b, got, want)
+	}
+}
+
+func TestDVV(t *testing.T) {
+	a1 := DVV{Dot: Dot{"a", 1}}
+	b1 := DVV{Dot: Dot{"b", 1}}
+	// Written on a after seeing a1, though not b1.
+	a3 := DVV{Dot: Dot{"a", 3}, Context: VectorClock{"a": 1}}
+	// Written on b after seeing both.
+	b4 := DVV{Dot: Dot{"b", 4}, Context: VectorClock{"a": 3, "b": 1}}
+
+	tests := []struct {
+		d, o       DVV
+		descends   bool
+		concurrent bool
+	}{
+		{a1, a1, true, false},
+		{a1, b1, false, true},
+		{a3, a1, true, false},
+		{a1, a3, false, false},
+		{a3, b1, false, true},
+		{b4, a3, true, false},
+		{b4, b1, true, false},
+	}
+	for _, test := range tests {
+		if got := test.d.Descends(test.o); got != test.descends {
+			t.Errorf("%v.Descends(%v) = %t, wanted %t", test.d, test.o, got, test.descends)
+		}
+		if got := test.d.Concurrent(test.o); got != test.concurrent {
+			t.Errorf("%v.Concurrent(%v) = %t, wanted %t", test.d, test.o, got, test.concurrent)
+		}
+	}
+
+	if got, want := b4.Clock(), (VectorClock{"a": 3, "b": 4}); got.Compare(want) != Equal {
+		t.Errorf("Got clock %v, wanted %v", got, want)
+	}
+}
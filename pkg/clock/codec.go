@@ -0,0 +1,162 @@
+package clock
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrBadEncoding = errors.New("Causal context is not encoded correctly")
+	ErrStaleEpoch  = errors.New("Causal context is from another view")
+)
+
+// Codec encodes clocks compactly by numbering the nodes of a view. Since
+// numbers are only meaningful within one view, each encoding starts with the
+// epoch of the view, which is bumped on every view change.
+//
+// An encoding is the unpadded URL safe base64 of a list of varints: the epoch,
+// then for each node, its position in the view counting from one and its
+// count of events. A node missing from the view has the position zero and is
+// followed by the length of its address and the address.
+//
+// A clock encoded in an earlier view is decoded with the members of that view
+// if they are in Past, and then truncated.
+type Codec struct {
+	Epoch   uint64
+	Members []string
+	Past    map[uint64][]string
+}
+
+// Encode returns the compact encoding of a clock.
+func (c Codec) Encode(vc VectorClock) string {
+	ids := make(map[string]uint64, len(c.Members))
+	for i, m := range c.Members {
+		ids[m] = uint64(i + 1)
+	}
+	nodes := make([]string, 0, len(vc))
+	for node, n := range vc {
+		if n > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if ids[nodes[i]] != ids[nodes[j]] {
+			return ids[nodes[i]] < ids[nodes[j]]
+		}
+		return nodes[i] < nodes[j]
+	})
+
+	buf := make([]byte, 0, binary.MaxVarintLen64*(1+2*len(nodes)))
+	buf = putUvarint(buf, c.Epoch)
+	for _, node := range nodes {
+		id := ids[node]
+		buf = putUvarint(buf, id)
+		if id == 0 {
+			buf = putUvarint(buf, uint64(len(node)))
+			buf = append(buf, node...)
+		}
+		buf = putUvarint(buf, vc[node])
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// Decode reads a clock encoded by Encode. It fails with ErrStaleEpoch if the
+// clock was encoded in another view that is not one of the past views.
+func (c Codec) Decode(s string) (VectorClock, error) {
+	vc := VectorClock{}
+	if s == "" {
+		return vc, nil
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrBadEncoding
+	}
+
+	r := &varintReader{buf: buf}
+	epoch, members := r.next(), c.Members
+	if r.err == nil && epoch != c.Epoch {
+		var ok bool
+		if members, ok = c.Past[epoch]; !ok {
+			return nil, fmt.Errorf("%w: epoch %d, not %d", ErrStaleEpoch, epoch, c.Epoch)
+		}
+	}
+	for r.err == nil && len(r.buf) > 0 {
+		var node string
+		switch id := r.next(); {
+		case id == 0:
+			node = r.bytes(r.next())
+		case id <= uint64(len(members)):
+			node = members[id-1]
+		default:
+			r.err = ErrBadEncoding
+		}
+		vc[node] = r.next()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if epoch != c.Epoch {
+		return c.Truncate(vc), nil
+	}
+	return vc, nil
+}
+
+// Truncate returns the clock without the nodes that were members of a past
+// view but have left since. Other nodes are kept, as they may have joined a
+// view we have not heard of yet.
+func (c Codec) Truncate(vc VectorClock) VectorClock {
+	current := make(map[string]bool, len(c.Members))
+	for _, m := range c.Members {
+		current[m] = true
+	}
+	truncated := vc.Copy()
+	for _, members := range c.Past {
+		for _, m := range members {
+			if !current[m] {
+				delete(truncated, m)
+			}
+		}
+	}
+	return truncated
+}
+
+func putUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	return append(buf, b[:n]...)
+}
+
+// varintReader reads varints until the first error.
+type varintReader struct {
+	buf []byte
+	err error
+}
+
+func (r *varintReader) next() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrBadEncoding
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+func (r *varintReader) bytes(n uint64) string {
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = ErrBadEncoding
+		return ""
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return string(b)
+}
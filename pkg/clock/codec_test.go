@@ -0,0 +1,50 @@
+package clock
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	c := Codec{Epoch: 3, Members: []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}}
+	vc := VectorClock{"10.0.0.1:8080": 5, "10.0.0.3:8080": 300, "10.0.0.9:8080": 1, "10.0.0.2:8080": 0}
+
+	if encoded := c.Encode(VectorClock{"10.0.0.1:8080": 5, "10.0.0.3:8080": 300}); len(encoded) > 10 {
+		t.Errorf("Encoding %q is not compact", encoded)
+	}
+
+	encoded := c.Encode(vc)
+	got, err := c.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Failed to decode %q: %v", encoded, err)
+	}
+	if got.Compare(vc) != Equal {
+		t.Errorf("Decoded %v, wanted %v", got, vc)
+	}
+
+	if got, err := c.Decode(""); err != nil || len(got) != 0 {
+		t.Errorf("Decoded %v and %v from nothing", got, err)
+	}
+	next := Codec{Epoch: 4, Members: c.Members}
+	if _, err := next.Decode(encoded); !errors.Is(err, ErrStaleEpoch) {
+		t.Errorf("Got %v decoding a clock from the last view, wanted ErrStaleEpoch", err)
+	}
+
+	// Once the last view is known, its clocks are translated, losing the
+	// node that left.
+	next = Codec{Epoch: 4, Members: []string{"10.0.0.3:8080", "10.0.0.1:8080"}, Past: map[uint64][]string{3: c.Members}}
+	got, err = next.Decode(encoded)
+	want := VectorClock{"10.0.0.1:8080": 5, "10.0.0.3:8080": 300, "10.0.0.9:8080": 1}
+	if err != nil || got.Compare(want) != Equal {
+		t.Errorf("Decoded %v and %v from the last view, wanted %v", got, err, want)
+	}
+	if _, ok := got["10.0.0.2:8080"]; ok {
+		t.Errorf("Decoded %v from the last view, wanted the departed node dropped", got)
+	}
+
+	for _, bad := range []string{"!!", encoded[:6], "Aw8"} {
+		if _, err := c.Decode(bad); err == nil {
+			t.Errorf("Decoded %q", bad)
+		}
+	}
+}
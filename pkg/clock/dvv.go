@@ -0,0 +1,44 @@
+package clock
+
+// Dot names a single event: the node it happened on and that node's count of
+// events once it happened.
+type Dot struct {
+	Node    string `json:"node"`
+	Counter uint64 `json:"counter"`
+}
+
+// DVV is a dotted version vector. It describes one version of a key by the
+// event that wrote it and the context of versions of that key the write had
+// seen. Unlike the clock of the whole node at the time of the write, it says
+// nothing of writes to other keys, so two versions are only concurrent if
+// neither write saw the other.
+type DVV struct {
+	Dot     Dot         `json:"dot"`
+	Context VectorClock `json:"context,omitempty"`
+}
+
+// Covers returns true if the clock includes the event d.
+func (a VectorClock) Covers(d Dot) bool {
+	return a[d.Node] >= d.Counter
+}
+
+// Clock returns the context with the dot folded in: every event the version
+// includes.
+func (d DVV) Clock() VectorClock {
+	vc := d.Context.Copy()
+	if vc[d.Dot.Node] < d.Dot.Counter {
+		vc[d.Dot.Node] = d.Dot.Counter
+	}
+	return vc
+}
+
+// Descends returns true if d is the version o or was written after seeing it.
+func (d DVV) Descends(o DVV) bool {
+	return d.Dot == o.Dot || d.Context.Covers(o.Dot)
+}
+
+// Concurrent returns true if neither version was written after seeing the
+// other.
+func (d DVV) Concurrent(o DVV) bool {
+	return !d.Descends(o) && !o.Descends(d)
+}
@@ -0,0 +1,107 @@
+package clock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrClockSkew = errors.New("Timestamp is too far in the future")
+)
+
+// Timestamp is a reading of a hybrid logical clock: the latest wall clock time
+// the clock has seen, in nanoseconds since the epoch, and a count of events
+// that happened at that time. Timestamps of causally related events are
+// ordered like the events, and otherwise stay close to the wall clock.
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical,omitempty"`
+}
+
+// IsZero returns true if the timestamp was never set.
+func (t Timestamp) IsZero() bool {
+	return t == Timestamp{}
+}
+
+// Compare orders two timestamps. It never returns NoRelation.
+func (t Timestamp) Compare(u Timestamp) CompareResult {
+	switch {
+	case t.Wall < u.Wall || (t.Wall == u.Wall && t.Logical < u.Logical):
+		return Less
+	case t == u:
+		return Equal
+	}
+	return Greater
+}
+
+// Time returns the wall clock time of the timestamp.
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall)
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%s+%d", t.Time().UTC().Format(time.RFC3339Nano), t.Logical)
+}
+
+// UnmarshalJSON reads a timestamp, or a bare number of nanoseconds as written
+// before timestamps were hybrid.
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	var wall int64
+	if err := json.Unmarshal(b, &wall); err == nil {
+		*t = Timestamp{Wall: wall}
+		return nil
+	}
+	type timestamp Timestamp
+	return json.Unmarshal(b, (*timestamp)(t))
+}
+
+// HLC is a hybrid logical clock. It is not safe for concurrent use.
+type HLC struct {
+	last Timestamp
+
+	// MaxSkew is how far ahead of our wall clock a timestamp from another
+	// node may be. Zero allows any.
+	MaxSkew time.Duration
+
+	// Wall returns the time. It is time.Now if nil.
+	Wall func() time.Time
+}
+
+func (c *HLC) wall() int64 {
+	if c.Wall == nil {
+		return time.Now().UnixNano()
+	}
+	return c.Wall().UnixNano()
+}
+
+// Now returns the timestamp of a new local event, which is after every
+// timestamp the clock has returned or seen.
+func (c *HLC) Now() Timestamp {
+	if wall := c.wall(); wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update moves the clock past a timestamp received from another node. It
+// fails with ErrClockSkew, and leaves the clock alone, if the timestamp is
+// more than MaxSkew ahead of our wall clock.
+func (c *HLC) Update(t Timestamp) error {
+	if c.MaxSkew > 0 && t.Wall-c.wall() > int64(c.MaxSkew) {
+		return fmt.Errorf("%w: %v is %v ahead", ErrClockSkew, t, time.Duration(t.Wall-c.wall()))
+	}
+	c.Observe(t)
+	return nil
+}
+
+// Observe moves the clock past a timestamp without checking it, such as one
+// this node already accepted before it restarted.
+func (c *HLC) Observe(t Timestamp) {
+	if c.last.Compare(t) == Less {
+		c.last = t
+	}
+}
@@ -0,0 +1,51 @@
+package clock
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	wall := time.Unix(100, 0)
+	c := &HLC{MaxSkew: time.Second, Wall: func() time.Time { return wall }}
+
+	first := c.Now()
+	second := c.Now()
+	if first.Compare(second) != Less || second.Wall != wall.UnixNano() || second.Logical != 1 {
+		t.Errorf("Got %v then %v at the same wall time", first, second)
+	}
+
+	// A timestamp from a node slightly ahead moves the clock forward, even
+	// though the wall clock has not.
+	ahead := Timestamp{Wall: wall.Add(500 * time.Millisecond).UnixNano(), Logical: 3}
+	if err := c.Update(ahead); err != nil {
+		t.Fatalf("Failed to update: %v", err)
+	}
+	if next := c.Now(); next.Compare(ahead) != Greater || next.Wall != ahead.Wall {
+		t.Errorf("Got %v after %v", next, ahead)
+	}
+
+	// One too far ahead is rejected.
+	if err := c.Update(Timestamp{Wall: wall.Add(time.Minute).UnixNano()}); !errors.Is(err, ErrClockSkew) {
+		t.Errorf("Got %v for a timestamp a minute ahead, wanted ErrClockSkew", err)
+	}
+
+	// Once the wall clock passes it, the clock follows the wall clock again.
+	wall = wall.Add(time.Second)
+	if next := c.Now(); next != (Timestamp{Wall: wall.UnixNano()}) {
+		t.Errorf("Got %v, wanted the wall clock", next)
+	}
+}
+
+func TestTimestampJSON(t *testing.T) {
+	var ts Timestamp
+	if err := json.Unmarshal([]byte(`123`), &ts); err != nil || ts != (Timestamp{Wall: 123}) {
+		t.Errorf("Got %v and %v from a bare number", ts, err)
+	}
+	b, _ := json.Marshal(Timestamp{Wall: 5, Logical: 2})
+	if err := json.Unmarshal(b, &ts); err != nil || ts != (Timestamp{Wall: 5, Logical: 2}) {
+		t.Errorf("Got %v and %v from %s", ts, err, b)
+	}
+}
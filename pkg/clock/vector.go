@@ -92,6 +92,15 @@ func (a VectorClock) Max(b VectorClock) {
 	}
 }
 
+// Min modifies a to be the pairwise min of a and b.
+func (a VectorClock) Min(b VectorClock) {
+	for k := range allKeys(a, b) {
+		if a[k] > b[k] {
+			a[k] = b[k]
+		}
+	}
+}
+
 // Copy returns a new identical vector clock.
 func (a VectorClock) Copy() VectorClock {
 	b := make(VectorClock)
@@ -115,6 +124,17 @@ func (a VectorClock) Subset(keys []string) VectorClock {
 	return s
 }
 
+// Prune returns a copy of the clock without the keys that are not given.
+func (a VectorClock) Prune(keys []string) VectorClock {
+	s := VectorClock{}
+	for _, key := range keys {
+		if v, ok := a[key]; ok {
+			s[key] = v
+		}
+	}
+	return s
+}
+
 // allKeys zips together all the keys for two clocks.
 // If any key is missing from one but not the other, it is
 // defaulted to zero in the clock missing the key.
@@ -0,0 +1,52 @@
+package crdt
+
+// Counter counts up and down. Each node only changes its own totals of
+// increments and decrements, so merging takes the larger of each.
+type Counter struct {
+	P map[string]uint64 `json:"p"`
+	N map[string]uint64 `json:"n,omitempty"`
+}
+
+func newCounter() *Counter {
+	return &Counter{P: make(map[string]uint64), N: make(map[string]uint64)}
+}
+
+// Value returns the count.
+func (c *Counter) Value() int64 {
+	var v int64
+	for _, n := range c.P {
+		v += int64(n)
+	}
+	for _, n := range c.N {
+		v -= int64(n)
+	}
+	return v
+}
+
+func (c *Counter) add(node string, amount int64) {
+	if amount >= 0 {
+		c.P[node] += uint64(amount)
+	} else {
+		c.N[node] += uint64(-amount)
+	}
+}
+
+func (c *Counter) merge(other *Counter) *Counter {
+	merged := newCounter()
+	for _, totals := range []map[string]uint64{c.P, other.P} {
+		maxInto(merged.P, totals)
+	}
+	for _, totals := range []map[string]uint64{c.N, other.N} {
+		maxInto(merged.N, totals)
+	}
+	return merged
+}
+
+// maxInto raises each count in a to at least that in b.
+func maxInto(a, b map[string]uint64) {
+	for k, n := range b {
+		if a[k] < n {
+			a[k] = n
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package crdt implements typed values that replicas update independently and
+// merge without losing any update, whatever order the updates arrive in.
+package crdt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+)
+
+// Kind is the type of a value.
+type Kind string
+
+const (
+	GCounter  Kind = "gcounter"
+	PNCounter Kind = "pncounter"
+	ORSet     Kind = "orset"
+	LWWMap    Kind = "lwwmap"
+)
+
+var (
+	ErrBadKind = errors.New("Unknown value type")
+	ErrBadOp   = errors.New("Operation does not apply to the value")
+)
+
+// Value is a value of one of the kinds. Only the field for its kind is set.
+type Value struct {
+	Kind    Kind     `json:"type"`
+	Counter *Counter `json:"counter,omitempty"`
+	Set     *Set     `json:"set,omitempty"`
+	Map     *Map     `json:"map,omitempty"`
+}
+
+// Op is an update to a value. Only the fields for the value's kind may be set.
+type Op struct {
+	// Amount is added to a counter. Only a PN-counter may be decremented.
+	Amount int64
+
+	// Add and Remove are members added to and removed from a set.
+	Add    []string
+	Remove []string
+
+	// Put and Delete are fields set in and deleted from a map.
+	Put    map[string]string
+	Delete []string
+}
+
+// Origin identifies the write that applies an operation.
+type Origin struct {
+	Node      string
+	Timestamp clock.Timestamp
+	Version   uuid.UUID
+}
+
+// New returns the empty value of a kind.
+func New(kind Kind) (Value, error) {
+	v := Value{Kind: kind}
+	switch kind {
+	case GCounter, PNCounter:
+		v.Counter = newCounter()
+	case ORSet:
+		v.Set = newSet()
+	case LWWMap:
+		v.Map = newMap()
+	default:
+		return Value{}, fmt.Errorf("%w %q", ErrBadKind, kind)
+	}
+	return v, nil
+}
+
+// Apply returns the value with an operation applied.
+func (v Value) Apply(op Op, at Origin) (Value, error) {
+	counting := op.Amount != 0
+	setting := len(op.Add) > 0 || len(op.Remove) > 0
+	mapping := len(op.Put) > 0 || len(op.Delete) > 0
+
+	v = v.Copy()
+	switch {
+	case v.Counter != nil && counting && !setting && !mapping:
+		if op.Amount < 0 && v.Kind != PNCounter {
+			return Value{}, ErrBadOp
+		}
+		v.Counter.add(at.Node, op.Amount)
+	case v.Set != nil && setting && !counting && !mapping:
+		for _, m := range op.Add {
+			v.Set.add(at.Node, m)
+		}
+		for _, m := range op.Remove {
+			v.Set.remove(m)
+		}
+	case v.Map != nil && mapping && !counting && !setting:
+		for f, value := range op.Put {
+			v.Map.put(f, value, at)
+		}
+		for _, f := range op.Delete {
+			v.Map.delete(f, at)
+		}
+	default:
+		return Value{}, ErrBadOp
+	}
+	return v, nil
+}
+
+// Merge returns the join of two values of the same kind, which includes every
+// update applied to either.
+func (v Value) Merge(other Value) (Value, error) {
+	if v.Kind != other.Kind {
+		return Value{}, fmt.Errorf("cannot merge %s with %s", v.Kind, other.Kind)
+	}
+	merged := Value{Kind: v.Kind}
+	switch {
+	case v.Counter != nil && other.Counter != nil:
+		merged.Counter = v.Counter.merge(other.Counter)
+	case v.Set != nil && other.Set != nil:
+		merged.Set = v.Set.merge(other.Set)
+	case v.Map != nil && other.Map != nil:
+		merged.Map = v.Map.merge(other.Map)
+	default:
+		return Value{}, fmt.Errorf("%w %q", ErrBadKind, v.Kind)
+	}
+	return merged, nil
+}
+
+// Copy returns a deep copy of the value.
+func (v Value) Copy() Value {
+	c := Value{Kind: v.Kind}
+	if v.Counter != nil {
+		c.Counter = v.Counter.merge(newCounter())
+	}
+	if v.Set != nil {
+		c.Set = v.Set.merge(newSet())
+	}
+	if v.Map != nil {
+		c.Map = v.Map.merge(newMap())
+	}
+	return c
+}
+
+// String renders the value as clients read it: a counter as an integer, a set
+// as a JSON array of its members and a map as a JSON object of its fields.
+func (v Value) String() string {
+	switch {
+	case v.Counter != nil:
+		return fmt.Sprint(v.Counter.Value())
+	case v.Set != nil:
+		return render(v.Set.Members())
+	case v.Map != nil:
+		return render(v.Map.Fields())
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package crdt
+
+import (
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const (
+	Alice = "1.1.1.1:8080"
+	Bob   = "2.2.2.2:8080"
+)
+
+// apply applies an operation or fails the test.
+func apply(t *testing.T, v Value, op Op, at Origin) Value {
+	t.Helper()
+	v, err := v.Apply(op, at)
+	if err != nil {
+		t.Fatalf("Failed to apply %+v: %v", op, err)
+	}
+	return v
+}
+
+// merge merges two values both ways, failing the test unless they agree.
+func merge(t *testing.T, a, b Value) Value {
+	t.Helper()
+	ab, err := a.Merge(b)
+	if err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	ba, err := b.Merge(a)
+	if err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	if ab.String() != ba.String() {
+		t.Errorf("Merge is not commutative: %s and %s", ab, ba)
+	}
+	if again, _ := ab.Merge(a); again.String() != ab.String() {
+		t.Errorf("Merge is not idempotent: %s and %s", again, ab)
+	}
+	return ab
+}
+
+func TestCounter(t *testing.T) {
+	zero, _ := New(PNCounter)
+	a := apply(t, zero, Op{Amount: 5}, Origin{Node: Alice})
+	b := apply(t, zero, Op{Amount: 3}, Origin{Node: Bob})
+	b = apply(t, b, Op{Amount: -1}, Origin{Node: Bob})
+
+	if got := merge(t, a, b).String(); got != "7" {
+		t.Errorf("Got count %s, wanted 7", got)
+	}
+	if got := merge(t, merge(t, a, b), b).String(); got != "7" {
+		t.Errorf("Got count %s after merging twice, wanted 7", got)
+	}
+
+	g, _ := New(GCounter)
+	if _, err := g.Apply(Op{Amount: -1}, Origin{Node: Alice}); err != ErrBadOp {
+		t.Errorf("Decremented a G-counter: %v", err)
+	}
+	if _, err := g.Apply(Op{Add: []string{"x"}}, Origin{Node: Alice}); err != ErrBadOp {
+		t.Errorf("Added to a counter: %v", err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	zero, _ := New(ORSet)
+	a := apply(t, zero, Op{Add: []string{"x", "y"}}, Origin{Node: Alice})
+	b := merge(t, zero, a)
+
+	// Alice removes x while Bob adds it again, and Bob removes y.
+	a = apply(t, a, Op{Remove: []string{"x"}}, Origin{Node: Alice})
+	b = apply(t, b, Op{Add: []string{"x"}}, Origin{Node: Bob})
+	b = apply(t, b, Op{Remove: []string{"y"}}, Origin{Node: Bob})
+	a = apply(t, a, Op{Add: []string{"z"}}, Origin{Node: Alice})
+
+	merged := merge(t, a, b)
+	if diff := cmp.Diff(merged.Set.Members(), []string{"x", "z"}); diff != "" {
+		t.Errorf("Bad members (-got,+want): %s", diff)
+	}
+	if got := merged.String(); got != `["x","z"]` {
+		t.Errorf("Got %s", got)
+	}
+}
+
+func TestMap(t *testing.T) {
+	zero, _ := New(LWWMap)
+	alice, bob := uuid.New(Alice).Next(), uuid.New(Bob).Next()
+	a := apply(t, zero, Op{Put: map[string]string{"f": "a", "g": "a"}}, Origin{Timestamp: clock.Timestamp{Wall: 1}, Version: alice})
+	b := apply(t, zero, Op{Put: map[string]string{"f": "b"}}, Origin{Timestamp: clock.Timestamp{Wall: 2}, Version: bob})
+	b = apply(t, b, Op{Delete: []string{"g"}}, Origin{Timestamp: clock.Timestamp{Wall: 2}, Version: bob})
+
+	merged := merge(t, a, b)
+	if diff := cmp.Diff(merged.Map.Fields(), map[string]string{"f": "b"}); diff != "" {
+		t.Errorf("Bad fields (-got,+want): %s", diff)
+	}
+
+	// An older write does not bring back a deleted field.
+	old := apply(t, zero, Op{Put: map[string]string{"g": "old"}}, Origin{Timestamp: clock.Timestamp{Wall: 1}, Version: alice.Next()})
+	if got := merge(t, merged, old).String(); got != `{"f":"b"}` {
+		t.Errorf("Got %s after an older write", got)
+	}
+}
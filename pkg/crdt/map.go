@@ -0,0 +1,72 @@
+package crdt
+
+import (
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+)
+
+// Map maps fields to strings, and the latest write to a field wins. Writes
+// are ordered by timestamp, then by version, so every replica keeps the same
+// one. A deleted field keeps its register so an older write cannot bring it
+// back.
+type Map struct {
+	Registers map[string]Register `json:"registers"`
+}
+
+// Register is the latest write to a field of a map.
+type Register struct {
+	Value     string          `json:"value,omitempty"`
+	Deleted   bool            `json:"deleted,omitempty"`
+	Timestamp clock.Timestamp `json:"timestamp"`
+	Version   uuid.UUID       `json:"version"`
+}
+
+func newMap() *Map {
+	return &Map{Registers: make(map[string]Register)}
+}
+
+// Fields returns the fields that are set.
+func (m *Map) Fields() map[string]string {
+	fields := make(map[string]string)
+	for f, r := range m.Registers {
+		if !r.Deleted {
+			fields[f] = r.Value
+		}
+	}
+	return fields
+}
+
+func (m *Map) put(f, value string, at Origin) {
+	m.write(f, Register{Value: value, Timestamp: at.Timestamp, Version: at.Version})
+}
+
+func (m *Map) delete(f string, at Origin) {
+	m.write(f, Register{Deleted: true, Timestamp: at.Timestamp, Version: at.Version})
+}
+
+func (m *Map) write(f string, r Register) {
+	if old, ok := m.Registers[f]; !ok || r.after(old) {
+		m.Registers[f] = r
+	}
+}
+
+func (m *Map) merge(other *Map) *Map {
+	merged := newMap()
+	for _, a := range []*Map{m, other} {
+		for f, r := range a.Registers {
+			merged.write(f, r)
+		}
+	}
+	return merged
+}
+
+// after returns true if r was written after other.
+func (r Register) after(other Register) bool {
+	switch r.Timestamp.Compare(other.Timestamp) {
+	case clock.Greater:
+		return true
+	case clock.Less:
+		return false
+	}
+	return r.Version.Greater(other.Version)
+}
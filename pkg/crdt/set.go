@@ -0,0 +1,76 @@
+package crdt
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Set is an observed-remove set. Each add is tagged with a dot, the node that
+// made it and how many adds that node had made, and a remove drops the dots
+// of a member that it saw. A member stays in the set while any dot of it
+// remains, so an add concurrent with a remove wins. Clock counts the adds
+// each node made that the set has seen, which is how a merge tells a dot that
+// was removed from one it has not seen yet, without keeping tombstones.
+type Set struct {
+	Dots  map[string]map[string]uint64 `json:"dots"`
+	Clock map[string]uint64            `json:"clock"`
+}
+
+func newSet() *Set {
+	return &Set{Dots: make(map[string]map[string]uint64), Clock: make(map[string]uint64)}
+}
+
+// Members returns the members of the set in order.
+func (s *Set) Members() []string {
+	members := make([]string, 0, len(s.Dots))
+	for m := range s.Dots {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Contains returns true if m is a member of the set.
+func (s *Set) Contains(m string) bool {
+	_, ok := s.Dots[m]
+	return ok
+}
+
+// add replaces every dot of a member with a new one, as the add saw them all.
+func (s *Set) add(node, m string) {
+	s.Clock[node]++
+	s.Dots[m] = map[string]uint64{node: s.Clock[node]}
+}
+
+func (s *Set) remove(m string) {
+	delete(s.Dots, m)
+}
+
+func (s *Set) merge(other *Set) *Set {
+	merged := newSet()
+	for _, sides := range [][2]*Set{{s, other}, {other, s}} {
+		a, b := sides[0], sides[1]
+		for m, dots := range a.Dots {
+			for node, n := range dots {
+				// Keep dots both sides have, and dots the other side has
+				// not seen. The rest the other side removed.
+				if b.Dots[m][node] != n && b.Clock[node] >= n {
+					continue
+				}
+				if merged.Dots[m] == nil {
+					merged.Dots[m] = make(map[string]uint64)
+				}
+				merged.Dots[m][node] = n
+			}
+		}
+	}
+	maxInto(merged.Clock, s.Clock)
+	maxInto(merged.Clock, other.Clock)
+	return merged
+}
+
+// render marshals v as JSON, which cannot fail for the values rendered here.
+func render(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
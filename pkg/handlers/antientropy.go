@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	ANTI_ENTROPY_ENDPOINT = "/kv-store/anti-entropy"
+)
+
+// antiEntropy periodically compares our entries with those of every other
+// replica in the shard and pulls the keys that differ. It repairs what gossip
+// lost, such as writes made while a replica was down for longer than the
+// sender kept retrying.
+func (s *State) antiEntropy(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, peer := range s.hash.GetReplicas(s.hash.GetShardId(s.address)) {
+				if peer != s.address {
+					s.repairFrom(peer)
+				}
+			}
+		}
+	}
+}
+
+// repairFrom exchanges Merkle trees with a peer and imports its entries for the
+// buckets of keys where the trees differ. Once every entry is repaired we have
+// every write the peer had when it took its tree. The peer repairs itself from
+// us in its own rounds.
+func (s *State) repairFrom(peer string) {
+	var response types.Response
+	resp, err := s.sendHttp(http.MethodGet, peer, ANTI_ENTROPY_ENDPOINT, nil, &response)
+	if err != nil {
+		log.Printf("Failed to get the Merkle tree of %q: %v\n", peer, err)
+		return
+	} else if resp.StatusCode != http.StatusOK || response.Tree == nil {
+		log.Printf("Peer %q returned %d for its Merkle tree\n", peer, resp.StatusCode)
+		return
+	}
+
+	peerClock := response.Tree.Clock
+	buckets := s.store.Tree().Diff(*response.Tree)
+	if len(buckets) == 0 {
+		s.caughtUp(peer, peerClock)
+		return
+	}
+
+	response = types.Response{}
+	resp, err = s.sendHttp(http.MethodPost, peer, ANTI_ENTROPY_ENDPOINT, &types.Input{Buckets: buckets}, &response)
+	if err != nil {
+		log.Printf("Failed to get entries to repair from %q: %v\n", peer, err)
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Peer %q returned %d for entries to repair\n", peer, resp.StatusCode)
+		return
+	}
+
+	repaired := 0
+	for _, e := range response.StorageState {
+		ok, err := s.store.Repair(e)
+		if err != nil {
+			log.Printf("Failed to repair %q from %q: %v\n", e.Key, peer, err)
+			return
+		} else if ok {
+			repaired++
+		}
+	}
+	log.Printf("Anti-entropy with %q found %d buckets that differ, repaired %d of %d entries\n",
+		peer, len(buckets), repaired, len(response.StorageState))
+	s.caughtUp(peer, peerClock)
+}
+
+// caughtUp records that we have every write a peer at the clock had, returning
+// false if we could not.
+func (s *State) caughtUp(peer string, vc clock.VectorClock) bool {
+	if err := s.store.CaughtUp(vc); err != nil {
+		log.Printf("Failed to catch up with the clock of %q: %v\n", peer, err)
+		return false
+	}
+	return true
+}
+
+// treeHandler returns the Merkle tree of our entries.
+func (s *State) treeHandler(in types.Input, res *types.Response) {
+	tree := s.store.Tree()
+	res.Tree = &tree
+}
+
+// bucketsHandler returns our entries in the buckets asked for.
+func (s *State) bucketsHandler(in types.Input, res *types.Response) {
+	res.StorageState = s.store.EntriesIn(in.Buckets)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	BATCH_ENDPOINT       = "/kv-store/batch"
+	SHARD_BATCH_ENDPOINT = "/kv-store/batch-shard"
+
+	MAX_BATCH_SIZE = 1000
+)
+
+// batchHandler performs a list of operations that may span every shard. The
+// operations for each shard are sent to it in one request.
+func (s *State) batchHandler(in types.Input, res *types.Response) {
+	if len(in.Operations) > MAX_BATCH_SIZE {
+		res.Error = msg.BatchTooLarge
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	// Group the operations by shard, remembering where each one came from.
+	groups := make(map[int][]int)
+	for i, op := range in.Operations {
+		if op.Op != types.OpGet && op.Op != types.OpPut && op.Op != types.OpDelete {
+			res.Error = msg.BadOperation
+			res.Status = http.StatusBadRequest
+			return
+		}
+		shardId, err := s.hash.GetKeyShardId(op.Key)
+		if err != nil {
+			log.Printf("Failed to get shard for key %q: %v\n", op.Key, err)
+			res.Status = http.StatusServiceUnavailable
+			res.Error = msg.Unavailable
+			return
+		}
+		groups[shardId] = append(groups[shardId], i)
+	}
+
+	// Each group gets its own copy of the context, since comparing clocks may
+	// add keys to them.
+	results := make([]types.Result, len(in.Operations))
+	clocks := make(chan clock.VectorClock, len(groups))
+	var wg sync.WaitGroup
+	for shardId, indices := range groups {
+		wg.Add(1)
+		go func(shardId int, indices []int, vc clock.VectorClock) {
+			defer wg.Done()
+			ops := make([]types.Operation, len(indices))
+			for i, j := range indices {
+				ops[i] = in.Operations[j]
+			}
+			groupResults, current := s.batchShard(shardId, vc, ops)
+			for i, j := range indices {
+				results[j] = groupResults[i]
+			}
+			clocks <- current
+		}(shardId, indices, in.CausalCtx.Copy())
+	}
+	wg.Wait()
+	close(clocks)
+
+	res.CausalCtx = in.CausalCtx.Copy()
+	for vc := range clocks {
+		if vc != nil {
+			res.CausalCtx.Max(vc)
+		}
+	}
+	res.Results = results
+	res.Message = msg.BatchSuccess
+}
+
+// batchShard performs operations that all belong to one shard, trying each of
+// its replicas in turn. If none can be reached, every operation fails.
+func (s *State) batchShard(shardId int, vc clock.VectorClock, ops []types.Operation) ([]types.Result, clock.VectorClock) {
+	if shardId == s.hash.GetShardId(s.address) {
+		return s.performBatch(vc, ops)
+	}
+
+	for _, replica := range s.hash.GetReplicas(shardId) {
+		var response types.Response
+		resp, err := s.sendHttp(http.MethodPost, replica, SHARD_BATCH_ENDPOINT, &types.Input{
+			CausalCtx:  vc,
+			Operations: ops,
+		}, &response)
+		if err != nil {
+			log.Printf("Failed to send batch for shard %d to %q: %v\n", shardId, replica, err)
+			continue
+		} else if resp.StatusCode != http.StatusOK || len(response.Results) != len(ops) {
+			log.Printf("Replica %q returned %d for batch of shard %d\n", replica, resp.StatusCode, shardId)
+			continue
+		}
+		return response.Results, response.CausalCtx
+	}
+
+	log.Println("All replicas in shard", shardId, "were unreachable for batch")
+	results := make([]types.Result, len(ops))
+	for i := range results {
+		results[i] = types.Result{Status: http.StatusServiceUnavailable, Error: msg.Unavailable}
+	}
+	return results, clock.VectorClock{}
+}
+
+// shardBatchHandler performs a batch on this node's shard for another node.
+func (s *State) shardBatchHandler(in types.Input, res *types.Response) {
+	res.Results, res.CausalCtx = s.performBatch(in.CausalCtx, in.Operations)
+}
+
+// performBatch performs operations in order against the local store, exactly
+// as if each had been sent on its own.
+func (s *State) performBatch(vc clock.VectorClock, ops []types.Operation) ([]types.Result, clock.VectorClock) {
+	handlers := map[string]func(types.Input, *types.Response){
+		types.OpGet:    types.ValidateKey(s.getHandler),
+		types.OpPut:    types.ValidateKey(s.putHandler),
+		types.OpDelete: types.ValidateKey(s.deleteHandler),
+	}
+
+	current := vc.Copy()
+	results := make([]types.Result, len(ops))
+	for i, op := range ops {
+		handler, ok := handlers[op.Op]
+		if !ok {
+			results[i] = types.Result{Status: http.StatusBadRequest, Error: msg.BadOperation}
+			continue
+		}
+
+		var in types.Input
+		in.Key, in.Value = op.Key, op.Value
+		in.CausalCtx = vc
+		res := types.Response{Status: http.StatusOK}
+		handler(in, &res)
+
+		results[i] = types.Result{
+			Status:   res.Status,
+			Message:  res.Message,
+			Value:    res.Value,
+			Error:    res.Error,
+			Exists:   res.Exists,
+			Replaced: res.Replaced,
+			TTL:      res.TTL,
+			Version:  res.Version,
+			Siblings: res.Siblings,
+		}
+		if res.CausalCtx != nil {
+			current.Max(res.CausalCtx)
+		}
+	}
+	return results, current
+}
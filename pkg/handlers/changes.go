@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	CHANGES_ENDPOINT = "/kv-store/changes"
+
+	DEFAULT_CHANGES_LIMIT = 100
+	MAX_CHANGES_LIMIT     = 1000
+)
+
+// changesHandler returns the entries this node committed, written here or
+// imported, in the order it committed them. A reader resumes after the cursor
+// of its last page, which is only meaningful on this node, or after the
+// clock of the changes it has seen, which works on any replica of the shard.
+// Changes that were compacted away are gone, and reading past them fails.
+func (s *State) changesHandler(in types.Input, res *types.Response) {
+	var after uint64
+	if cursor := in.Query.Get("cursor"); cursor != "" {
+		n, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			res.Error = msg.BadCursor
+			res.Status = http.StatusBadRequest
+			return
+		}
+		after = n
+	}
+	limit := DEFAULT_CHANGES_LIMIT
+	if l := in.Query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > MAX_CHANGES_LIMIT {
+			res.Error = msg.BadRange
+			res.Status = http.StatusBadRequest
+			return
+		}
+		limit = n
+	}
+
+	var err error
+	var changes []store.Change
+	var last uint64
+	if after == 0 && len(in.Since) > 0 {
+		err, changes, last = s.store.ChangesSince(in.Since, limit)
+	} else {
+		err, changes, last = s.store.Changes(after, limit)
+	}
+	if errors.Is(err, store.ErrCompacted) {
+		res.Error = msg.ChangesCompacted
+		res.Status = http.StatusGone
+		return
+	} else if err != nil {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
+
+	res.CausalCtx = in.Since.Copy()
+	for _, ch := range changes {
+		res.CausalCtx.Max(ch.Clock.Copy())
+	}
+	res.Changes = changes
+	res.Cursor = strconv.FormatUint(last, 10)
+	res.Address = s.address
+	res.Message = msg.ChangesSuccess
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+// codec numbers the members of our view for compact causal contexts, and
+// remembers those of past views to translate contexts from before a view
+// change.
+func (s *State) codec() clock.Codec {
+	view := s.hash.GetView()
+	return clock.Codec{Epoch: view.Epoch, Members: view.Members, Past: s.hash.PastViews()}
+}
+
+// withCodec lets requests use compact causal contexts in the current view.
+func (s *State) withCodec(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, types.WithCodec(r, s.codec()))
+	})
+}
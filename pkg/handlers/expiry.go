@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+// expiryOf returns when a write should expire. The zero time means never. It
+// returns false if the request asked for an expiry that makes no sense.
+func expiryOf(in types.Input, now time.Time) (time.Time, bool) {
+	switch {
+	case in.TTL != nil && in.ExpiresAt != nil:
+		return time.Time{}, false
+	case in.TTL != nil:
+		if *in.TTL <= 0 {
+			return time.Time{}, false
+		}
+		return now.Add(time.Duration(*in.TTL) * time.Second), true
+	case in.ExpiresAt != nil:
+		if !in.ExpiresAt.After(now) {
+			return time.Time{}, false
+		}
+		return *in.ExpiresAt, true
+	}
+	return time.Time{}, true
+}
+
+// expireEntries periodically deletes entries that have expired.
+func (s *State) expireEntries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := s.store.ExpireEntries(now); err != nil {
+				log.Println("Failed to expire entries:", err)
+			}
+		}
+	}
+}
@@ -138,7 +138,26 @@ func (s *State) forwardMessage(w http.ResponseWriter, r *http.Request) {
 	resp, err := s.cli.Do(request)
 	if err != nil {
 		log.Println("Failed to do proxy request:", err)
-		// Presumably the leader is down.
+		// Presumably the leader is down. Hold the write for it if we may.
+		h := hint{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Header: r.Header.Clone(),
+			Body:   requestBody,
+		}
+		vc := s.contextOf(r, requestBody)
+		if _, ok := r.Header[types.CAUSAL_CONTEXT_HEADER]; ok {
+			h.Context = vc
+		}
+		if s.sloppy(r) && s.hint(nodeAddr, h) {
+			log.Printf("Holding write to %q for %q until it recovers\n", r.URL.Path, nodeAddr)
+			result.Status = http.StatusAccepted
+			result.Message = msg.HintedSuccess
+			result.Hinted = true
+			result.Address = nodeAddr
+			result.CausalCtx = vc
+			return
+		}
 		result.Status = http.StatusServiceUnavailable
 		result.Error = msg.MainFailure
 		return
@@ -151,6 +170,13 @@ func (s *State) forwardMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The node we forwarded to answered a compact causal context in kind.
+	if h, ok := resp.Header[types.CAUSAL_CONTEXT_HEADER]; ok && len(h) > 0 {
+		if result.CausalCtx, err = s.codec().Decode(h[0]); err != nil {
+			log.Println("Could not decode forwarded causal context:", err)
+		}
+	}
+
 	result.Status = resp.StatusCode
 	result.Address = nodeAddr
 	return
@@ -3,70 +3,287 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
+	"github.com/spencer-p/key-value-store/pkg/outbox"
 	"github.com/spencer-p/key-value-store/pkg/store"
 	"github.com/spencer-p/key-value-store/pkg/types"
 )
 
 const (
+	GOSSIP_BATCH_ENDPOINT = "/kv-store/gossip-batch"
+
 	RETRY_TIMEOUT     = 10 * time.Millisecond
 	RETRY_TIMEOUT_MAX = 1 * time.Second
+
+	// DEFAULT_GOSSIP_QUEUE_SIZE is how many items the queue of each peer
+	// keeps in memory unless configured otherwise.
+	DEFAULT_GOSSIP_QUEUE_SIZE = 10000
+
+	// DEFAULT_GOSSIP_BATCH_SIZE is how many items are sent to a peer at most
+	// in one message unless configured otherwise.
+	DEFAULT_GOSSIP_BATCH_SIZE = 100
 )
 
+// queues holds the outbound queue of each peer we gossip to.
+type queues struct {
+	m     sync.Mutex
+	peers map[string]*outbox.Queue
+	opts  outbox.Options
+
+	// batch is the most items sent in one message, and linger how long to
+	// wait for that many.
+	batch  int
+	linger time.Duration
+}
+
+// dispatchGossip queues every write in the journal for each other replica in
+// our shard.
 func (s *State) dispatchGossip(ctx context.Context, journal <-chan store.Entry) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case e := <-journal:
-			go func() {
-				var wg sync.WaitGroup
-				members := s.hash.GetReplicas(s.hash.GetShardId(s.address))
-				for i := range members {
-					if s.address != members[i] /*_, visitedNode := e.NodeHistory[members[i]]; !visitedNode*/ {
-						wg.Add(1)
-						go func(addr string) {
-							s.sendGossip(ctx, e, addr)
-							wg.Done()
-						}(members[i])
-					}
-				}
-				wg.Wait()
-				for i := range members {
-					if s.address != members[i] {
-						go s.sendIncrement(members[i], s.address)
-					}
-				}
-			}()
-		}
-	}
-}
-
-func (s *State) sendIncrement(node string, origin string) {
+			for _, peer := range s.peers() {
+				s.queueFor(ctx, peer).Push(outbox.Item{Entry: &e})
+			}
+		}
+	}
+}
+
+// peers returns the other replicas in our shard.
+func (s *State) peers() []string {
+	var peers []string
+	for _, replica := range s.hash.GetReplicas(s.hash.GetShardId(s.address)) {
+		if replica != s.address {
+			peers = append(peers, replica)
+		}
+	}
+	return peers
+}
+
+// queueFor returns the queue of a peer, opening it and starting to deliver it
+// the first time.
+func (s *State) queueFor(ctx context.Context, peer string) *outbox.Queue {
+	s.queues.m.Lock()
+	defer s.queues.m.Unlock()
+	if q, ok := s.queues.peers[peer]; ok {
+		return q
+	}
+
+	q, err := outbox.Open(url.PathEscape(peer), s.queues.opts)
+	if err != nil {
+		log.Printf("Failed to open the gossip queue of %q, keeping it in memory: %v\n", peer, err)
+		mem := s.queues.opts
+		mem.Dir = ""
+		q, _ = outbox.Open(peer, mem)
+	}
+	s.queues.peers[peer] = q
+	go s.deliver(ctx, peer, q)
+	go s.deliverCounts(ctx, peer, q)
+	return q
+}
+
+// retireQueues discards the queues of peers that are no longer replicas in our
+// shard after a view change.
+func (s *State) retireQueues() {
+	peers := make(map[string]bool)
+	for _, peer := range s.peers() {
+		peers[peer] = true
+	}
+
+	s.queues.m.Lock()
+	defer s.queues.m.Unlock()
+	for peer, q := range s.queues.peers {
+		if peers[peer] {
+			continue
+		}
+		log.Printf("Discarding %d items queued for %q\n", q.Stats().Depth, peer)
+		if err := q.Discard(); err != nil {
+			log.Printf("Failed to discard the gossip queue of %q: %v\n", peer, err)
+		}
+		delete(s.queues.peers, peer)
+	}
+}
+
+// closeQueues stops every queue, keeping what is left on disk if it can.
+func (s *State) closeQueues() error {
+	s.queues.m.Lock()
+	defer s.queues.m.Unlock()
+	var err error
+	for peer, q := range s.queues.peers {
+		if cerr := q.Close(); cerr != nil {
+			log.Printf("Failed to keep the gossip queue of %q: %v\n", peer, cerr)
+			err = cerr
+		}
+	}
+	return err
+}
+
+// deliver sends the items of a peer's queue in order, in batches, retrying
+// each batch until it is delivered.
+func (s *State) deliver(ctx context.Context, peer string, q *outbox.Queue) {
+	for {
+		items, ok := q.Next(ctx, s.queues.batch, s.queues.linger)
+		if !ok {
+			return
+		}
+
+		if !s.retry(ctx, func() bool { return s.sendBatch(ctx, peer, items) }) {
+			return
+		}
+		q.Done()
+	}
+}
+
+// deliverCounts tells a peer how many writes other replicas imported, apart
+// from the writes in its queue. The peer may need the counts to import a write
+// from another replica before it can import the next of ours.
+// Failed counts are given back to the queue before retrying, so that they are
+// kept if it closes.
+func (s *State) deliverCounts(ctx context.Context, peer string, q *outbox.Queue) {
 	tout := RETRY_TIMEOUT
 	for {
-		var res types.GossipResponse
-		resp, err := s.sendHttp(http.MethodPut,
-			node, "/kv-store/gossip-increment",
-			&types.IncrementInput{Origin: origin}, &res,
-		)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			log.Println("Failed to send increment to", node, "because", err)
-			log.Println("Trying again")
-			time.Sleep(tout)
-			tout *= 2
-			if tout > RETRY_TIMEOUT_MAX {
-				tout = RETRY_TIMEOUT_MAX
-			}
+		counts, ok := q.Counts(ctx, s.queues.linger)
+		if !ok {
+			return
+		}
+		batch := types.GossipBatch{Origin: s.address, Imports: counts}
+		delivered := s.sendCounts(peer, &batch)
+		q.CountsDone(delivered)
+		if delivered {
+			tout = RETRY_TIMEOUT
 			continue
 		}
-		break
+
+		// Back off as retry does
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(tout):
+		}
+		tout *= 2
+		if tout > RETRY_TIMEOUT_MAX {
+			tout = RETRY_TIMEOUT_MAX
+		}
+	}
+}
+
+// retry calls send with exponential backoff until it succeeds, returning false
+// if the context is done first.
+func (s *State) retry(ctx context.Context, send func() bool) bool {
+	// Perform exponential backoff with a max of one second
+	tout := RETRY_TIMEOUT
+	for !send() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(tout):
+		}
+		tout *= 2
+		if tout > RETRY_TIMEOUT_MAX {
+			tout = RETRY_TIMEOUT_MAX
+		}
+	}
+	return true
+}
+
+// sendCounts sends a peer a batch of import counts, returning true if it
+// succeeded.
+func (s *State) sendCounts(node string, batch *types.GossipBatch) bool {
+	var res types.GossipResponse
+	resp, err := s.sendHttp(http.MethodPut, node, GOSSIP_BATCH_ENDPOINT, batch, &res)
+	if err != nil {
+		log.Printf("Failed to send import counts to %s: %v\n", node, err)
+		return false
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Replica %q returned %d for import counts\n", node, resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// sendBatch sends a peer the writes of a batch of items in order, returning
+// true if it succeeded. Every other replica is then told the peer imported the
+// writes.
+func (s *State) sendBatch(ctx context.Context, node string, items []outbox.Item) bool {
+	batch := types.GossipBatch{Origin: s.address}
+	for _, it := range items {
+		batch.Writes = append(batch.Writes, types.GossipInput{Entry: *it.Entry, Origin: s.address, Skipped: it.Skipped})
+	}
+
+	log.Printf("Sending gossip of %d writes to %s\n", len(batch.Writes), node)
+	var res types.GossipResponse
+	resp, err := s.sendHttp(http.MethodPut, node, GOSSIP_BATCH_ENDPOINT, &batch, &res)
+	if err != nil {
+		log.Printf("Failed to gossip %d writes to %s: %v\n", len(batch.Writes), node, err)
+		return false
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Replica %q returned %d for gossip of %d writes\n", node, resp.StatusCode, len(batch.Writes))
+		return false
+	}
+
+	// The writes they imported were events there, which we and every other
+	// replica count. Those they did not import were not. The other replicas
+	// are only told of what we counted ourselves.
+	if res.Count <= 0 {
+		return true
+	}
+	if err := s.store.BumpClockForNodes(map[string]uint64{node: uint64(res.Count)}); err != nil {
+		log.Println("Failed to count gossip imported by", node, "because", err)
+		return true
+	}
+	for _, peer := range s.peers() {
+		if peer != node {
+			s.queueFor(ctx, peer).Count(node, uint64(res.Count))
+		}
+	}
+	return true
+}
+
+// receiveBatch counts the writes other replicas imported, then imports a batch
+// of writes in the order they were made.
+func (s *State) receiveBatch(w http.ResponseWriter, r *http.Request) {
+	var res types.GossipResponse
+	defer func() {
+		if err := json.NewEncoder(w).Encode(&res); err != nil {
+			log.Println("Failed to encode gossip response:", err)
+		}
+	}()
+
+	var in types.GossipBatch
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		log.Println("Received malformed gossip:", err)
+		return
+	}
+	if err := s.countImports(in.Origin, in.Imports); err != nil {
+		log.Printf("Failed to count imports from %s: %v\n", in.Origin, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if len(in.Writes) == 0 {
+		return
+	}
+	log.Printf("Import gossip of %d writes from %s\n", len(in.Writes), in.Origin)
+
+	batch := make([]store.Import, len(in.Writes))
+	for i, write := range in.Writes {
+		batch[i] = store.Import{Entry: write.Entry, Skipped: write.Skipped}
 	}
+	imported, err := s.store.ImportBatch(in.Origin, batch)
+	if err != nil {
+		log.Printf("Failed to import %d of %d writes from %s: %v\n", len(batch)-imported, len(batch), in.Origin, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	res.Imported = true
+	res.Count = imported
 }
 
 func (s *State) receiveIncrement(w http.ResponseWriter, r *http.Request) {
@@ -83,13 +300,35 @@ func (s *State) receiveIncrement(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	replicas := s.hash.GetReplicas(s.hash.GetShardId(s.address))
-	for i := range replicas {
-		if replicas[i] == s.address || replicas[i] == in.Origin {
-			continue
+	if in.Imports != nil {
+		if err := s.countImports(in.Origin, in.Imports); err != nil {
+			log.Printf("Failed to count imports from %s: %v\n", in.Origin, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		return
+	}
+	counts := make(map[string]uint64)
+	for _, replica := range s.hash.GetReplicas(s.hash.GetShardId(s.address)) {
+		if replica != s.address && replica != in.Origin {
+			counts[replica] = 1
+		}
+	}
+	if err := s.store.BumpClockForNodes(counts); err != nil {
+		log.Println("Failed to count increment because", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// countImports counts the writes from origin that each other replica imported
+// as events on that replica, all at once so that a retry counts none twice.
+func (s *State) countImports(origin string, imports map[string]uint64) error {
+	counts := make(map[string]uint64)
+	for _, replica := range s.hash.GetReplicas(s.hash.GetShardId(s.address)) {
+		if replica != s.address && replica != origin && imports[replica] > 0 {
+			counts[replica] = imports[replica]
 		}
-		s.store.BumpClockForNode(replicas[i])
 	}
+	return s.store.BumpClockForNodes(counts)
 }
 
 func (s *State) receiveGossip(w http.ResponseWriter, r *http.Request) {
@@ -100,14 +339,21 @@ func (s *State) receiveGossip(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	var e store.Entry
-	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+	var in types.GossipInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
 		log.Println("Received malformed gossip:", err)
 		return
 	}
+	e := in.Entry
 	log.Printf("Import gossip of %q\n", e.Key)
 
-	imported, err := s.store.ImportEntry(e)
+	var imported bool
+	var err error
+	if in.Skipped > 0 {
+		imported, err = s.store.ImportCoalesced(e, in.Origin, in.Skipped)
+	} else {
+		imported, err = s.store.ImportEntry(e)
+	}
 	if err != nil {
 		log.Printf("Failed to import entry %v: %v\n", e, err)
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -117,48 +363,16 @@ func (s *State) receiveGossip(w http.ResponseWriter, r *http.Request) {
 	res.Imported = imported
 }
 
-func (s *State) sendGossip(ctx context.Context, e store.Entry, node string) {
-	log.Printf("Sending gossip of %v to %s\n", e, node)
-	tout := RETRY_TIMEOUT
-	for {
-		var res types.GossipResponse
-		resp, err := s.sendHttp(
-			http.MethodPut,
-			node, "/kv-store/gossip",
-			&e, &res,
-		)
-
-		if gossipSucceeded(resp, err) {
-			// Successfully gossipped.
-			if res.Imported {
-				// If they also imported it, we can count that as an event.
-				s.store.BumpClockForNode(node)
-			}
-			return
-		}
-
-		log.Printf("Failed to gossip %v: %v\n", e, err)
-		log.Println("Retrying after timeout")
-
-		// Perform exponential backoff with a max of one second
-		time.Sleep(tout)
-		tout *= 2
-		if tout > RETRY_TIMEOUT_MAX {
-			tout = RETRY_TIMEOUT_MAX
-		}
+// queuesHandler reports the gossip queued for each peer.
+func (s *State) queuesHandler(in types.Input, res *types.Response) {
+	res.Queues = make(map[string]outbox.Stats)
+	for _, peer := range s.peers() {
+		res.Queues[peer] = outbox.Stats{}
 	}
-}
 
-func gossipSucceeded(resp *http.Response, err error) bool {
-	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-		// Returned an error that does not have to do with the context being cancelled.
-		return false
-	} else if resp.StatusCode != http.StatusOK {
-		// The target rejected it for some reason. This is OK
-		return false
+	s.queues.m.Lock()
+	defer s.queues.m.Unlock()
+	for peer, q := range s.queues.peers {
+		res.Queues[peer] = q.Stats()
 	}
-	// There may have been a context error, which means the gossip did not succeed.
-	// However, we should stop looping forever if the context is closed.
-	// In the common case, this was no error and a 200 from the other node.
-	return true
 }
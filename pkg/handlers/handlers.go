@@ -3,11 +3,17 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"path/filepath"
+	"time"
 
+	"github.com/spencer-p/key-value-store/pkg/crdt"
 	"github.com/spencer-p/key-value-store/pkg/hash"
 	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/outbox"
 	"github.com/spencer-p/key-value-store/pkg/store"
 	"github.com/spencer-p/key-value-store/pkg/types"
 
@@ -19,6 +25,59 @@ type State struct {
 	hash    *hash.Hash
 	address string
 	cli     *http.Client
+	txns    *coordinator
+	queues  *queues
+	syncs   *syncs
+	hints   *hints
+}
+
+// Options configures optional behavior of a node.
+type Options struct {
+	// Store configures durability of the node's storage.
+	Store store.Options
+
+	// SnapshotInterval is how often a persistent store is snapshotted. Zero
+	// disables periodic snapshots.
+	SnapshotInterval time.Duration
+
+	// TombstoneInterval is how often replicas exchange clocks and collect
+	// tombstones they have all seen. Zero disables collection.
+	TombstoneInterval time.Duration
+
+	// ExpiryInterval is how often expired entries are deleted. Zero disables
+	// deleting them, though they are still hidden from reads.
+	ExpiryInterval time.Duration
+
+	// TxnTimeout is how long a transaction across shards may stay prepared
+	// before its coordinator is asked what became of it. Zero disables
+	// resolving transactions after a failure.
+	TxnTimeout time.Duration
+
+	// AntiEntropyInterval is how often replicas compare their entries and
+	// repair those that differ. Zero disables anti-entropy.
+	AntiEntropyInterval time.Duration
+
+	// GossipQueueSize is how many writes queued for each peer are kept in
+	// memory. Those beyond it spill to the store's directory if it has one,
+	// and are dropped otherwise, unless anti-entropy is disabled and could
+	// not repair them. Zero uses DEFAULT_GOSSIP_QUEUE_SIZE.
+	GossipQueueSize int
+
+	// GossipBatchSize is how many writes and imports are sent to a peer at
+	// most in one message. Zero uses DEFAULT_GOSSIP_BATCH_SIZE.
+	GossipBatchSize int
+
+	// GossipLinger is how long to wait for a full batch before sending what
+	// is queued. Zero sends it right away.
+	GossipLinger time.Duration
+
+	// HintedHandoff lets every write whose owner cannot be reached be held
+	// for it and handed off later, not just those that ask to be.
+	HintedHandoff bool
+
+	// HandoffInterval is how often the owners of held writes are checked.
+	// Zero uses DEFAULT_HANDOFF_INTERVAL.
+	HandoffInterval time.Duration
 }
 
 func (s *State) deleteHandler(in types.Input, res *types.Response) {
@@ -28,8 +87,27 @@ func (s *State) deleteHandler(in types.Input, res *types.Response) {
 		return
 	}
 
-	err, ok, vc := s.store.Delete(in.CausalCtx, in.Key)
-	if err != nil {
+	precondition, ok := preconditionOf(in)
+	if !ok {
+		res.Error = msg.BadPrecondition
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	err, ok, vc := s.store.DeleteWithOptions(in.CausalCtx, in.Key, store.DeleteOptions{
+		Precondition: precondition,
+	})
+	if errors.Is(err, store.ErrPreconditionFailed) {
+		res.Status = http.StatusPreconditionFailed
+		res.Error = msg.PreconditionFailed
+		res.CausalCtx = vc
+		return
+	} else if errors.Is(err, store.ErrKeyLocked) {
+		res.Status = http.StatusConflict
+		res.Error = msg.KeyLocked
+		res.CausalCtx = vc
+		return
+	} else if err != nil {
 		res.Status = http.StatusServiceUnavailable
 		res.Error = msg.Unavailable
 		return
@@ -58,6 +136,18 @@ func (s *State) getHandler(in types.Input, res *types.Response) {
 	if ok {
 		res.Message = msg.GetSuccess
 		res.Value = e.Value
+		res.Version = &e.Version
+		res.Siblings = types.SiblingsOf(e)
+		if !e.Timestamp.IsZero() {
+			res.Timestamp = &e.Timestamp
+		}
+		if e.CRDT != nil {
+			res.Type = e.CRDT.Kind
+		}
+		if ttl, expires := e.TTL(time.Now()); expires {
+			res.TTL = new(int64)
+			*res.TTL = int64(math.Ceil(ttl.Seconds()))
+		}
 	} else {
 		res.Error = msg.KeyDNE
 		res.Status = http.StatusNotFound
@@ -84,8 +174,35 @@ func (s *State) putHandler(in types.Input, res *types.Response) {
 		return
 	}
 
-	err, replaced, vc := s.store.Write(in.CausalCtx, in.Key, in.Value)
-	if err != nil {
+	expiresAt, ok := expiryOf(in, time.Now())
+	if !ok {
+		res.Error = msg.BadExpiry
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	precondition, ok := preconditionOf(in)
+	if !ok {
+		res.Error = msg.BadPrecondition
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	err, replaced, vc := s.store.WriteWithOptions(in.CausalCtx, in.Key, in.Value, store.WriteOptions{
+		ExpiresAt:    expiresAt,
+		Precondition: precondition,
+	})
+	if errors.Is(err, store.ErrPreconditionFailed) {
+		res.Status = http.StatusPreconditionFailed
+		res.Error = msg.PreconditionFailed
+		res.CausalCtx = vc
+		return
+	} else if errors.Is(err, store.ErrKeyLocked) {
+		res.Status = http.StatusConflict
+		res.Error = msg.KeyLocked
+		res.CausalCtx = vc
+		return
+	} else if err != nil {
 		res.Status = http.StatusServiceUnavailable
 		res.Error = msg.Unavailable
 		return
@@ -101,6 +218,16 @@ func (s *State) putHandler(in types.Input, res *types.Response) {
 	}
 }
 
+// preconditionOf returns the precondition a request asks for. It returns false
+// if the request asks for one no write could pass: that the key be absent and
+// hold a version.
+func preconditionOf(in types.Input) (store.Precondition, bool) {
+	return store.Precondition{
+		Version:  in.Version,
+		IfAbsent: in.IfAbsent,
+	}, !(in.IfAbsent && in.Version != nil)
+}
+
 func (s *State) idHandler(in types.Input, res *types.Response) {
 	err, KeyCount, CausalCtx := s.store.NumKeys(in.CausalCtx)
 	if err != nil {
@@ -126,33 +253,127 @@ func (s *State) shardsHandler(in types.Input, res *types.Response) {
 	res.CausalCtx = s.store.Clock()
 }
 
-func NewState(ctx context.Context, addr string, view types.View) *State {
+func NewState(ctx context.Context, addr string, view types.View, opts Options) (*State, error) {
 	journal := make(chan store.Entry, 10)
 	hash := hash.New(view)
+	st, err := store.Open(addr, hash.GetReplicas(hash.GetShardId(addr)), journal, opts.Store)
+	if err != nil {
+		return nil, err
+	}
 	s := &State{
-		store:   store.New(addr, hash.GetReplicas(hash.GetShardId(addr)), journal),
+		store:   st,
 		hash:    hash,
 		address: addr,
 		cli: &http.Client{
 			Timeout: CLIENT_TIMEOUT,
 		},
+		txns: &coordinator{active: make(map[string]bool)},
+		syncs: &syncs{
+			acked:   make(map[string]uint64),
+			running: make(map[string]bool),
+		},
+		queues: &queues{
+			peers: make(map[string]*outbox.Queue),
+			opts: outbox.Options{
+				Capacity: opts.GossipQueueSize,
+				KeepAll:  opts.AntiEntropyInterval <= 0,
+			},
+			batch:  opts.GossipBatchSize,
+			linger: opts.GossipLinger,
+		},
+		hints: &hints{
+			pending: make(map[string][]hint),
+			stats:   make(map[string]*types.HintStats),
+			sloppy:  opts.HintedHandoff,
+		},
+	}
+	if s.queues.opts.Capacity == 0 {
+		s.queues.opts.Capacity = DEFAULT_GOSSIP_QUEUE_SIZE
+	}
+	if s.queues.batch == 0 {
+		s.queues.batch = DEFAULT_GOSSIP_BATCH_SIZE
+	}
+	if opts.Store.Dir != "" {
+		s.queues.opts.Dir = filepath.Join(opts.Store.Dir, "outbox")
+		s.hints.dir = filepath.Join(opts.Store.Dir, "hints")
+		if err := s.loadHints(); err != nil {
+			log.Println("Failed to recover hinted writes:", err)
+		}
 	}
 
 	log.Println("Starting gossip dispatcher")
 	go s.dispatchGossip(ctx, journal)
 
-	return s
+	if opts.Store.Dir != "" && opts.SnapshotInterval > 0 {
+		go s.snapshotPeriodically(ctx, opts.SnapshotInterval)
+	}
+
+	if opts.TombstoneInterval > 0 {
+		go s.collectTombstones(ctx, opts.TombstoneInterval)
+	}
+
+	if opts.ExpiryInterval > 0 {
+		go s.expireEntries(ctx, opts.ExpiryInterval)
+	}
+
+	if opts.TxnTimeout > 0 {
+		go s.resolveTransactions(ctx, opts.TxnTimeout)
+	}
+
+	if opts.AntiEntropyInterval > 0 {
+		go s.antiEntropy(ctx, opts.AntiEntropyInterval)
+	}
+
+	if opts.HandoffInterval == 0 {
+		opts.HandoffInterval = DEFAULT_HANDOFF_INTERVAL
+	}
+	go s.handOff(ctx, opts.HandoffInterval)
+
+	go s.catchUp()
+
+	return s, nil
+}
+
+// Close releases the resources held by the node's storage and gossip queues.
+func (s *State) Close() error {
+	qerr := s.closeQueues()
+	if err := s.store.Close(); err != nil {
+		return err
+	}
+	return qerr
 }
 
 func (s *State) Route(r *mux.Router) {
+	r.Use(s.withCodec)
 	r.HandleFunc("/kv-store/gossip", s.receiveGossip).Methods(http.MethodPut)
+	r.HandleFunc("/kv-store/gossip-batch", s.receiveBatch).Methods(http.MethodPut)
 	r.HandleFunc("/kv-store/gossip-increment", s.receiveIncrement)
+	r.HandleFunc("/kv-store/gossip-ack", s.receiveAck).Methods(http.MethodPut)
 	r.HandleFunc("/kv-store/key-count", types.WrapHTTP(s.countHandler)).Methods(http.MethodGet)
 
 	r.HandleFunc("/kv-store/shards", types.WrapHTTP(s.shardsHandler)).Methods(http.MethodGet)
 	r.HandleFunc("/kv-store/shards/{key:[0-9]+}", s.forwardMessage).MatcherFunc(s.shouldForwardId).Methods(http.MethodGet)
 	r.HandleFunc("/kv-store/shards/{key:[0-9]+}", types.WrapHTTP(s.idHandler)).Methods(http.MethodGet)
 
+	r.HandleFunc("/kv-store/keys", types.WrapHTTP(s.keysHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/list", s.listHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/watch", s.watchHandler).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/changes", types.WrapHTTP(s.changesHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/batch", types.WrapHTTP(s.batchHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/batch-shard", types.WrapHTTP(s.shardBatchHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/txn", types.WrapHTTP(s.txnHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/global-txn", types.WrapHTTP(s.globalTxnHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/global-txn/prepare", types.WrapHTTP(s.prepareHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/global-txn/commit", types.WrapHTTP(s.commitHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/global-txn/abort", types.WrapHTTP(s.abortHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/global-txn/status", types.WrapHTTP(s.txnStatusHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/{kind:counters|sets|maps}/{key}/{op}", s.forwardMessage).MatcherFunc(s.shouldForwardUpdate).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/counters/{key}/incr", types.WrapHTTP(types.ValidateKey(s.updateHandler(crdt.PNCounter, incrOf)))).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/counters/{key}/decr", types.WrapHTTP(types.ValidateKey(s.updateHandler(crdt.PNCounter, decrOf)))).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/sets/{key}/add", types.WrapHTTP(types.ValidateKey(s.updateHandler(crdt.ORSet, addOf)))).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/sets/{key}/remove", types.WrapHTTP(types.ValidateKey(s.updateHandler(crdt.ORSet, removeOf)))).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/maps/{key}/put", types.WrapHTTP(types.ValidateKey(s.updateHandler(crdt.LWWMap, putOf)))).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/maps/{key}/delete", types.WrapHTTP(types.ValidateKey(s.updateHandler(crdt.LWWMap, deleteOf)))).Methods(http.MethodPost)
 	r.HandleFunc("/kv-store/keys/{key:.*}", s.forwardMessage).MatcherFunc(s.shouldForwardKey).Methods(http.MethodPut, http.MethodDelete)
 	r.HandleFunc("/kv-store/keys/{key:.*}", s.forwardMessage).MatcherFunc(s.shouldForwardRead).Methods(http.MethodGet)
 	r.HandleFunc("/kv-store/keys/{key:.*}", types.WrapHTTP(types.ValidateKey(s.putHandler))).Methods(http.MethodPut)
@@ -164,4 +385,13 @@ func (s *State) Route(r *mux.Router) {
 	r.HandleFunc("/kv-store/view-change/primary-replace", types.WrapHTTP(s.primaryReplace))
 	r.HandleFunc("/kv-store/view-change/secondary-collect", types.WrapHTTP(s.secondaryCollect))
 	r.HandleFunc("/kv-store/view-change/secondary-replace", types.WrapHTTP(s.secondaryReplace))
+
+	r.HandleFunc("/kv-store/sync", types.WrapHTTP(s.deltaHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/anti-entropy", types.WrapHTTP(s.treeHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/anti-entropy", types.WrapHTTP(s.bucketsHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/scan", types.WrapHTTP(s.scanHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/admin/snapshot", types.WrapHTTP(s.snapshotHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/kv-store/admin/gossip", types.WrapHTTP(s.queuesHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/admin/hints", types.WrapHTTP(s.hintsHandler)).Methods(http.MethodGet)
+	r.HandleFunc("/kv-store/health", types.WrapHTTP(s.healthHandler)).Methods(http.MethodGet)
 }
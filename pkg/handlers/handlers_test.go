@@ -5,12 +5,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/spencer-p/key-value-store/pkg/clock"
 	"github.com/spencer-p/key-value-store/pkg/msg"
 	"github.com/spencer-p/key-value-store/pkg/ptr"
+	"github.com/spencer-p/key-value-store/pkg/store"
 	"github.com/spencer-p/key-value-store/pkg/types"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/gorilla/mux"
@@ -158,10 +165,13 @@ func TestPut(t *testing.T) {
 
 			// Create one server per set of requests
 			r := mux.NewRouter()
-			s := NewState(context.Background(), FAKE_ADDRESS, types.View{
+			s, err := NewState(context.Background(), FAKE_ADDRESS, types.View{
 				Members:    []string{FAKE_ADDRESS},
 				ReplFactor: 1,
-			})
+			}, Options{})
+			if err != nil {
+				t.Fatalf("Failed to create state: %v", err)
+			}
 			s.Route(r)
 
 			for i, test := range requests {
@@ -181,8 +191,10 @@ func TestPut(t *testing.T) {
 						t.Errorf("Failed to parse response: %v", err)
 					}
 
-					// ignore the clock
+					// ignore the clock, version and timestamp
 					got.CausalCtx = nil
+					got.Version = nil
+					got.Timestamp = nil
 
 					if diff := cmp.Diff(&got, &test.want); diff != "" {
 						t.Errorf("Got bad body (-got, +want): %s", diff)
@@ -196,3 +208,815 @@ func TestPut(t *testing.T) {
 		})
 	}
 }
+
+// newTestRouter routes a single node cluster.
+func newTestRouter(t *testing.T) *mux.Router {
+	t.Helper()
+	r := mux.NewRouter()
+	s, err := NewState(context.Background(), FAKE_ADDRESS, types.View{
+		Members:    []string{FAKE_ADDRESS},
+		ReplFactor: 1,
+	}, Options{})
+	if err != nil {
+		t.Fatalf("Failed to create state: %v", err)
+	}
+	s.Route(r)
+	return r
+}
+
+// do sends a request with a raw JSON body and parses the response.
+func do(t *testing.T, r *mux.Router, method, path, body string) (types.Response, int) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	var got types.Response
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Errorf("Failed to parse response: %v", err)
+	}
+	return got, resp.Code
+}
+
+func TestTTL(t *testing.T) {
+	r := newTestRouter(t)
+
+	if _, code := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1","ttl":-5}`); code != 400 {
+		t.Errorf("Got status %d for a negative TTL, wanted 400", code)
+	}
+	if _, code := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1","ttl":5,"expires-at":"2030-01-01T00:00:00Z"}`); code != 400 {
+		t.Errorf("Got status %d for both a TTL and expiry, wanted 400", code)
+	}
+
+	if _, code := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1","ttl":100}`); code != 201 {
+		t.Errorf("Got status %d for a TTL write, wanted 201", code)
+	}
+	got, _ := do(t, r, "GET", "/kv-store/keys/x", `{}`)
+	if got.TTL == nil || *got.TTL > 100 || *got.TTL < 99 {
+		t.Errorf("Got TTL %v, wanted 100", got.TTL)
+	}
+
+	do(t, r, "PUT", "/kv-store/keys/y", `{"value":"1"}`)
+	if got, _ := do(t, r, "GET", "/kv-store/keys/y", `{}`); got.TTL != nil {
+		t.Errorf("Got TTL %d for a key with no expiry", *got.TTL)
+	}
+}
+
+func TestConditional(t *testing.T) {
+	r := newTestRouter(t)
+
+	if _, code := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1","if-absent":true}`); code != 201 {
+		t.Errorf("Got status %d creating an absent key, wanted 201", code)
+	}
+	if _, code := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"2","if-absent":true}`); code != 412 {
+		t.Errorf("Got status %d creating an existing key, wanted 412", code)
+	}
+
+	got, _ := do(t, r, "GET", "/kv-store/keys/x", `{}`)
+	if got.Version == nil {
+		t.Fatalf("GET did not return a version")
+	}
+	version, _ := json.Marshal(got.Version)
+
+	if _, code := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"2","version":`+string(version)+`}`); code != 200 {
+		t.Errorf("Got status %d updating the current version, wanted 200", code)
+	}
+	if _, code := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"3","version":`+string(version)+`}`); code != 412 {
+		t.Errorf("Got status %d updating a stale version, wanted 412", code)
+	}
+	if _, code := do(t, r, "DELETE", "/kv-store/keys/x", `{"version":`+string(version)+`}`); code != 412 {
+		t.Errorf("Got status %d deleting a stale version, wanted 412", code)
+	}
+	for _, method := range []string{"PUT", "DELETE"} {
+		if _, code := do(t, r, method, "/kv-store/keys/x", `{"value":"3","if-absent":true,"version":`+string(version)+`}`); code != 400 {
+			t.Errorf("Got status %d for %s asking for an absent key and a version, wanted 400", code, method)
+		}
+	}
+	if got, _ := do(t, r, "GET", "/kv-store/keys/x", `{}`); got.Value != "2" {
+		t.Errorf("Got x=%q after failed writes, wanted 2", got.Value)
+	}
+}
+
+func TestScan(t *testing.T) {
+	r := newTestRouter(t)
+	for _, key := range []string{"c", "a", "b", "d"} {
+		do(t, r, "PUT", "/kv-store/keys/"+key, `{"value":"v"}`)
+	}
+
+	got, code := do(t, r, "GET", "/kv-store/keys?limit=2", `{}`)
+	if code != 200 {
+		t.Fatalf("Got status %d for scan, wanted 200", code)
+	}
+	if diff := cmp.Diff(got.Keys, []types.Entry{{Key: "a", Value: "v"}, {Key: "b", Value: "v"}}); diff != "" {
+		t.Errorf("Bad first page (-got,+want): %s", diff)
+	}
+
+	got, _ = do(t, r, "GET", "/kv-store/keys?limit=2&cursor="+got.Cursor, `{}`)
+	if diff := cmp.Diff(got.Keys, []types.Entry{{Key: "c", Value: "v"}, {Key: "d", Value: "v"}}); diff != "" {
+		t.Errorf("Bad second page (-got,+want): %s", diff)
+	}
+	if got.Cursor != "" {
+		t.Errorf("Got cursor %q on the last page", got.Cursor)
+	}
+
+	if _, code := do(t, r, "GET", "/kv-store/keys?limit=0", `{}`); code != 400 {
+		t.Errorf("Got status %d for a bad limit, wanted 400", code)
+	}
+}
+
+func TestList(t *testing.T) {
+	r := newTestRouter(t)
+	for _, key := range []string{"c", "a", "b"} {
+		do(t, r, "PUT", "/kv-store/keys/"+key, `{"value":"v"}`)
+	}
+
+	got, code := do(t, r, "GET", "/kv-store/list", `{}`)
+	if code != 200 {
+		t.Fatalf("Got status %d for list, wanted 200", code)
+	}
+	want := []types.Entry{{Key: "a", Value: "v"}, {Key: "b", Value: "v"}, {Key: "c", Value: "v"}}
+	if diff := cmp.Diff(got.Keys, want); diff != "" {
+		t.Errorf("Bad key list (-got,+want): %s", diff)
+	}
+	if got.Cursor != "" || len(got.MissingShards) != 0 || len(got.CausalCtx) == 0 {
+		t.Errorf("Got cursor %q, missing shards %v, and context %v", got.Cursor, got.MissingShards, got.CausalCtx)
+	}
+
+	got, _ = do(t, r, "GET", "/kv-store/list?limit=2", `{}`)
+	if diff := cmp.Diff(got.Keys, want[:2]); diff != "" {
+		t.Errorf("Bad limited key list (-got,+want): %s", diff)
+	}
+	if got.Cursor != "b" {
+		t.Errorf("Got cursor %q, wanted b", got.Cursor)
+	}
+}
+
+func TestListMissingShard(t *testing.T) {
+	r := mux.NewRouter()
+	s, err := NewState(context.Background(), FAKE_ADDRESS, types.View{
+		// Nothing listens on the second shard.
+		Members:    []string{FAKE_ADDRESS, "127.0.0.1:1"},
+		ReplFactor: 1,
+	}, Options{})
+	if err != nil {
+		t.Fatalf("Failed to create state: %v", err)
+	}
+	s.Route(r)
+	s.store.Write(nil, "x", "1")
+
+	got, code := do(t, r, "GET", "/kv-store/list", `{}`)
+	if code != 200 {
+		t.Fatalf("Got status %d for list, wanted 200", code)
+	}
+	if diff := cmp.Diff(got.Keys, []types.Entry{{Key: "x", Value: "1"}}); diff != "" {
+		t.Errorf("Bad key list (-got,+want): %s", diff)
+	}
+	if diff := cmp.Diff(got.MissingShards, []int{2}); diff != "" {
+		t.Errorf("Bad missing shards (-got,+want): %s", diff)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	r := newTestRouter(t)
+	do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1"}`)
+
+	got, code := do(t, r, "POST", "/kv-store/batch", `{"operations":[
+		{"op":"put","key":"y","value":"2"},
+		{"op":"get","key":"x"},
+		{"op":"delete","key":"x"},
+		{"op":"get","key":"x"},
+		{"op":"get","key":"y"},
+		{"op":"put","key":"z"}
+	]}`)
+	if code != 200 {
+		t.Fatalf("Got status %d for batch, wanted 200", code)
+	}
+
+	var statuses []int
+	var values []string
+	for _, res := range got.Results {
+		statuses = append(statuses, res.Status)
+		values = append(values, res.Value)
+	}
+	if diff := cmp.Diff(statuses, []int{201, 200, 200, 404, 200, 400}); diff != "" {
+		t.Errorf("Bad statuses (-got,+want): %s", diff)
+	}
+	if diff := cmp.Diff(values, []string{"", "1", "", "", "2", ""}); diff != "" {
+		t.Errorf("Bad values (-got,+want): %s", diff)
+	}
+	if len(got.CausalCtx) == 0 {
+		t.Errorf("Batch did not return a causal context")
+	}
+
+	if _, code := do(t, r, "POST", "/kv-store/batch", `{"operations":[{"op":"frob","key":"x"}]}`); code != 400 {
+		t.Errorf("Got status %d for a bad operation, wanted 400", code)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	r := newTestRouter(t)
+	do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1"}`)
+
+	got, code := do(t, r, "POST", "/kv-store/txn", `{"operations":[
+		{"op":"put","key":"y","value":"2"},
+		{"op":"delete","key":"x"}
+	]}`)
+	if code != 200 {
+		t.Fatalf("Got status %d for transaction, wanted 200", code)
+	}
+	if len(got.Results) != 2 || got.Results[0].Status != 201 || got.Results[1].Exists == nil || !*got.Results[1].Exists {
+		t.Errorf("Bad transaction results %+v", got.Results)
+	}
+	if _, code := do(t, r, "GET", "/kv-store/keys/x", `{}`); code != 404 {
+		t.Errorf("Got status %d reading a deleted key, wanted 404", code)
+	}
+
+	if _, code := do(t, r, "POST", "/kv-store/txn", `{"operations":[{"op":"get","key":"x"}]}`); code != 400 {
+		t.Errorf("Got status %d for a read in a transaction, wanted 400", code)
+	}
+}
+
+func TestTxnAcrossShards(t *testing.T) {
+	view := types.View{Members: []string{FAKE_ADDRESS, "127.0.0.1:1"}, ReplFactor: 1}
+	r := mux.NewRouter()
+	s, err := NewState(context.Background(), FAKE_ADDRESS, view, Options{})
+	if err != nil {
+		t.Fatalf("Failed to create state: %v", err)
+	}
+	s.Route(r)
+
+	keys := keysOnShards(s, 2)
+	_, code := do(t, r, "POST", "/kv-store/txn", fmt.Sprintf(`{"operations":[
+		{"op":"put","key":%q,"value":"1"},
+		{"op":"put","key":%q,"value":"1"}
+	]}`, keys[1], keys[2]))
+	if code != 400 {
+		t.Errorf("Got status %d for a transaction across shards, wanted 400", code)
+	}
+}
+
+// newCluster starts n nodes on local servers. It returns their states, their
+// addresses, and a function that shuts them all down.
+func newCluster(t *testing.T, n, replFactor int) ([]*State, []string, func()) {
+	t.Helper()
+	servers := make([]*httptest.Server, n)
+	addrs := make([]string, n)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		addrs[i] = servers[i].Listener.Addr().String()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	states := make([]*State, n)
+	for i := range servers {
+		s, err := NewState(ctx, addrs[i], types.View{Members: addrs, ReplFactor: replFactor}, Options{})
+		if err != nil {
+			t.Fatalf("Failed to create state: %v", err)
+		}
+		r := mux.NewRouter()
+		s.Route(r)
+		servers[i].Config.Handler = r
+		servers[i].Start()
+		states[i] = s
+	}
+
+	return states, addrs, func() {
+		cancel()
+		for i := range servers {
+			servers[i].Close()
+		}
+	}
+}
+
+// request sends a request with a raw JSON body to a node.
+func request(t *testing.T, method, addr, path, body string) (types.Response, int) {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+addr+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	var got types.Response
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Errorf("Failed to parse response: %v", err)
+	}
+	return got, resp.StatusCode
+}
+
+// keysOnShards finds a key on each shard.
+func keysOnShards(s *State, shards int) map[int]string {
+	keys := make(map[int]string)
+	for i := 0; len(keys) < shards; i++ {
+		key := fmt.Sprintf("key%d", i)
+		id, _ := s.hash.GetKeyShardId(key)
+		keys[id] = key
+	}
+	return keys
+}
+
+func TestGlobalTxn(t *testing.T) {
+	states, addrs, stop := newCluster(t, 2, 1)
+	defer stop()
+	keys := keysOnShards(states[0], 2)
+
+	got, code := request(t, "POST", addrs[0], "/kv-store/global-txn", fmt.Sprintf(`{"operations":[
+		{"op":"put","key":%q,"value":"1"},
+		{"op":"put","key":%q,"value":"2"}
+	]}`, keys[1], keys[2]))
+	if code != 200 {
+		t.Fatalf("Got status %d for global transaction, wanted 200", code)
+	}
+	ctx, _ := json.Marshal(got.CausalCtx)
+	for shard, value := range map[int]string{1: "1", 2: "2"} {
+		read, _ := request(t, "GET", addrs[0], "/kv-store/keys/"+keys[shard], `{"causal-context":`+string(ctx)+`}`)
+		if read.Value != value {
+			t.Errorf("Read %q=%q after commit, wanted %q", keys[shard], read.Value, value)
+		}
+	}
+	if len(states[0].store.Decisions()) != 0 {
+		t.Errorf("Coordinator kept decisions %v after every participant committed", states[0].store.Decisions())
+	}
+
+	// A transaction that cannot prepare everywhere aborts everywhere.
+	states[1].store.Prepare(clock.VectorClock{}, store.PreparedTxn{ID: "other", Writes: []store.Entry{{Key: keys[2], Value: "x"}}})
+	_, code = request(t, "POST", addrs[0], "/kv-store/global-txn", fmt.Sprintf(`{"operations":[
+		{"op":"put","key":%q,"value":"3"},
+		{"op":"put","key":%q,"value":"4"}
+	]}`, keys[1], keys[2]))
+	if code != 409 {
+		t.Errorf("Got status %d for a conflicting transaction, wanted 409", code)
+	}
+	if read, _ := request(t, "GET", addrs[0], "/kv-store/keys/"+keys[1], `{}`); read.Value != "1" {
+		t.Errorf("Read %q=%q after abort, wanted 1", keys[1], read.Value)
+	}
+	if _, code := request(t, "PUT", addrs[0], "/kv-store/keys/"+keys[1], `{"value":"5"}`); code != 200 {
+		t.Errorf("Got status %d writing a key after abort, wanted 200", code)
+	}
+}
+
+func TestTxnStatus(t *testing.T) {
+	r := newTestRouter(t)
+	got, _ := do(t, r, "GET", "/kv-store/global-txn/status", `{"txn-id":"unknown"}`)
+	if got.TxnStatus != TXN_ABORTED {
+		t.Errorf("Got status %q for an unknown transaction, wanted %q", got.TxnStatus, TXN_ABORTED)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	states, addrs, stop := newCluster(t, 2, 1)
+	defer stop()
+	keys := keysOnShards(states[0], 2)
+
+	if _, code := request(t, "GET", addrs[0], "/kv-store/watch", `{}`); code != 400 {
+		t.Errorf("Got status %d for a watch without key or prefix, wanted 400", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", "http://"+addrs[0]+"/kv-store/watch?prefix=key", nil)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("Failed to watch: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Got status %d for watch, wanted 200", resp.StatusCode)
+	}
+	events := make(chan types.Event)
+	go relayEvents(ctx, resp.Body, events)
+
+	// A change on either shard reaches the watcher, with its clock.
+	for shard, value := range map[int]string{1: "1", 2: "2"} {
+		request(t, "PUT", addrs[0], "/kv-store/keys/"+keys[shard], `{"value":"`+value+`"}`)
+		event := <-events
+		if event.Key != keys[shard] || event.Value != value || len(event.CausalCtx) == 0 {
+			t.Errorf("Got event %+v, wanted %s=%s with a context", event, keys[shard], value)
+		}
+	}
+	request(t, "DELETE", addrs[0], "/kv-store/keys/"+keys[1], `{}`)
+	if event := <-events; event.Key != keys[1] || !event.Deleted {
+		t.Errorf("Got event %+v, wanted delete of %s", event, keys[1])
+	}
+}
+
+func TestChanges(t *testing.T) {
+	r := newTestRouter(t)
+	first, _ := do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1"}`)
+	do(t, r, "PUT", "/kv-store/keys/y", `{"value":"2"}`)
+	do(t, r, "DELETE", "/kv-store/keys/x", `{}`)
+
+	got, code := do(t, r, "GET", "/kv-store/changes?limit=2", `{}`)
+	if code != 200 {
+		t.Fatalf("Got status %d for changes, wanted 200", code)
+	}
+	if len(got.Changes) != 2 || got.Changes[0].Key != "x" || got.Changes[1].Key != "y" || got.Cursor != "2" {
+		t.Errorf("Got changes %+v and cursor %q, wanted x and y", got.Changes, got.Cursor)
+	}
+
+	got, _ = do(t, r, "GET", "/kv-store/changes?cursor="+got.Cursor, `{}`)
+	if len(got.Changes) != 1 || got.Changes[0].Key != "x" || !got.Changes[0].Deleted || got.Cursor != "3" {
+		t.Errorf("Got changes %+v and cursor %q, wanted delete of x", got.Changes, got.Cursor)
+	}
+
+	since, _ := json.Marshal(first.CausalCtx)
+	got, _ = do(t, r, "GET", "/kv-store/changes", `{"since":`+string(since)+`}`)
+	if len(got.Changes) != 2 || got.Changes[0].Key != "y" {
+		t.Errorf("Got changes %+v since the first write, wanted the last two", got.Changes)
+	}
+
+	if _, code := do(t, r, "GET", "/kv-store/changes?cursor=x", `{}`); code != 400 {
+		t.Errorf("Got status %d for a bad cursor, wanted 400", code)
+	}
+}
+
+func TestSiblings(t *testing.T) {
+	r := mux.NewRouter()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	other := "127.0.0.1:1"
+	s, err := NewState(ctx, FAKE_ADDRESS, types.View{
+		Members:    []string{FAKE_ADDRESS, other},
+		ReplFactor: 2,
+	}, Options{})
+	if err != nil {
+		t.Fatalf("Failed to create state: %v", err)
+	}
+	s.Route(r)
+
+	// Writes go to the other replica, so make them on the store.
+	s.store.Write(clock.VectorClock{}, "x", "1")
+	s.store.ImportEntry(store.Entry{Key: "x", Value: "2", Version: uuid.New(other).Next(), Clock: clock.VectorClock{other: 1}})
+
+	got, _ := do(t, r, "GET", "/kv-store/keys/x", `{}`)
+	values := []string{}
+	for _, sibling := range got.Siblings {
+		values = append(values, sibling.Value)
+	}
+	sort.Strings(values)
+	if diff := cmp.Diff(values, []string{"1", "2"}); diff != "" {
+		t.Errorf("Bad siblings (-got,+want): %s", diff)
+	}
+
+	s.store.Write(got.CausalCtx, "x", "3")
+	got, _ = do(t, r, "GET", "/kv-store/keys/x", `{}`)
+	if got.Value != "3" || len(got.Siblings) != 0 {
+		t.Errorf("Got %q with siblings %+v, wanted them replaced by 3", got.Value, got.Siblings)
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	r := newTestRouter(t)
+	do(t, r, "POST", "/kv-store/counters/n/incr", `{}`)
+	got, code := do(t, r, "POST", "/kv-store/counters/n/incr", `{"amount":4}`)
+	if code != 200 || got.Value != "5" {
+		t.Errorf("Got %d and count %q, wanted 5", code, got.Value)
+	}
+	do(t, r, "POST", "/kv-store/counters/n/decr", `{}`)
+	got, _ = do(t, r, "GET", "/kv-store/keys/n", `{}`)
+	if got.Value != "4" || got.Type != "pncounter" {
+		t.Errorf("Read %q of type %q, wanted a count of 4", got.Value, got.Type)
+	}
+
+	do(t, r, "POST", "/kv-store/sets/s/add", `{"members":["a","b"]}`)
+	got, _ = do(t, r, "POST", "/kv-store/sets/s/remove", `{"members":["a"]}`)
+	if got.Value != `["b"]` {
+		t.Errorf("Got set %s, wanted [b]", got.Value)
+	}
+
+	do(t, r, "POST", "/kv-store/maps/m/put", `{"fields":{"f":"1","g":"2"}}`)
+	got, _ = do(t, r, "POST", "/kv-store/maps/m/delete", `{"names":["g"]}`)
+	if got.Value != `{"f":"1"}` {
+		t.Errorf("Got map %s, wanted f only", got.Value)
+	}
+
+	do(t, r, "PUT", "/kv-store/keys/x", `{"value":"1"}`)
+	if _, code := do(t, r, "POST", "/kv-store/counters/x/incr", `{}`); code != 409 {
+		t.Errorf("Got status %d incrementing a plain value, wanted 409", code)
+	}
+	if _, code := do(t, r, "POST", "/kv-store/sets/n/add", `{"members":["a"]}`); code != 400 {
+		t.Errorf("Got status %d adding to a counter, wanted 400", code)
+	}
+
+	// A type named by one request is not the default for the next.
+	if got, _ := do(t, r, "POST", "/kv-store/counters/a/incr", `{"type":"gcounter"}`); got.Type != "gcounter" {
+		t.Errorf("Created a counter of type %q, wanted gcounter", got.Type)
+	}
+	if got, _ := do(t, r, "POST", "/kv-store/counters/b/incr", `{}`); got.Type != "pncounter" {
+		t.Errorf("Created a counter of type %q after naming another type, wanted pncounter", got.Type)
+	}
+}
+
+func TestCompactContext(t *testing.T) {
+	r := newTestRouter(t)
+	send := func(method, path, body, ctx string) (types.Response, *httptest.ResponseRecorder) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header[types.CAUSAL_CONTEXT_HEADER] = []string{ctx}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		var got types.Response
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+			t.Errorf("Failed to parse response: %v", err)
+		}
+		return got, resp
+	}
+
+	got, resp := send("PUT", "/kv-store/keys/x", `{"value":"1"}`, "")
+	ctx := resp.Header().Get(types.CAUSAL_CONTEXT_HEADER)
+	if resp.Code != 201 || ctx == "" || got.CausalCtx != nil {
+		t.Fatalf("Got status %d, header %q and body context %v", resp.Code, ctx, got.CausalCtx)
+	}
+	codec := clock.Codec{Members: []string{FAKE_ADDRESS}}
+	if vc, err := codec.Decode(ctx); err != nil || vc[FAKE_ADDRESS] != 1 {
+		t.Errorf("Decoded %v and %v from %q", vc, err, ctx)
+	}
+
+	if got, resp := send("GET", "/kv-store/keys/x", `{}`, ctx); resp.Code != 200 || got.Value != "1" {
+		t.Errorf("Got status %d and value %q reading with a compact context", resp.Code, got.Value)
+	}
+	stale := clock.Codec{Epoch: 7, Members: codec.Members}.Encode(clock.VectorClock{FAKE_ADDRESS: 1})
+	for _, bad := range []string{"!!", stale} {
+		if _, resp := send("GET", "/kv-store/keys/x", `{}`, bad); resp.Code != 400 {
+			t.Errorf("Got status %d for context %q, wanted 400", resp.Code, bad)
+		}
+	}
+}
+
+func TestGossipBatches(t *testing.T) {
+	states, addrs, stop := newCluster(t, 3, 3)
+	defer stop()
+
+	ctx := []byte("{}")
+	for i := 0; i < 20; i++ {
+		got, code := request(t, "PUT", addrs[0], fmt.Sprintf("/kv-store/keys/key%d", i%5),
+			fmt.Sprintf(`{"value":"%d","causal-context":%s}`, i, ctx))
+		if code != 200 && code != 201 {
+			t.Fatalf("Got status %d writing, wanted 200 or 201", code)
+		}
+		ctx, _ = json.Marshal(got.CausalCtx)
+	}
+
+	// Every queue drains, and the replicas have every write.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := request(t, "GET", addrs[0], "/kv-store/admin/gossip", "")
+		depth := 0
+		for _, stats := range got.Queues {
+			depth += stats.Depth
+		}
+		if len(got.Queues) == 2 && depth == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Gossip queues did not drain: %+v", got.Queues)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, s := range states[1:] {
+		for i := 15; i < 20; i++ {
+			err, e, ok, _ := s.store.Read(clock.VectorClock{}, fmt.Sprintf("key%d", i%5))
+			if err != nil || !ok || e.Value != fmt.Sprint(i) {
+				t.Errorf("Replica %s read key%d=%q, wanted %d", s.address, i%5, e.Value, i)
+			}
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	states, addrs, stop := newCluster(t, 2, 2)
+	defer stop()
+
+	// A write that gossip never brought to the other replica.
+	missed := store.Entry{Key: "x", Value: "1", Version: uuid.New(addrs[0]).Next(), Clock: clock.VectorClock{addrs[0]: 1}}
+	if _, err := states[0].store.Repair(missed); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	} else if err := states[0].store.CaughtUp(missed.Clock); err != nil {
+		t.Fatalf("Failed to record the write's clock: %v", err)
+	}
+
+	// The other replica lags once the clock it missed is acked twice.
+	if states[1].lagging(addrs[0], 1) {
+		t.Errorf("Lagging after the first ack")
+	}
+	if !states[1].lagging(addrs[0], 1) {
+		t.Errorf("Not lagging after missing what was acked")
+	}
+
+	// Sync may already be running as the node catches up on startup.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if !states[1].syncFrom(addrs[0]) {
+			t.Fatalf("Failed to sync")
+		}
+		err, e, ok, _ := states[1].store.Read(clock.VectorClock{}, "x")
+		if err == nil && ok && e.Value == "1" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Read x=%q after sync, wanted 1", e.Value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if states[1].lagging(addrs[0], 1) {
+		t.Errorf("Lagging after sync")
+	}
+}
+
+func TestHintedHandoff(t *testing.T) {
+	// The second node is down until its address is served.
+	up := httptest.NewUnstartedServer(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addrs := []string{up.Listener.Addr().String(), l.Addr().String()}
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	view := types.View{Members: addrs, ReplFactor: 1}
+	opts := Options{HandoffInterval: 10 * time.Millisecond}
+	s, err := NewState(ctx, addrs[0], view, opts)
+	if err != nil {
+		t.Fatalf("Failed to create state: %v", err)
+	}
+	r := mux.NewRouter()
+	s.Route(r)
+	up.Config.Handler = r
+	up.Start()
+	defer up.Close()
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if owner, _ := s.hash.Get(fmt.Sprintf("key%d", i)); owner == addrs[1] {
+			key = fmt.Sprintf("key%d", i)
+		}
+	}
+
+	// Only writes that ask to be are held for the owner.
+	if _, code := request(t, "PUT", addrs[0], "/kv-store/keys/"+key, `{"value":"1"}`); code != http.StatusServiceUnavailable {
+		t.Errorf("Got status %d writing to a node that is down, wanted 503", code)
+	}
+	got, code := request(t, "PUT", addrs[0], "/kv-store/keys/"+key+"?sloppy=true", `{"value":"1","causal-context":{}}`)
+	if code != http.StatusAccepted || !got.Hinted || got.Address != addrs[1] {
+		t.Fatalf("Got status %d and %+v for a sloppy write, wanted 202 hinted for %s", code, got, addrs[1])
+	}
+	got, _ = request(t, "GET", addrs[0], "/kv-store/admin/hints", "")
+	if diff := cmp.Diff(got.Hints, map[string]types.HintStats{addrs[1]: {Pending: 1, Stored: 1, Dropped: 0}}); diff != "" {
+		t.Errorf("Bad hints (-got,+want): %s", diff)
+	}
+
+	// The owner recovers and is handed the write.
+	down, err := NewState(ctx, addrs[1], view, opts)
+	if err != nil {
+		t.Fatalf("Failed to create state: %v", err)
+	}
+	l, err = net.Listen("tcp", addrs[1])
+	if err != nil {
+		t.Fatalf("Failed to listen on %s again: %v", addrs[1], err)
+	}
+	r = mux.NewRouter()
+	down.Route(r)
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: r}}
+	srv.Start()
+	defer srv.Close()
+
+	want := map[string]types.HintStats{addrs[1]: {Stored: 1, Delivered: 1}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ = request(t, "GET", addrs[0], "/kv-store/admin/hints", "")
+		if cmp.Equal(got.Hints, want) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Bad hints after the owner recovered (-got,+want): %s", cmp.Diff(got.Hints, want))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err, e, ok, _ := down.store.Read(clock.VectorClock{}, key); err != nil || !ok || e.Value != "1" {
+		t.Errorf("Read %s=%q after the owner recovered, wanted 1", key, e.Value)
+	}
+}
+
+func TestHintedHandoffTimeout(t *testing.T) {
+	// The second node applies what it is sent, but does not answer until
+	// released, so forwards to it time out.
+	servers := []*httptest.Server{httptest.NewUnstartedServer(nil), httptest.NewUnstartedServer(nil)}
+	addrs := []string{servers[0].Listener.Addr().String(), servers[1].Listener.Addr().String()}
+	release := make(chan struct{})
+	released := false
+	defer func() {
+		if !released {
+			close(release)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	view := types.View{Members: addrs, ReplFactor: 1}
+	opts := Options{HandoffInterval: 10 * time.Millisecond}
+	var states []*State
+	for i, addr := range addrs {
+		s, err := NewState(ctx, addr, view, opts)
+		if err != nil {
+			t.Fatalf("Failed to create state: %v", err)
+		}
+		s.cli.Timeout = 100 * time.Millisecond
+		r := mux.NewRouter()
+		s.Route(r)
+		servers[i].Config.Handler = r
+		states = append(states, s)
+	}
+	slow := servers[1].Config.Handler
+	servers[1].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slow.ServeHTTP(w, r)
+		if r.URL.Path != HEALTH_ENDPOINT {
+			<-release
+		}
+	})
+	for _, srv := range servers {
+		srv.Start()
+		defer srv.Close()
+	}
+
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		if owner, _ := states[0].hash.Get(fmt.Sprintf("key%d", i)); owner == addrs[1] {
+			keys = append(keys, fmt.Sprintf("key%d", i))
+		}
+	}
+
+	// A put is held, though the owner applied it.
+	got, code := request(t, "PUT", addrs[0], "/kv-store/keys/"+keys[0]+"?sloppy=true", `{"value":"1","causal-context":{}}`)
+	if code != http.StatusAccepted || !got.Hinted {
+		t.Fatalf("Got status %d and %+v for a sloppy put that timed out, wanted 202 hinted", code, got)
+	}
+
+	// An update of a typed value is not, since it would be applied twice.
+	got, code = request(t, "POST", addrs[0], "/kv-store/counters/"+keys[1]+"/incr?sloppy=true", `{"causal-context":{}}`)
+	if code != http.StatusServiceUnavailable || got.Hinted {
+		t.Errorf("Got status %d and %+v for a sloppy increment that timed out, wanted 503", code, got)
+	}
+
+	close(release)
+	released = true
+	want := map[string]types.HintStats{addrs[1]: {Stored: 1, Delivered: 1}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ = request(t, "GET", addrs[0], "/kv-store/admin/hints", "")
+		if cmp.Equal(got.Hints, want) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Bad hints after the owner answered (-got,+want): %s", cmp.Diff(got.Hints, want))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, _ := request(t, "GET", addrs[1], "/kv-store/keys/"+keys[0], `{}`); got.Value != "1" {
+		t.Errorf("Read %s=%q after the hint was handed off, wanted 1", keys[0], got.Value)
+	}
+	if got, _ := request(t, "GET", addrs[1], "/kv-store/keys/"+keys[1], `{}`); got.Value != "1" {
+		t.Errorf("Read count %q of %s, wanted it incremented once", got.Value, keys[1])
+	}
+}
+
+func TestReplayHint(t *testing.T) {
+	// The owner refuses the first replay while a transaction holds the key.
+	var contexts []string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contexts = append(contexts, r.Header.Get(types.CAUSAL_CONTEXT_HEADER))
+		if len(contexts) == 1 {
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer owner.Close()
+	addrs := []string{"127.0.0.1:1", owner.Listener.Addr().String()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewState(ctx, addrs[0], types.View{Members: addrs, ReplFactor: 1}, Options{})
+	if err != nil {
+		t.Fatalf("Failed to create state: %v", err)
+	}
+
+	// The header held with the write is encoded for a view that is gone.
+	h := hint{
+		Method:  http.MethodPut,
+		Path:    "/kv-store/keys/x",
+		Header:  http.Header{types.CAUSAL_CONTEXT_HEADER: []string{"stale"}},
+		Body:    []byte(`{"value":"1"}`),
+		Context: clock.VectorClock{addrs[1]: 1},
+	}
+	if s.replay(addrs[1], h) {
+		t.Errorf("Delivered a hint the owner could not apply yet")
+	}
+	if !s.replay(addrs[1], h) {
+		t.Errorf("Failed to deliver a hint the owner applied")
+	}
+	h.Context = nil
+	s.replay(addrs[1], h)
+
+	want := s.codec().Encode(clock.VectorClock{addrs[1]: 1})
+	if diff := cmp.Diff(contexts, []string{want, want, ""}); diff != "" {
+		t.Errorf("Bad causal contexts replayed (-got,+want): %s", diff)
+	}
+}
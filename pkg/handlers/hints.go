@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/types"
+	"github.com/spencer-p/key-value-store/pkg/util"
+)
+
+const (
+	HEALTH_ENDPOINT = "/kv-store/health"
+
+	// DEFAULT_HANDOFF_INTERVAL is how often the owners of hinted writes are
+	// checked unless configured otherwise.
+	DEFAULT_HANDOFF_INTERVAL = time.Second
+
+	// MAX_HINTS is how many hinted writes are held for each owner. Writes
+	// beyond it are refused as if there were no hinted handoff.
+	MAX_HINTS = 10000
+)
+
+// hint is a write held on behalf of a node that could not be reached, to be
+// handed off to it once it is healthy again.
+type hint struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+
+	// Context is the causal context the write carried in its header, decoded
+	// when it was held. The header is encoded for the view of the time, so it
+	// is encoded again for the view the write is handed off in.
+	Context clock.VectorClock `json:"context,omitempty"`
+}
+
+// hints holds the hinted writes for each owner, oldest first.
+type hints struct {
+	m       sync.Mutex
+	pending map[string][]hint
+	stats   map[string]*types.HintStats
+
+	// sloppy is true if every put or delete may be hinted, not just those
+	// that ask.
+	sloppy bool
+
+	// dir, if set, is where the hints of each owner are kept.
+	dir string
+}
+
+// sloppy returns true if a write that cannot reach its owner may be held on
+// its behalf, either for every write or because the request asked. Only puts
+// and deletes of a key are held, since the owner may have applied a write whose
+// forward timed out and an update of a typed value would then apply twice.
+//
+// A held write is applied when it is handed off, as a new write with the
+// causal context it was sent with. It is timestamped then, so under
+// last-writer-wins it replaces any write made to the key since; otherwise it
+// is kept as a sibling of those. A write applied twice is two writes too.
+func (s *State) sloppy(r *http.Request) bool {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		return false
+	} else if !strings.HasPrefix(r.URL.Path, "/kv-store/keys/") {
+		return false
+	}
+	if s.hints.sloppy {
+		return true
+	}
+	ok, _ := strconv.ParseBool(r.URL.Query().Get("sloppy"))
+	return ok
+}
+
+// hint holds a write for an owner that could not be reached. It returns false
+// if the owner already has as many hints as we hold.
+func (s *State) hint(owner string, h hint) bool {
+	s.hints.m.Lock()
+	defer s.hints.m.Unlock()
+	stats := s.hintStats(owner)
+	if len(s.hints.pending[owner]) >= MAX_HINTS {
+		stats.Dropped++
+		return false
+	}
+	if s.hints.dir != "" {
+		if err := s.appendHint(owner, h); err != nil {
+			log.Printf("Failed to keep hint for %q: %v\n", owner, err)
+			stats.Dropped++
+			return false
+		}
+	}
+	s.hints.pending[owner] = append(s.hints.pending[owner], h)
+	stats.Pending++
+	stats.Stored++
+	return true
+}
+
+// hintStats returns the stats of an owner's hints, with the lock held.
+func (s *State) hintStats(owner string) *types.HintStats {
+	stats, ok := s.hints.stats[owner]
+	if !ok {
+		stats = &types.HintStats{}
+		s.hints.stats[owner] = stats
+	}
+	return stats
+}
+
+// handOff periodically checks the health of each node we hold hints for and
+// delivers them to those that recovered.
+func (s *State) handOff(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.hints.m.Lock()
+		var owners []string
+		for owner, pending := range s.hints.pending {
+			if len(pending) > 0 {
+				owners = append(owners, owner)
+			}
+		}
+		s.hints.m.Unlock()
+
+		for _, owner := range owners {
+			if s.healthy(owner) {
+				s.deliverHints(owner)
+			}
+		}
+	}
+}
+
+// healthy returns true if a node answers its health check.
+func (s *State) healthy(node string) bool {
+	var response types.Response
+	resp, err := s.sendHttp(http.MethodGet, node, HEALTH_ENDPOINT, nil, &response)
+	return err == nil && resp.StatusCode == http.StatusOK
+}
+
+// deliverHints replays the writes held for an owner in order, stopping at the
+// first it cannot deliver. A node that left the view gets nothing; its writes
+// are sent through us, to be forwarded to whichever node owns them now.
+func (s *State) deliverHints(owner string) {
+	s.hints.m.Lock()
+	pending := s.hints.pending[owner]
+	s.hints.m.Unlock()
+
+	target := owner
+	if !s.isMember(owner) {
+		target = s.address
+	}
+
+	delivered := 0
+	for _, h := range pending {
+		if !s.replay(target, h) {
+			break
+		}
+		delivered++
+	}
+	if delivered == 0 {
+		return
+	}
+	log.Printf("Handed off %d of %d hinted writes for %q\n", delivered, len(pending), owner)
+
+	s.hints.m.Lock()
+	defer s.hints.m.Unlock()
+	rest := s.hints.pending[owner][delivered:]
+	if len(rest) == 0 {
+		delete(s.hints.pending, owner)
+	} else {
+		s.hints.pending[owner] = rest
+	}
+	stats := s.hintStats(owner)
+	stats.Pending -= delivered
+	stats.Delivered += uint64(delivered)
+	if s.hints.dir != "" {
+		if err := s.rewriteHints(owner, rest); err != nil {
+			log.Printf("Failed to keep hints for %q: %v\n", owner, err)
+		}
+	}
+}
+
+// isMember returns true if a node is in the current view.
+func (s *State) isMember(node string) bool {
+	for _, member := range s.hash.GetView().Members {
+		if member == node {
+			return true
+		}
+	}
+	return false
+}
+
+// replay sends a hinted write to a node, returning true if it was delivered.
+// A write the node refuses, such as one whose precondition failed, is delivered
+// too: it would be refused again. One it cannot apply yet, because it is
+// unavailable or a transaction holds the key, is not.
+func (s *State) replay(node string, h hint) bool {
+	target, err := url.Parse(util.CorrectURL(node))
+	if err != nil {
+		log.Printf("Bad hint address %q: %v\n", node, err)
+		return false
+	}
+	target.Path = path.Join(target.Path, h.Path)
+
+	request, err := http.NewRequest(h.Method, target.String(), bytes.NewReader(h.Body))
+	if err != nil {
+		log.Printf("Failed to build hinted write to %q: %v\n", node, err)
+		return false
+	}
+	if h.Header != nil {
+		request.Header = h.Header.Clone()
+	}
+	request.Header.Del(types.CAUSAL_CONTEXT_HEADER)
+	if h.Context != nil {
+		request.Header.Set(types.CAUSAL_CONTEXT_HEADER, s.codec().Encode(h.Context))
+	}
+
+	resp, err := s.cli.Do(request)
+	if err != nil {
+		log.Printf("Failed to hand off write to %q: %v\n", node, err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusConflict {
+		log.Printf("Node %q returned %d for hinted write\n", node, resp.StatusCode)
+		return false
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Printf("Node %q refused hinted write %s %s with %d\n", node, h.Method, h.Path, resp.StatusCode)
+	}
+	return true
+}
+
+// hintFile returns the path of the file an owner's hints are kept in.
+func (s *State) hintFile(owner string) string {
+	return filepath.Join(s.hints.dir, url.PathEscape(owner))
+}
+
+// appendHint adds a hint to the end of its owner's file.
+func (s *State) appendHint(owner string, h hint) error {
+	if err := os.MkdirAll(s.hints.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.hintFile(owner), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(&h)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rewriteHints replaces an owner's file with the hints not yet delivered.
+func (s *State) rewriteHints(owner string, rest []hint) error {
+	file := s.hintFile(owner)
+	if len(rest) == 0 {
+		return os.Remove(file)
+	}
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range rest {
+		if err = enc.Encode(&rest[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// loadHints reads the hints kept for each owner when the node last ran.
+func (s *State) loadHints() error {
+	files, err := ioutil.ReadDir(s.hints.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		owner, err := url.PathUnescape(fi.Name())
+		if err != nil || filepath.Ext(fi.Name()) == ".tmp" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(s.hints.dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		var pending []hint
+		dec := json.NewDecoder(f)
+		for {
+			var h hint
+			if err := dec.Decode(&h); err != nil {
+				// The last hint may be torn by a crash.
+				break
+			}
+			pending = append(pending, h)
+		}
+		f.Close()
+		if len(pending) == 0 {
+			continue
+		}
+		s.hints.pending[owner] = pending
+		s.hintStats(owner).Pending = len(pending)
+		log.Printf("Recovered %d hinted writes for %q\n", len(pending), owner)
+	}
+	return nil
+}
+
+// contextOf returns the causal context a forwarded request carried, to answer
+// a hinted write with. The write is not in it until it is handed off.
+func (s *State) contextOf(r *http.Request, body []byte) clock.VectorClock {
+	if h, ok := r.Header[types.CAUSAL_CONTEXT_HEADER]; ok && len(h) > 0 {
+		if vc, err := s.codec().Decode(h[0]); err == nil {
+			return vc
+		}
+	}
+	var in types.Input
+	if len(body) > 0 && json.Unmarshal(body, &in) == nil && in.CausalCtx != nil {
+		return in.CausalCtx
+	}
+	return clock.VectorClock{}
+}
+
+// healthHandler answers health checks.
+func (s *State) healthHandler(in types.Input, res *types.Response) {
+	res.Message = msg.Healthy
+}
+
+// hintsHandler reports the writes held for each node that could not be
+// reached, and what became of them.
+func (s *State) hintsHandler(in types.Input, res *types.Response) {
+	s.hints.m.Lock()
+	defer s.hints.m.Unlock()
+	res.Hints = make(map[string]types.HintStats)
+	for owner, stats := range s.hints.stats {
+		res.Hints[owner] = *stats
+	}
+}
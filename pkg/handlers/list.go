@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	LIST_ENDPOINT = "/kv-store/list"
+
+	// Shards are read LIST_PAGE_SIZE keys at a time, and the response is
+	// flushed to the client after as many keys.
+	LIST_PAGE_SIZE = 500
+)
+
+// shardCursor walks the keys of one shard in order, a page at a time.
+type shardCursor struct {
+	id     int
+	r      store.Range
+	page   []store.Entry
+	more   bool
+	failed bool
+	vc     clock.VectorClock
+}
+
+// fetch reads the next page of the shard.
+func (c *shardCursor) fetch(s *State, vc clock.VectorClock) {
+	scan := s.scanShard(c.id, vc, c.r)
+	if !scan.ok {
+		c.failed = true
+		c.page, c.more = nil, false
+		return
+	}
+	c.page, c.more = scan.entries, scan.more
+	if len(scan.entries) > 0 {
+		c.r.After = scan.entries[len(scan.entries)-1].Key
+	}
+	c.vc.Max(scan.vc)
+}
+
+// head returns the next entry on the shard, fetching another page if needed.
+// It returns false once the shard is exhausted or unreachable.
+func (c *shardCursor) head(s *State, vc clock.VectorClock) (store.Entry, bool) {
+	for len(c.page) == 0 {
+		if !c.more {
+			return store.Entry{}, false
+		}
+		c.fetch(s, vc)
+	}
+	return c.page[0], true
+}
+
+// listHandler streams every key in the cluster in order. Each shard is read
+// from one replica a page at a time and the pages are merged as they arrive.
+// The response has the same shape as any other, but the keys are written out
+// before the shards have all been read, so shards that become unreachable are
+// reported in missing-shards rather than failing the request.
+func (s *State) listHandler(w http.ResponseWriter, r *http.Request) {
+	var in types.Input
+	if ok, errMsg := types.ParseInput(r, &in); !ok {
+		result := types.Response{Status: http.StatusBadRequest, Error: errMsg}
+		result.Serve(w, r)
+		return
+	}
+	if in.CausalCtx == nil {
+		in.CausalCtx = clock.VectorClock{}
+	}
+	rng, ok := rangeOf(in, 0, 0)
+	if !ok {
+		result := types.Response{Status: http.StatusBadRequest, Error: msg.BadRange}
+		result.Serve(w, r)
+		return
+	}
+
+	// Read the first page of every shard at once.
+	view := s.hash.GetView()
+	cursors := make([]*shardCursor, len(view.Members)/view.ReplFactor)
+	var wg sync.WaitGroup
+	for i := range cursors {
+		page := rng
+		page.Limit = LIST_PAGE_SIZE
+		cursors[i] = &shardCursor{id: i + 1, r: page, vc: clock.VectorClock{}}
+		wg.Add(1)
+		go func(c *shardCursor) {
+			defer wg.Done()
+			c.fetch(s, in.CausalCtx)
+		}(cursors[i])
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if _, err := io.WriteString(w, `{"keys":[`); err != nil {
+		log.Println("Failed to write key list:", err)
+		return
+	}
+
+	var last string
+	written := 0
+	for rng.Limit <= 0 || written < rng.Limit {
+		// Shards hold disjoint keys, so the next key is the least head.
+		var next *shardCursor
+		var nextEntry store.Entry
+		for _, c := range cursors {
+			if e, ok := c.head(s, in.CausalCtx); ok && (next == nil || e.Key < nextEntry.Key) {
+				next, nextEntry = c, e
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.page = next.page[1:]
+
+		buf, err := json.Marshal(types.Entry{Key: nextEntry.Key, Value: nextEntry.Value})
+		if err != nil {
+			log.Printf("Failed to encode %q: %v\n", nextEntry.Key, err)
+			return
+		}
+		if written > 0 {
+			buf = append([]byte{','}, buf...)
+		}
+		if _, err := w.Write(buf); err != nil {
+			log.Println("Failed to write key list:", err)
+			return
+		}
+		written++
+		last = nextEntry.Key
+		if flusher != nil && written%LIST_PAGE_SIZE == 0 {
+			flusher.Flush()
+		}
+	}
+
+	result := types.Response{
+		Message:   msg.ScanSuccess,
+		CausalCtx: in.CausalCtx.Copy(),
+	}
+	for _, c := range cursors {
+		if c.failed {
+			result.MissingShards = append(result.MissingShards, c.id)
+			continue
+		}
+		result.CausalCtx.Max(c.vc)
+		if _, ok := c.head(s, in.CausalCtx); ok && written > 0 {
+			// We stopped at the limit with keys left over.
+			result.Cursor = last
+		}
+	}
+	if len(result.MissingShards) > 0 {
+		log.Println("Listed keys without shards", result.MissingShards)
+		result.Message = msg.PartialScanSuccess
+	}
+
+	// Finish the object with the rest of the response.
+	trailer, err := json.Marshal(&result)
+	if err != nil {
+		log.Println("Failed to encode key list trailer:", err)
+		return
+	}
+	trailer = bytes.TrimPrefix(trailer, []byte{'{'})
+	if _, err := w.Write(append([]byte("],"), trailer...)); err != nil {
+		log.Println("Failed to write key list:", err)
+	}
+	log.Printf("Listed %d keys\n", written)
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	SCAN_ENDPOINT = "/kv-store/scan"
+
+	// Pages of keys hold DEFAULT_SCAN_LIMIT keys unless the client asks for
+	// up to MAX_SCAN_LIMIT.
+	DEFAULT_SCAN_LIMIT = 100
+	MAX_SCAN_LIMIT     = 1000
+)
+
+// shardScan is the result of scanning one shard.
+type shardScan struct {
+	entries []store.Entry
+	more    bool
+	vc      clock.VectorClock
+	ok      bool
+}
+
+// rangeOf returns the range of keys a request asks for, limited to
+// defaultLimit keys unless the request asks for up to maxLimit. Zero means no
+// limit. It returns false if the range makes no sense.
+func rangeOf(in types.Input, defaultLimit, maxLimit int) (store.Range, bool) {
+	r := store.Range{
+		Prefix: in.Query.Get("prefix"),
+		Start:  in.Query.Get("start"),
+		End:    in.Query.Get("end"),
+		After:  in.Query.Get("cursor"),
+		Limit:  defaultLimit,
+	}
+	if limit := in.Query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || (maxLimit > 0 && n > maxLimit) {
+			return r, false
+		}
+		r.Limit = n
+	}
+	if r.End != "" && r.End <= r.Start {
+		return r, false
+	}
+	return r, true
+}
+
+// keysHandler lists a page of keys in order across every shard.
+func (s *State) keysHandler(in types.Input, res *types.Response) {
+	r, ok := rangeOf(in, DEFAULT_SCAN_LIMIT, MAX_SCAN_LIMIT)
+	if !ok {
+		res.Error = msg.BadRange
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	view := s.hash.GetView()
+	nshards := len(view.Members) / view.ReplFactor
+	scans := make([]shardScan, nshards)
+	var wg sync.WaitGroup
+	for i := range scans {
+		wg.Add(1)
+		go func(scan *shardScan, shardId int) {
+			defer wg.Done()
+			*scan = s.scanShard(shardId, in.CausalCtx, r)
+		}(&scans[i], i+1)
+	}
+	wg.Wait()
+
+	// Every shard returned its first page. The first page overall is the
+	// first keys of their union.
+	vc := in.CausalCtx.Copy()
+	var entries []store.Entry
+	more := false
+	for _, scan := range scans {
+		if !scan.ok {
+			res.Status = http.StatusServiceUnavailable
+			res.Error = msg.Unavailable
+			return
+		}
+		entries = append(entries, scan.entries...)
+		more = more || scan.more
+		vc.Max(scan.vc)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if len(entries) > r.Limit {
+		entries = entries[:r.Limit]
+		more = true
+	}
+
+	res.Keys = make([]types.Entry, len(entries))
+	for i, e := range entries {
+		res.Keys[i] = types.Entry{Key: e.Key, Value: e.Value}
+	}
+	if more && len(entries) > 0 {
+		res.Cursor = entries[len(entries)-1].Key
+	}
+	res.Message = msg.ScanSuccess
+	res.CausalCtx = vc
+}
+
+// scanShard scans a range on one shard, trying each of its replicas in turn.
+func (s *State) scanShard(shardId int, vc clock.VectorClock, r store.Range) shardScan {
+	if shardId == s.hash.GetShardId(s.address) {
+		err, entries, more, current := s.store.Scan(vc, r)
+		if err != nil {
+			log.Printf("Failed to scan shard %d: %v\n", shardId, err)
+			return shardScan{}
+		}
+		return shardScan{entries: entries, more: more, vc: current, ok: true}
+	}
+
+	for _, replica := range s.hash.GetReplicas(shardId) {
+		var response types.Response
+		resp, err := s.sendHttp(http.MethodGet, replica, SCAN_ENDPOINT, &types.Input{
+			CausalCtx: vc,
+			Range:     r,
+		}, &response)
+		if err != nil {
+			log.Printf("Failed to scan shard %d on %q: %v\n", shardId, replica, err)
+			continue
+		} else if resp.StatusCode != http.StatusOK {
+			log.Printf("Replica %q returned %d for scan of shard %d\n", replica, resp.StatusCode, shardId)
+			continue
+		}
+		return shardScan{
+			entries: response.StorageState,
+			more:    response.Cursor != "",
+			vc:      response.CausalCtx,
+			ok:      true,
+		}
+	}
+	log.Println("All replicas in shard", shardId, "were unreachable for scan")
+	return shardScan{}
+}
+
+// scanHandler scans a range on this node's shard for another node.
+func (s *State) scanHandler(in types.Input, res *types.Response) {
+	err, entries, more, vc := s.store.Scan(in.CausalCtx, in.Range)
+	if err != nil {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
+	res.StorageState = entries
+	if more && len(entries) > 0 {
+		res.Cursor = entries[len(entries)-1].Key
+	}
+	res.CausalCtx = vc
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+// snapshotHandler takes a snapshot of the store on demand.
+func (s *State) snapshotHandler(in types.Input, res *types.Response) {
+	err := s.store.Snapshot()
+	if errors.Is(err, store.ErrNotPersistent) {
+		res.Status = http.StatusBadRequest
+		res.Error = msg.NotPersistent
+		return
+	} else if err != nil {
+		log.Println("Failed to take snapshot:", err)
+		res.Status = http.StatusInternalServerError
+		res.Error = msg.SnapshotFailure
+		return
+	}
+	res.Message = msg.SnapshotSuccess
+}
+
+// snapshotPeriodically takes a snapshot of the store every interval.
+func (s *State) snapshotPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.store.Snapshot(); err != nil {
+				log.Println("Failed to take periodic snapshot:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	SYNC_ENDPOINT = "/kv-store/sync"
+)
+
+// syncs tracks how far behind peers we are, to sync from them when we lag.
+type syncs struct {
+	m sync.Mutex
+	// acked is each peer's count of its own events when it last acked.
+	acked map[string]uint64
+	// running is the peers we are syncing from.
+	running map[string]bool
+}
+
+// deltaHandler returns the entries with writes that a replica at the causal
+// context has not seen.
+func (s *State) deltaHandler(in types.Input, res *types.Response) {
+	res.StorageState, res.CausalCtx = s.store.Delta(in.CausalCtx)
+}
+
+// catchUp syncs from every peer in our shard when a node starts, so it does not
+// have to wait on gossip for everything it missed while it was down.
+func (s *State) catchUp() {
+	synced := false
+	for _, peer := range s.peers() {
+		if s.syncFrom(peer) {
+			synced = true
+		}
+	}
+	if !synced {
+		log.Println("No peers were available to catch up from")
+	}
+}
+
+// syncFrom sends our clock to a peer and imports every entry it has that we
+// have not seen, after which we have every write the peer had. It returns false
+// if the peer could not be reached or an entry could not be imported.
+func (s *State) syncFrom(peer string) bool {
+	s.syncs.m.Lock()
+	if s.syncs.running[peer] {
+		s.syncs.m.Unlock()
+		return true
+	}
+	s.syncs.running[peer] = true
+	s.syncs.m.Unlock()
+	defer func() {
+		s.syncs.m.Lock()
+		delete(s.syncs.running, peer)
+		s.syncs.m.Unlock()
+	}()
+
+	var response types.Response
+	resp, err := s.sendHttp(http.MethodPost, peer, SYNC_ENDPOINT, &types.Input{CausalCtx: s.store.Clock()}, &response)
+	if err != nil {
+		log.Printf("Failed to sync from %q: %v\n", peer, err)
+		return false
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Peer %q returned %d for sync\n", peer, resp.StatusCode)
+		return false
+	}
+
+	synced := 0
+	for _, e := range response.StorageState {
+		ok, err := s.store.Repair(e)
+		if err != nil {
+			log.Printf("Failed to sync %q from %q: %v\n", e.Key, peer, err)
+			return false
+		} else if ok {
+			synced++
+		}
+	}
+	log.Printf("Synced from %q, imported %d of %d entries we had not seen\n", peer, synced, len(response.StorageState))
+	return s.caughtUp(peer, response.CausalCtx)
+}
+
+// lagging returns true if, when a peer acks its clock, we have yet to see
+// events it had when it last acked. Gossip delivers events well within an
+// ack interval, so we have missed them.
+func (s *State) lagging(peer string, acked uint64) bool {
+	seen := s.store.Clock()[peer]
+
+	s.syncs.m.Lock()
+	defer s.syncs.m.Unlock()
+	last := s.syncs.acked[peer]
+	s.syncs.acked[peer] = acked
+	return last > seen
+}
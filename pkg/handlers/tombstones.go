@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	ACK_ENDPOINT = "/kv-store/gossip-ack"
+)
+
+// collectTombstones periodically tells the other replicas in our shard what
+// our clock is, then drops every tombstone all replicas have seen.
+func (s *State) collectTombstones(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendAcks()
+			if _, err := s.store.CollectTombstones(); err != nil {
+				log.Println("Failed to collect tombstones:", err)
+			}
+		}
+	}
+}
+
+// sendAcks sends our clock to every other replica in the shard. Failures are
+// fine; the next round will try again.
+func (s *State) sendAcks() {
+	in := types.AckInput{
+		Origin: s.address,
+		Clock:  s.store.Clock(),
+	}
+	for _, replica := range s.hash.GetReplicas(s.hash.GetShardId(s.address)) {
+		if replica == s.address {
+			continue
+		}
+		go func(addr string) {
+			var res types.GossipResponse
+			resp, err := s.sendHttp(http.MethodPut, addr, ACK_ENDPOINT, &in, &res)
+			if err != nil {
+				log.Printf("Failed to send clock to %q: %v\n", addr, err)
+			} else if resp.StatusCode != http.StatusOK {
+				log.Printf("Replica %q returned %d for our clock\n", addr, resp.StatusCode)
+			}
+		}(replica)
+	}
+}
+
+func (s *State) receiveAck(w http.ResponseWriter, r *http.Request) {
+	var res types.GossipResponse
+	defer func() {
+		if err := json.NewEncoder(w).Encode(&res); err != nil {
+			log.Println("Failed to encode gossip response:", err)
+		}
+	}()
+
+	var in types.AckInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		log.Println("Failed to decode ack input:", err)
+		return
+	}
+
+	s.store.Acknowledge(in.Origin, in.Clock)
+	res.Imported = true
+
+	if s.lagging(in.Origin, in.Clock[in.Origin]) {
+		log.Printf("Lagging behind %q, syncing from it\n", in.Origin)
+		go s.syncFrom(in.Origin)
+	}
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	GLOBAL_TXN_ENDPOINT = "/kv-store/global-txn"
+	PREPARE_ENDPOINT    = "/kv-store/global-txn/prepare"
+	COMMIT_ENDPOINT     = "/kv-store/global-txn/commit"
+	ABORT_ENDPOINT      = "/kv-store/global-txn/abort"
+	TXN_STATUS_ENDPOINT = "/kv-store/global-txn/status"
+
+	TXN_COMMITTED = "committed"
+	TXN_ABORTED   = "aborted"
+	TXN_PENDING   = "pending"
+)
+
+// coordinator tracks the transactions across shards this node is running.
+// A transaction is active from before it is prepared anywhere until it is
+// decided. Participants that ask about a transaction that is neither active
+// nor decided are told it aborted.
+type coordinator struct {
+	m      sync.Mutex
+	active map[string]bool
+	seq    uint64
+}
+
+// begin starts a transaction and returns its ID.
+func (c *coordinator) begin(addr string) string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.seq++
+	id := fmt.Sprintf("%s/%d/%d", addr, time.Now().UnixNano(), c.seq)
+	c.active[id] = true
+	return id
+}
+
+// globalTxnHandler atomically performs puts and deletes on keys of any shard.
+// The primary of each shard involved prepares its writes, and only if every
+// one of them does is the transaction committed. This is much slower than a
+// transaction within a shard, and blocks other writes to its keys on the
+// primaries while it runs.
+func (s *State) globalTxnHandler(in types.Input, res *types.Response) {
+	writes, ok := writesOf(in.Operations)
+	if !ok {
+		res.Error = msg.BadOperation
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	// Group the writes by the primary of their shard.
+	groups := make(map[string][]types.Operation)
+	for i, w := range writes {
+		shardId, err := s.hash.GetKeyShardId(w.Key)
+		if err != nil {
+			log.Printf("Failed to get shard for key %q: %v\n", w.Key, err)
+			res.Status = http.StatusServiceUnavailable
+			res.Error = msg.Unavailable
+			return
+		}
+		primary := s.hash.GetReplicas(shardId)[0]
+		groups[primary] = append(groups[primary], in.Operations[i])
+	}
+	participants := make([]string, 0, len(groups))
+	for primary := range groups {
+		participants = append(participants, primary)
+	}
+
+	id := s.txns.begin(s.address)
+	res.TxnID = id
+
+	// Phase one: every participant must promise to commit.
+	var wg sync.WaitGroup
+	votes := make(chan bool, len(groups))
+	for primary, ops := range groups {
+		wg.Add(1)
+		go func(primary string, ops []types.Operation) {
+			defer wg.Done()
+			votes <- s.sendPrepare(primary, id, in.CausalCtx.Copy(), ops)
+		}(primary, ops)
+	}
+	wg.Wait()
+	close(votes)
+	commit := true
+	for vote := range votes {
+		commit = commit && vote
+	}
+
+	// The decision is durable before anyone hears about it.
+	s.txns.m.Lock()
+	if commit {
+		if err := s.store.Decide(store.Decision{ID: id, Participants: participants}); err != nil {
+			log.Printf("Failed to decide %s: %v\n", id, err)
+			commit = false
+		}
+	}
+	delete(s.txns.active, id)
+	s.txns.m.Unlock()
+
+	if !commit {
+		// Participants we fail to reach will ask us later.
+		log.Printf("Aborting transaction %s\n", id)
+		for _, primary := range participants {
+			s.sendResolution(primary, ABORT_ENDPOINT, id)
+		}
+		res.Status = http.StatusConflict
+		res.Error = msg.TxnAborted
+		res.CausalCtx = in.CausalCtx
+		return
+	}
+
+	// Phase two: tell everyone. Anyone we fail to reach is retried later.
+	vc, _ := s.finishCommit(store.Decision{ID: id, Participants: participants})
+	vc.Max(in.CausalCtx)
+	res.Message = msg.TxnSuccess
+	res.CausalCtx = vc
+}
+
+// sendPrepare asks a shard primary to prepare its part of a transaction and
+// returns whether it promised to commit.
+func (s *State) sendPrepare(primary, id string, vc clock.VectorClock, ops []types.Operation) bool {
+	if primary == s.address {
+		writes, _ := writesOf(ops)
+		err, _ := s.store.Prepare(vc, store.PreparedTxn{ID: id, Coordinator: s.address, Writes: writes})
+		if err != nil {
+			log.Printf("Failed to prepare %s: %v\n", id, err)
+			return false
+		}
+		return true
+	}
+
+	var response types.Response
+	resp, err := s.sendHttp(http.MethodPost, primary, PREPARE_ENDPOINT, &types.Input{
+		CausalCtx:   vc,
+		Operations:  ops,
+		TxnID:       id,
+		Coordinator: s.address,
+	}, &response)
+	if err != nil {
+		log.Printf("Failed to send prepare of %s to %q: %v\n", id, primary, err)
+		return false
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Primary %q returned %d for prepare of %s\n", primary, resp.StatusCode, id)
+		return false
+	}
+	return true
+}
+
+// sendResolution tells a participant to commit or abort a transaction. It
+// returns the participant's clock and whether it was reached.
+func (s *State) sendResolution(primary, endpoint, id string) (clock.VectorClock, bool) {
+	if primary == s.address {
+		var err error
+		vc := clock.VectorClock{}
+		if endpoint == COMMIT_ENDPOINT {
+			err, vc = s.store.CommitPrepared(id)
+		} else {
+			err = s.store.AbortPrepared(id)
+		}
+		if err != nil {
+			log.Printf("Failed to resolve %s: %v\n", id, err)
+			return nil, false
+		}
+		return vc, true
+	}
+
+	var response types.Response
+	resp, err := s.sendHttp(http.MethodPost, primary, endpoint, &types.Input{TxnID: id}, &response)
+	if err != nil {
+		log.Printf("Failed to send resolution of %s to %q: %v\n", id, primary, err)
+		return nil, false
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Primary %q returned %d for resolution of %s\n", primary, resp.StatusCode, id)
+		return nil, false
+	}
+	return response.CausalCtx, true
+}
+
+// finishCommit tells every participant of a decided transaction to commit,
+// and forgets the decision once they all have. It returns the combined clock
+// of the participants that were reached and whether that was all of them.
+func (s *State) finishCommit(d store.Decision) (clock.VectorClock, bool) {
+	vc := clock.VectorClock{}
+	done := true
+	for _, primary := range d.Participants {
+		current, ok := s.sendResolution(primary, COMMIT_ENDPOINT, d.ID)
+		if !ok {
+			done = false
+			continue
+		}
+		if current != nil {
+			vc.Max(current)
+		}
+	}
+	if done {
+		if err := s.store.Forget(d.ID); err != nil {
+			log.Printf("Failed to forget %s: %v\n", d.ID, err)
+		}
+	}
+	return vc, done
+}
+
+// txnStatus is what this node knows of a transaction it coordinated.
+func (s *State) txnStatus(id string) string {
+	s.txns.m.Lock()
+	defer s.txns.m.Unlock()
+	if s.txns.active[id] {
+		return TXN_PENDING
+	} else if s.store.Decided(id) {
+		return TXN_COMMITTED
+	}
+	// Presumed abort: we never decided to commit, and now never will.
+	return TXN_ABORTED
+}
+
+// resolveTransactions periodically finishes the transactions this node
+// decided to commit, and settles the ones it prepared that have waited on
+// their coordinator for longer than timeout.
+func (s *State) resolveTransactions(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, d := range s.store.Decisions() {
+				s.finishCommit(d)
+			}
+			for _, txn := range s.store.InDoubt(now.Add(-timeout)) {
+				s.settle(txn)
+			}
+		}
+	}
+}
+
+// settle asks the coordinator of a prepared transaction what became of it.
+// If the coordinator cannot be reached the transaction stays prepared.
+func (s *State) settle(txn store.PreparedTxn) {
+	status := TXN_PENDING
+	if txn.Coordinator == s.address {
+		status = s.txnStatus(txn.ID)
+	} else {
+		var response types.Response
+		resp, err := s.sendHttp(http.MethodGet, txn.Coordinator, TXN_STATUS_ENDPOINT, &types.Input{TxnID: txn.ID}, &response)
+		if err != nil {
+			log.Printf("Failed to ask %q about %s: %v\n", txn.Coordinator, txn.ID, err)
+			return
+		} else if resp.StatusCode != http.StatusOK {
+			log.Printf("Coordinator %q returned %d for status of %s\n", txn.Coordinator, resp.StatusCode, txn.ID)
+			return
+		}
+		status = response.TxnStatus
+	}
+
+	log.Printf("Transaction %s in doubt is %s\n", txn.ID, status)
+	switch status {
+	case TXN_COMMITTED:
+		if err, _ := s.store.CommitPrepared(txn.ID); err != nil {
+			log.Printf("Failed to commit %s: %v\n", txn.ID, err)
+		}
+	case TXN_ABORTED:
+		if err := s.store.AbortPrepared(txn.ID); err != nil {
+			log.Printf("Failed to abort %s: %v\n", txn.ID, err)
+		}
+	}
+}
+
+// prepareHandler prepares this shard's part of a transaction for its
+// coordinator.
+func (s *State) prepareHandler(in types.Input, res *types.Response) {
+	writes, ok := writesOf(in.Operations)
+	if !ok || in.TxnID == "" || in.Coordinator == "" {
+		res.Error = msg.BadOperation
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	err, vc := s.store.Prepare(in.CausalCtx, store.PreparedTxn{
+		ID:          in.TxnID,
+		Coordinator: in.Coordinator,
+		Writes:      writes,
+	})
+	if errors.Is(err, store.ErrKeyLocked) {
+		res.Error = msg.KeyLocked
+		res.Status = http.StatusConflict
+		return
+	} else if errors.Is(err, store.ErrInvalidTxn) {
+		res.Error = msg.BadOperation
+		res.Status = http.StatusBadRequest
+		return
+	} else if err != nil {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
+	res.Message = msg.TxnPrepared
+	res.CausalCtx = vc
+}
+
+// commitHandler commits a prepared transaction for its coordinator.
+func (s *State) commitHandler(in types.Input, res *types.Response) {
+	err, vc := s.store.CommitPrepared(in.TxnID)
+	if err != nil {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
+	res.Message = msg.TxnSuccess
+	res.CausalCtx = vc
+}
+
+// abortHandler aborts a prepared transaction for its coordinator.
+func (s *State) abortHandler(in types.Input, res *types.Response) {
+	if err := s.store.AbortPrepared(in.TxnID); err != nil {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
+	res.Message = msg.TxnAborted
+}
+
+// txnStatusHandler tells a participant what became of a transaction.
+func (s *State) txnStatusHandler(in types.Input, res *types.Response) {
+	res.TxnID = in.TxnID
+	res.TxnStatus = s.txnStatus(in.TxnID)
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+)
+
+const (
+	TXN_ENDPOINT = "/kv-store/txn"
+)
+
+// txnHandler atomically performs puts and deletes on keys of a single shard.
+// If the shard is not ours, the transaction is sent to one of its replicas.
+func (s *State) txnHandler(in types.Input, res *types.Response) {
+	writes, ok := writesOf(in.Operations)
+	if !ok {
+		res.Error = msg.BadOperation
+		res.Status = http.StatusBadRequest
+		return
+	}
+
+	shardId := -1
+	for _, w := range writes {
+		id, err := s.hash.GetKeyShardId(w.Key)
+		if err != nil {
+			log.Printf("Failed to get shard for key %q: %v\n", w.Key, err)
+			res.Status = http.StatusServiceUnavailable
+			res.Error = msg.Unavailable
+			return
+		}
+		if shardId != -1 && id != shardId {
+			res.Error = msg.CrossShardTxn
+			res.Status = http.StatusBadRequest
+			return
+		}
+		shardId = id
+	}
+
+	if shardId != s.hash.GetShardId(s.address) {
+		s.forwardTxn(shardId, in, res)
+		return
+	}
+
+	err, replaced, vc := s.store.Transact(in.CausalCtx, writes)
+	if errors.Is(err, store.ErrInvalidTxn) {
+		res.Error = msg.BadOperation
+		res.Status = http.StatusBadRequest
+		return
+	} else if errors.Is(err, store.ErrKeyLocked) {
+		res.Error = msg.KeyLocked
+		res.Status = http.StatusConflict
+		res.CausalCtx = vc
+		return
+	} else if err != nil {
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
+
+	res.Results = make([]types.Result, len(writes))
+	for i := range writes {
+		res.Results[i].Status = http.StatusOK
+		if writes[i].Deleted {
+			res.Results[i].Exists = &replaced[i]
+			continue
+		}
+		res.Results[i].Replaced = &replaced[i]
+		if !replaced[i] {
+			res.Results[i].Status = http.StatusCreated
+		}
+	}
+	res.Message = msg.TxnSuccess
+	res.CausalCtx = vc
+}
+
+// writesOf converts the operations of a transaction to the writes they make.
+// It returns false if any is not a put or delete of a valid key.
+func writesOf(ops []types.Operation) ([]store.Entry, bool) {
+	if len(ops) == 0 || len(ops) > MAX_BATCH_SIZE {
+		return nil, false
+	}
+	writes := make([]store.Entry, len(ops))
+	for i, op := range ops {
+		if op.Op != types.OpPut && op.Op != types.OpDelete {
+			return nil, false
+		}
+		if types.CheckKey(op.Key) != "" {
+			return nil, false
+		}
+		writes[i] = store.Entry{
+			Key:     op.Key,
+			Value:   op.Value,
+			Deleted: op.Op == types.OpDelete,
+		}
+	}
+	return writes, true
+}
+
+// forwardTxn sends a transaction to the shard it belongs to.
+func (s *State) forwardTxn(shardId int, in types.Input, res *types.Response) {
+	for _, replica := range s.hash.GetReplicas(shardId) {
+		resp, err := s.sendHttp(http.MethodPost, replica, TXN_ENDPOINT, &types.Input{
+			CausalCtx:  in.CausalCtx,
+			Operations: in.Operations,
+		}, res)
+		if err != nil {
+			log.Printf("Failed to send transaction for shard %d to %q: %v\n", shardId, replica, err)
+			continue
+		}
+		res.Status = resp.StatusCode
+		res.Address = replica
+		return
+	}
+
+	log.Println("All replicas in shard", shardId, "were unreachable for transaction")
+	res.Status = http.StatusServiceUnavailable
+	res.Error = msg.Unavailable
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"path"
+
+	"github.com/spencer-p/key-value-store/pkg/crdt"
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+
+	"github.com/gorilla/mux"
+)
+
+// shouldForwardUpdate forwards an update to a typed value like a write to its
+// key. The key is the second to last element of the path.
+func (s *State) shouldForwardUpdate(r *http.Request, rm *mux.RouteMatch) bool {
+	key := path.Base(path.Dir(r.URL.Path))
+	nodeAddr, err := s.hash.Get(key)
+	return s.shouldForwardToNode(r, key, nodeAddr, err)
+}
+
+// updateHandler returns a handler that applies the operation a request asks
+// for to the typed value of its key. A key that does not exist is created as
+// the type the request names, or as kind.
+func (s *State) updateHandler(kind crdt.Kind, opOf func(types.Input) (crdt.Op, bool)) func(types.Input, *types.Response) {
+	return func(in types.Input, res *types.Response) {
+		op, ok := opOf(in)
+		if !ok {
+			res.Error = msg.BadOperation
+			res.Status = http.StatusBadRequest
+			return
+		}
+		k := kind
+		if in.Type != "" {
+			k = in.Type
+		}
+
+		err, v, vc := s.store.Update(in.CausalCtx, in.Key, k, op)
+		if errors.Is(err, store.ErrWrongType) {
+			res.Status = http.StatusConflict
+			res.Error = msg.WrongType
+			res.CausalCtx = vc
+			return
+		} else if errors.Is(err, crdt.ErrBadOp) || errors.Is(err, crdt.ErrBadKind) {
+			res.Status = http.StatusBadRequest
+			res.Error = msg.BadOperation
+			res.CausalCtx = vc
+			return
+		} else if errors.Is(err, store.ErrKeyLocked) {
+			res.Status = http.StatusConflict
+			res.Error = msg.KeyLocked
+			res.CausalCtx = vc
+			return
+		} else if err != nil {
+			res.Status = http.StatusServiceUnavailable
+			res.Error = msg.Unavailable
+			return
+		}
+
+		res.Message = msg.UpdateSuccess
+		res.Value = v.String()
+		res.Type = v.Kind
+		res.CausalCtx = vc
+	}
+}
+
+// incrOf increments a counter by the amount given, or by one.
+func incrOf(in types.Input) (crdt.Op, bool) {
+	if in.Amount == nil {
+		return crdt.Op{Amount: 1}, true
+	}
+	return crdt.Op{Amount: *in.Amount}, *in.Amount > 0
+}
+
+// decrOf decrements a counter by the amount given, or by one.
+func decrOf(in types.Input) (crdt.Op, bool) {
+	op, ok := incrOf(in)
+	op.Amount = -op.Amount
+	return op, ok
+}
+
+func addOf(in types.Input) (crdt.Op, bool) {
+	return crdt.Op{Add: in.Members}, len(in.Members) > 0
+}
+
+func removeOf(in types.Input) (crdt.Op, bool) {
+	return crdt.Op{Remove: in.Members}, len(in.Members) > 0
+}
+
+func putOf(in types.Input) (crdt.Op, bool) {
+	return crdt.Op{Put: in.Fields}, len(in.Fields) > 0
+}
+
+func deleteOf(in types.Input) (crdt.Op, bool) {
+	return crdt.Op{Delete: in.Names}, len(in.Names) > 0
+}
@@ -35,6 +35,7 @@ func (s *State) viewChange(in types.Input, res *types.Response) {
 
 	log.Printf("Received view change %#v, acting as coordinator\n", in.View)
 	oldview := s.hash.GetView()
+	in.View.Epoch = oldview.Epoch + 1
 	nshards := len(oldview.Members) / oldview.ReplFactor
 	storageCh := make(chan []store.Entry)
 
@@ -202,8 +203,14 @@ func (s *State) primaryCollect(in types.Input, res *types.Response) {
 func (s *State) primaryReplace(in types.Input, res *types.Response) {
 	s.hash.TestAndSet(in.View)
 	log.Println("Replacing storage with", len(in.StorageState), "entries")
-	s.store.ReplaceEntries(in.StorageState)
+	if err := s.store.ReplaceEntries(in.StorageState); err != nil {
+		log.Println("Failed to replace storage:", err)
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
 	s.store.SetReplicas(s.hash.GetReplicas(s.hash.GetShardId(s.address)))
+	s.pruneClock()
 	var wg sync.WaitGroup
 
 	shardId := s.hash.GetShardId(s.address)
@@ -247,8 +254,23 @@ func (s *State) secondaryCollect(in types.Input, res *types.Response) {
 func (s *State) secondaryReplace(in types.Input, res *types.Response) {
 	s.hash.TestAndSet(in.View)
 	log.Println("Replacing storage with", len(in.StorageState), "entries")
-	s.store.ReplaceEntries(in.StorageState)
+	if err := s.store.ReplaceEntries(in.StorageState); err != nil {
+		log.Println("Failed to replace storage:", err)
+		res.Status = http.StatusServiceUnavailable
+		res.Error = msg.Unavailable
+		return
+	}
 	s.store.SetReplicas(s.hash.GetReplicas(s.hash.GetShardId(s.address)))
+	s.pruneClock()
+}
+
+// pruneClock forgets the nodes that left the view once our storage is
+// replaced, and stops gossiping to those that are no longer our replicas.
+func (s *State) pruneClock() {
+	if err := s.store.Prune(s.hash.GetView().Members); err != nil {
+		log.Println("Failed to prune the clock:", err)
+	}
+	s.retireQueues()
 }
 
 // sendHttp builds a request and issues it with a JSON body matching input.
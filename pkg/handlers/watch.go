@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/types"
+	"github.com/spencer-p/key-value-store/pkg/util"
+)
+
+const (
+	WATCH_ENDPOINT = "/kv-store/watch"
+
+	// An idle stream is sent a comment every WATCH_HEARTBEAT so that
+	// proxies and clients do not give up on it.
+	WATCH_HEARTBEAT = 15 * time.Second
+)
+
+// watchHandler streams every change to a key, or to every key with a prefix,
+// as server-sent events. A key is watched on its own shard and a prefix on
+// every shard; changes from other shards are relayed from one of their
+// replicas. If a causal context is given, the latest change to every watched
+// key that the context has not seen is sent first. The stream ends if any
+// shard stops answering or the watcher falls behind, and the client should
+// reconnect with the clock of the last event it saw.
+func (s *State) watchHandler(w http.ResponseWriter, r *http.Request) {
+	var in types.Input
+	if ok, errMsg := types.ParseInput(r, &in); !ok {
+		result := types.Response{Status: http.StatusBadRequest, Error: errMsg}
+		result.Serve(w, r)
+		return
+	}
+	if in.CausalCtx == nil {
+		in.CausalCtx = clock.VectorClock{}
+	}
+	rng, ok := watchRange(in.Query)
+	if !ok {
+		result := types.Response{Status: http.StatusBadRequest, Error: msg.BadWatch}
+		result.Serve(w, r)
+		return
+	}
+
+	// Work out which shards hold the keys.
+	ownShard := s.hash.GetShardId(s.address)
+	var shards []int
+	if key := in.Query.Get("key"); key != "" {
+		shardId, err := s.hash.GetKeyShardId(key)
+		if err != nil {
+			log.Printf("Failed to get shard for key %q: %v\n", key, err)
+			result := types.Response{Status: http.StatusServiceUnavailable, Error: msg.Unavailable}
+			result.Serve(w, r)
+			return
+		}
+		shards = []int{shardId}
+	} else {
+		view := s.hash.GetView()
+		for i := 1; i <= len(view.Members)/view.ReplFactor; i++ {
+			shards = append(shards, i)
+		}
+	}
+	if in.Query.Get("local") != "" {
+		shards = []int{ownShard}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events := make(chan types.Event)
+	failed := make(chan error, len(shards))
+
+	// Connect to every other shard before answering, so that a shard that
+	// cannot be reached fails the request instead of the stream.
+	for _, shardId := range shards {
+		if shardId == ownShard {
+			continue
+		}
+		body, err := s.openWatch(ctx, shardId, r.URL.Query(), in.CausalCtx)
+		if err != nil {
+			result := types.Response{Status: http.StatusServiceUnavailable, Error: msg.Unavailable}
+			result.Serve(w, r)
+			return
+		}
+		defer body.Close()
+		go func(shardId int) {
+			failed <- fmt.Errorf("shard %d: %w", shardId, relayEvents(ctx, body, events))
+		}(shardId)
+	}
+	for _, shardId := range shards {
+		if shardId != ownShard {
+			continue
+		}
+		watcher := s.store.Watch(rng, in.CausalCtx)
+		defer s.store.Unwatch(watcher)
+		go func() {
+			failed <- watchEvents(ctx, watcher, events)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	heartbeat := time.NewTicker(WATCH_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		var buf []byte
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-failed:
+			log.Println("Ending watch:", err)
+			return
+		case <-heartbeat.C:
+			buf = []byte(": keep-alive\n\n")
+		case event := <-events:
+			data, err := json.Marshal(&event)
+			if err != nil {
+				log.Printf("Failed to encode change to %q: %v\n", event.Key, err)
+				return
+			}
+			buf = append(append([]byte("data: "), data...), '\n', '\n')
+		}
+		if _, err := w.Write(buf); err != nil {
+			log.Println("Failed to write watch:", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// watchRange returns the keys a watch covers, given either a key or a
+// prefix. An empty prefix watches every key.
+func watchRange(query url.Values) (store.Range, bool) {
+	key, hasKey := query.Get("key"), query["key"] != nil
+	prefix, hasPrefix := query.Get("prefix"), query["prefix"] != nil
+	switch {
+	case hasKey && !hasPrefix && key != "" && len(key) <= 50:
+		return store.Range{Start: key, End: key + "\x00"}, true
+	case hasPrefix && !hasKey:
+		return store.Range{Prefix: prefix}, true
+	}
+	return store.Range{}, false
+}
+
+// openWatch starts watching another shard on the first of its replicas that
+// answers. The caller must close the returned stream.
+func (s *State) openWatch(ctx context.Context, shardId int, query url.Values, vc clock.VectorClock) (io.ReadCloser, error) {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(&types.Input{CausalCtx: vc}); err != nil {
+		return nil, err
+	}
+	query.Set("local", "true")
+
+	// The stream lasts as long as the watch, so the client's timeout does
+	// not apply.
+	cli := &http.Client{Transport: s.cli.Transport}
+	for _, replica := range s.hash.GetReplicas(shardId) {
+		target, err := url.Parse(util.CorrectURL(replica))
+		if err != nil {
+			log.Printf("Bad forwarding address %q: %v\n", replica, err)
+			continue
+		}
+		target.Path = path.Join(target.Path, WATCH_ENDPOINT)
+		target.RawQuery = query.Encode()
+
+		request, err := http.NewRequest(http.MethodGet, target.String(), bytes.NewReader(body.Bytes()))
+		if err != nil {
+			log.Printf("Failed to build request to %q: %v\n", replica, err)
+			continue
+		}
+		request = request.WithContext(ctx)
+		request.Header.Set("Content-Type", "application/json")
+
+		resp, err := cli.Do(request)
+		if err != nil {
+			log.Printf("Failed to watch shard %d on %q: %v\n", shardId, replica, err)
+			continue
+		} else if resp.StatusCode != http.StatusOK {
+			log.Printf("Replica %q returned %d for watch of shard %d\n", replica, resp.StatusCode, shardId)
+			resp.Body.Close()
+			continue
+		}
+		return resp.Body, nil
+	}
+
+	log.Println("All replicas in shard", shardId, "were unreachable for watch")
+	return nil, fmt.Errorf("shard %d is unreachable", shardId)
+}
+
+// relayEvents passes on the events streamed by another replica until the
+// stream ends.
+func relayEvents(ctx context.Context, body io.Reader, events chan<- types.Event) error {
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event types.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			return err
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// watchEvents passes on the changes seen by a watcher of the local store
+// until it is stopped or dropped.
+func watchEvents(ctx context.Context, watcher *store.Watcher, events chan<- types.Event) error {
+	for {
+		select {
+		case e, ok := <-watcher.C:
+			if !ok {
+				return fmt.Errorf("watcher fell behind")
+			}
+			event := types.Event{
+				Key:       e.Key,
+				Value:     e.Value,
+				Deleted:   e.Deleted,
+				Version:   e.Version,
+				CausalCtx: e.Clock,
+			}
+			if e.Deleted {
+				event.Value = ""
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
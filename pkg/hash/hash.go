@@ -16,10 +16,15 @@ var (
 	ErrNoElements = errors.New("No elements to hash to")
 )
 
+// PAST_VIEWS is how many earlier views a hash remembers the members of.
+const PAST_VIEWS = 8
+
 // Hash implements simple modulo hashing.
 type Hash struct {
 	elts       []string
 	replFactor int
+	epoch      uint64
+	past       map[uint64][]string
 	fnv        hash.Hash32
 	mtx        sync.Mutex // TODO Is this lock necessary?
 }
@@ -29,6 +34,7 @@ func New(view types.View) *Hash {
 		elts:       view.Members,
 		fnv:        fnv.New32(),
 		replFactor: view.ReplFactor,
+		epoch:      view.Epoch,
 	}
 }
 
@@ -139,23 +145,60 @@ func (m *Hash) GetView() types.View {
 	var view types.View
 	view.Members = m.elts
 	view.ReplFactor = m.replFactor
+	view.Epoch = m.epoch
 	return view
 }
 
 // Test and set performs an atomic Set operation iff the new member slice is
-// different than the old. Returns true if the member slice changed.
+// different than the old. Returns true if the member slice changed. The epoch
+// is taken from the new view if it is later, even if the members are the same.
 func (m *Hash) TestAndSet(view types.View) bool {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	old := m.elts
 	viewIsNew := !eltsEqual(view.Members, m.elts) || view.ReplFactor != m.replFactor
 	if viewIsNew {
 		m.elts = view.Members
 		m.replFactor = view.ReplFactor
 	}
+	if view.Epoch > m.epoch {
+		m.remember(m.epoch, old)
+		m.epoch = view.Epoch
+	}
 	return viewIsNew
 }
 
+// remember keeps the members of a past view, forgetting the oldest once there
+// are more than PAST_VIEWS.
+func (m *Hash) remember(epoch uint64, members []string) {
+	if m.past == nil {
+		m.past = make(map[uint64][]string)
+	}
+	m.past[epoch] = members
+	for len(m.past) > PAST_VIEWS {
+		oldest := epoch
+		for e := range m.past {
+			if e < oldest {
+				oldest = e
+			}
+		}
+		delete(m.past, oldest)
+	}
+}
+
+// PastViews returns the members of the views before this one by their epoch.
+func (m *Hash) PastViews() map[uint64][]string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	past := make(map[uint64][]string, len(m.past))
+	for epoch, members := range m.past {
+		past[epoch] = members
+	}
+	return past
+}
+
 // eltsEqual returns true iff the elts are the same set-wise.
 func eltsEqual(e1 []string, e2 []string) bool {
 	s1 := util.StringSet(e1)
@@ -52,3 +52,19 @@ func TestShardMembers(t *testing.T) {
 		t.Errorf("did not get correct shard (-got,+want): %s", diff)
 	}
 }
+
+func TestPastViews(t *testing.T) {
+	h := New(types.View{Members: []string{"a", "b"}, ReplFactor: 1, Epoch: 1})
+	h.TestAndSet(types.View{Members: []string{"a", "c"}, ReplFactor: 1, Epoch: 2})
+	if diff := cmp.Diff(h.PastViews(), map[uint64][]string{1: {"a", "b"}}); diff != "" {
+		t.Errorf("Bad past views (-got,+want): %s", diff)
+	}
+
+	for epoch := uint64(3); epoch < 3+2*PAST_VIEWS; epoch++ {
+		h.TestAndSet(types.View{Members: []string{"a"}, ReplFactor: 1, Epoch: epoch})
+	}
+	past := h.PastViews()
+	if _, ok := past[1]; ok || len(past) != PAST_VIEWS {
+		t.Errorf("Kept %d past views, wanted only the last %d", len(past), PAST_VIEWS)
+	}
+}
@@ -12,12 +12,39 @@ const (
 	PartialViewChangeSuccess = "Partial view change successful"
 	ShardInfoSuccess         = "Shard information retrieved successfully"
 	ShardMembSuccess         = "Shard membership retrieved successfully"
+	SnapshotSuccess          = "Snapshot taken successfully"
+	ScanSuccess              = "Keys retrieved successfully"
+	PartialScanSuccess       = "Keys retrieved from reachable shards"
+	BatchSuccess             = "Batch processed"
+	TxnSuccess               = "Transaction committed"
+	ChangesSuccess           = "Changes retrieved successfully"
+	TxnPrepared              = "Transaction prepared"
+	TxnAborted               = "Transaction aborted"
+	HintedSuccess            = "Accepted on behalf of an unreachable replica"
+	Healthy                  = "Healthy"
 
-	FailedToParse = "Failed to parse request body"
-	KeyMissing    = "Key is missing"
-	KeyDNE        = "Key does not exist"
-	KeyTooLong    = "Key is too long"
-	ValueMissing  = "Value is missing"
-	BadForwarding = "Bad forwarding address"
-	Unavailable   = "Unable to satisfy request"
+	FailedToParse   = "Failed to parse request body"
+	KeyMissing      = "Key is missing"
+	KeyDNE          = "Key does not exist"
+	KeyTooLong      = "Key is too long"
+	ValueMissing    = "Value is missing"
+	BadExpiry       = "TTL or expiry is invalid"
+	BadRange        = "Key range is invalid"
+	BadOperation    = "Operation is invalid"
+	BatchTooLarge   = "Batch is too large"
+	CrossShardTxn   = "Transaction spans multiple shards"
+	WrongType       = "Key holds a value of another type"
+	BadWatch        = "Watch needs a key or prefix"
+	BadCursor       = "Cursor is invalid"
+	BadContext      = "Causal context is invalid"
+	BadPrecondition = "Precondition cannot be met"
+
+	BadForwarding      = "Bad forwarding address"
+	Unavailable        = "Unable to satisfy request"
+	PreconditionFailed = "Precondition failed"
+	KeyLocked          = "Key is locked by a transaction"
+	ChangesCompacted   = "Changes after the cursor were compacted"
+
+	NotPersistent   = "Store is not persistent"
+	SnapshotFailure = "Failed to take snapshot"
 )
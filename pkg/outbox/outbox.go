@@ -0,0 +1,528 @@
+// Package outbox queues the gossip a node sends to each of its peers, so that
+// it is delivered in order and in bounded memory however long a peer is down.
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/store"
+)
+
+// Item is a write to gossip to a peer.
+type Item struct {
+	Entry *store.Entry `json:"entry,omitempty"`
+
+	// Skipped is how many writes made before Entry were coalesced into it.
+	Skipped uint64 `json:"skipped,omitempty"`
+}
+
+// Options configures a queue.
+type Options struct {
+	// Capacity is how many items are kept in memory.
+	Capacity int
+
+	// Dir, if set, is where items beyond the capacity spill to, and where
+	// the queue is kept while the node is down. Otherwise they are dropped.
+	Dir string
+
+	// KeepAll keeps items beyond the capacity in memory when there is no Dir
+	// instead of dropping them, for when nothing else would repair them.
+	KeepAll bool
+}
+
+// Stats describes the state of a queue.
+type Stats struct {
+	// Depth is how many items are waiting to be delivered, including those
+	// spilled to disk.
+	Depth   int `json:"depth"`
+	Spilled int `json:"spilled"`
+
+	// Coalesced and Dropped count the items that were never queued: those
+	// coalesced into a later one and those that did not fit.
+	Coalesced uint64 `json:"coalesced"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// Queue holds the items for one peer, oldest first. The oldest are in memory
+// and the rest, if any, are spilled to a file in the order they were pushed.
+//
+// Beside the items, a queue counts the writes other replicas imported that the
+// peer has yet to hear of. The counts are not ordered with the items: the peer
+// may need them to import a write from another replica before it can import
+// the next item, so they must never wait behind one.
+type Queue struct {
+	opts Options
+	path string
+
+	m        sync.Mutex
+	items    []Item
+	inflight int // how many of the first items are being delivered
+	spill    *os.File
+	spilled  int
+	readOff  int64 // where the spilled items not loaded start
+	closed   bool
+	notify   chan struct{}
+
+	counts  map[string]uint64
+	sending map[string]uint64 // counts being delivered
+	counted chan struct{}
+	settled *sync.Cond // signalled when counts are no longer being delivered
+
+	coalesced, dropped uint64
+}
+
+// Open returns the queue called name, with any items it kept on disk.
+func Open(name string, opts Options) (*Queue, error) {
+	if opts.Capacity < 1 {
+		opts.Capacity = 1
+	}
+	q := &Queue{
+		opts:    opts,
+		notify:  make(chan struct{}, 1),
+		counts:  make(map[string]uint64),
+		counted: make(chan struct{}, 1),
+	}
+	q.settled = sync.NewCond(&q.m)
+	if opts.Dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	q.path = filepath.Join(opts.Dir, name)
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	q.spill = f
+
+	// Count what was kept; it is loaded as it is needed.
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		q.spilled++
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if q.spilled > 0 {
+		log.Printf("Recovered %d queued items for %s\n", q.spilled, name)
+	}
+
+	b, err := ioutil.ReadFile(q.countsPath())
+	if err == nil {
+		if err := json.Unmarshal(b, &q.counts); err != nil {
+			log.Printf("Discarding queued import counts for %s that could not be read: %v\n", name, err)
+			q.counts = make(map[string]uint64)
+		}
+	} else if !os.IsNotExist(err) {
+		f.Close()
+		return nil, err
+	}
+	if len(q.counts) > 0 {
+		signal(q.counted)
+	}
+	return q, nil
+}
+
+// Push adds an item to the end of the queue. A write replaces the write before
+// it if it is the last item and the new write replaces it for the peer.
+func (q *Queue) Push(it Item) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return
+	}
+	defer q.wake()
+
+	if q.spilled == 0 && q.coalesce(it) {
+		q.coalesced++
+		return
+	}
+	if q.spilled == 0 && len(q.items) < q.opts.Capacity {
+		q.items = append(q.items, it)
+		return
+	}
+	if q.spill != nil {
+		err := q.append(it)
+		if err == nil {
+			q.spilled++
+			return
+		}
+		log.Println("Failed to spill queued item:", err)
+	} else if q.opts.KeepAll {
+		q.items = append(q.items, it)
+		return
+	}
+	q.dropped++
+	if q.dropped == 1 || q.dropped%1000 == 0 {
+		log.Printf("Queue is full, dropped %d items so far\n", q.dropped)
+	}
+}
+
+// coalesce merges the item into the last one in memory, unless that one is
+// being delivered. It returns true if it did.
+func (q *Queue) coalesce(it Item) bool {
+	n := len(q.items)
+	if n <= q.inflight {
+		return false
+	}
+	last := &q.items[n-1]
+	switch {
+	case it.Entry != nil && last.Entry != nil && it.Entry.Replaces(*last.Entry):
+		it.Skipped += last.Skipped + 1
+		*last = it
+		return true
+	}
+	return false
+}
+
+// Next returns up to max of the oldest items, waiting for one if the queue is
+// empty, and then for up to linger for more until there are max. It returns
+// false if the context is done or the queue closed first. The items stay in
+// the queue until they are marked Done.
+func (q *Queue) Next(ctx context.Context, max int, linger time.Duration) ([]Item, bool) {
+	if max < 1 {
+		max = 1
+	}
+	var timer *time.Timer
+	var lingered <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for done := linger <= 0; ; {
+		q.m.Lock()
+		if q.closed {
+			q.m.Unlock()
+			return nil, false
+		}
+		if len(q.items) < max && q.spilled > 0 {
+			q.load()
+		}
+		n := len(q.items)
+		if n > max {
+			n = max
+		}
+		if n > 0 && (done || n == max || n == q.opts.Capacity) {
+			q.inflight = n
+			items := make([]Item, n)
+			copy(items, q.items)
+			q.m.Unlock()
+			return items, true
+		}
+		q.m.Unlock()
+
+		if n > 0 && timer == nil {
+			timer = time.NewTimer(linger)
+			lingered = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-q.notify:
+		case <-lingered:
+			done = true
+		}
+	}
+}
+
+// Done removes the items returned by Next once they are delivered.
+func (q *Queue) Done() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for i := 0; i < q.inflight; i++ {
+		q.items[i] = Item{}
+	}
+	q.items = q.items[q.inflight:]
+	q.inflight = 0
+}
+
+// Count adds n writes imported by node to tell the peer about.
+func (q *Queue) Count(node string, n uint64) {
+	if n == 0 {
+		return
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.counts[node] += n
+	signal(q.counted)
+}
+
+// Counts waits for imports to tell the peer about, and then for up to linger
+// for more, and takes them. It returns false if the context is done or the
+// queue closed first. Each attempt to deliver the counts must be followed by
+// CountsDone, which gives them back if it failed.
+func (q *Queue) Counts(ctx context.Context, linger time.Duration) (map[string]uint64, bool) {
+	for waited := false; ; {
+		q.m.Lock()
+		if q.closed {
+			q.m.Unlock()
+			return nil, false
+		}
+		if len(q.counts) > 0 && (waited || linger <= 0) {
+			counts := q.counts
+			q.sending = counts
+			q.counts = make(map[string]uint64)
+			q.m.Unlock()
+			return counts, true
+		}
+		pending := len(q.counts) > 0
+		q.m.Unlock()
+
+		if pending {
+			select {
+			case <-ctx.Done():
+				return nil, false
+			case <-time.After(linger):
+				waited = true
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-q.counted:
+		}
+	}
+}
+
+// CountsDone ends an attempt to deliver the counts returned by Counts, giving
+// them back if they were not delivered.
+func (q *Queue) CountsDone(delivered bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if !delivered {
+		for node, n := range q.sending {
+			q.counts[node] += n
+		}
+		if len(q.counts) > 0 {
+			signal(q.counted)
+		}
+	}
+	q.sending = nil
+	q.settled.Broadcast()
+}
+
+// Stats returns the state of the queue.
+func (q *Queue) Stats() Stats {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return Stats{
+		Depth:     len(q.items) + q.spilled,
+		Spilled:   q.spilled,
+		Coalesced: q.coalesced,
+		Dropped:   q.dropped,
+	}
+}
+
+// Close stops the queue. Items in memory are written to disk ahead of those
+// spilled, and the import counts beside them, so the queue picks up where it
+// left off when opened again. Items being delivered are kept too, and may be
+// delivered twice. Counts are not, since a peer would count them twice: Close
+// waits for the attempt to deliver them to end.
+func (q *Queue) Close() error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.stop()
+	for q.sending != nil {
+		q.settled.Wait()
+	}
+	if q.spill == nil {
+		return nil
+	}
+	if err := q.saveCounts(); err != nil {
+		q.spill.Close()
+		return err
+	}
+
+	rest, err := q.unloaded()
+	if err != nil {
+		q.spill.Close()
+		return err
+	}
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		q.spill.Close()
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, it := range q.items {
+		if err = enc.Encode(&it); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = w.Write(rest)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	q.spill.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// Discard stops the queue and deletes what it kept on disk, for a peer that is
+// no longer a replica.
+func (q *Queue) Discard() error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.stop()
+	if q.spill == nil {
+		return nil
+	}
+	q.spill.Close()
+	if err := os.Remove(q.countsPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(q.path)
+}
+
+// wake tells a waiting Next that there may be an item.
+func (q *Queue) wake() {
+	signal(q.notify)
+}
+
+// stop closes the queue and wakes anything waiting on it.
+func (q *Queue) stop() {
+	q.closed = true
+	signal(q.notify)
+	signal(q.counted)
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// append spills an item to the end of the file.
+func (q *Queue) append(it Item) error {
+	b, err := json.Marshal(&it)
+	if err != nil {
+		return err
+	}
+	_, err = q.spill.Write(append(b, '\n'))
+	return err
+}
+
+// load reads spilled items into memory, up to the capacity. Once every item
+// has been read the file is emptied.
+func (q *Queue) load() {
+	f, err := os.Open(q.path)
+	if err != nil {
+		log.Println("Failed to read spilled items:", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(q.readOff, io.SeekStart); err != nil {
+		log.Println("Failed to read spilled items:", err)
+		return
+	}
+
+	r := bufio.NewReader(f)
+	for q.spilled > 0 && len(q.items) < q.opts.Capacity {
+		line, err := r.ReadBytes('\n')
+		var it Item
+		if err == nil {
+			err = json.Unmarshal(line, &it)
+		}
+		if err != nil {
+			log.Printf("Discarding %d spilled items that could not be read: %v\n", q.spilled, err)
+			q.spilled = 0
+			break
+		}
+		q.items = append(q.items, it)
+		q.readOff += int64(len(line))
+		q.spilled--
+	}
+
+	if q.spilled == 0 {
+		if err := q.spill.Truncate(0); err != nil {
+			log.Println("Failed to empty spilled items:", err)
+		}
+		q.readOff = 0
+	}
+}
+
+// countsPath returns the path of the file the import counts are kept in.
+func (q *Queue) countsPath() string {
+	return q.path + ".counts"
+}
+
+// saveCounts writes the import counts not yet delivered to disk, or removes
+// the file if there are none.
+func (q *Queue) saveCounts() error {
+	if len(q.counts) == 0 {
+		if err := os.Remove(q.countsPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(q.counts)
+	if err != nil {
+		return err
+	}
+	tmp := q.countsPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, q.countsPath())
+}
+
+// unloaded returns the spilled items that are not loaded, as they are written.
+func (q *Queue) unloaded() ([]byte, error) {
+	if q.spilled == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(q.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(q.readOff, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
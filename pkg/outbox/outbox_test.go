@@ -0,0 +1,252 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const Alice = "1.1.1.1:8080"
+
+// write returns an item for the nth write of Alice, to key.
+func write(n uint64, key string) Item {
+	return Item{Entry: &store.Entry{
+		Key:     key,
+		Value:   key,
+		Clock:   clock.VectorClock{Alice: n},
+		Version: uuid.UUID{Seq: n},
+	}}
+}
+
+// drain delivers every item in the queue, describing each as its key and
+// how many writes it skipped.
+func drain(t *testing.T, q *Queue) []string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := []string{}
+	for q.Stats().Depth > 0 {
+		items, ok := q.Next(ctx, 1, 0)
+		if !ok {
+			t.Fatalf("Queue closed with %d items", q.Stats().Depth)
+		}
+		it := items[0]
+		got = append(got, fmt.Sprintf("%s%d", it.Entry.Key, it.Skipped))
+		q.Done()
+	}
+	return got
+}
+
+func TestQueue(t *testing.T) {
+	q, err := Open("peer", Options{Capacity: 10})
+	if err != nil {
+		t.Fatalf("Failed to open queue: %v", err)
+	}
+	q.Push(write(1, "x"))
+	q.Push(write(2, "x"))
+	q.Push(write(3, "y"))
+	q.Push(write(4, "x"))
+
+	if diff := cmp.Diff(drain(t, q), []string{"x1", "y0", "x0"}); diff != "" {
+		t.Errorf("Bad items (-got,+want): %s", diff)
+	}
+	if stats := q.Stats(); stats.Coalesced != 1 || stats.Dropped != 0 {
+		t.Errorf("Got stats %+v, wanted 1 coalesced", stats)
+	}
+
+	// The item being delivered is never coalesced into.
+	q.Push(write(5, "x"))
+	ctx := context.Background()
+	if items, _ := q.Next(ctx, 1, 0); items[0].Entry.Key != "x" {
+		t.Fatalf("Got %+v, wanted x", items)
+	}
+	q.Push(write(6, "x"))
+	q.Done()
+	if diff := cmp.Diff(drain(t, q), []string{"x0"}); diff != "" {
+		t.Errorf("Bad items after delivering (-got,+want): %s", diff)
+	}
+
+	// A write that keeps the last as a sibling does not replace it.
+	sibling := write(7, "x")
+	q.Push(write(6, "x"))
+	sibling.Entry.Siblings = []store.Entry{*write(6, "x").Entry, *sibling.Entry}
+	q.Push(sibling)
+	if diff := cmp.Diff(drain(t, q), []string{"x0", "x0"}); diff != "" {
+		t.Errorf("Bad items with siblings (-got,+want): %s", diff)
+	}
+}
+
+func TestQueueBounds(t *testing.T) {
+	q, _ := Open("peer", Options{Capacity: 2})
+	for i, key := range []string{"a", "b", "c", "d"} {
+		q.Push(write(uint64(i+1), key))
+	}
+	if stats := q.Stats(); stats.Depth != 2 || stats.Dropped != 2 {
+		t.Errorf("Got stats %+v, wanted 2 kept and 2 dropped", stats)
+	}
+
+	// Unless nothing else would repair what is dropped.
+	q, _ = Open("peer", Options{Capacity: 2, KeepAll: true})
+	for i, key := range []string{"a", "b", "c", "d"} {
+		q.Push(write(uint64(i+1), key))
+	}
+	if diff := cmp.Diff(drain(t, q), []string{"a0", "b0", "c0", "d0"}); diff != "" {
+		t.Errorf("Bad items kept beyond the capacity (-got,+want): %s", diff)
+	}
+
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("Failed to make a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err = Open("peer", Options{Capacity: 2, Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open queue: %v", err)
+	}
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		q.Push(write(uint64(i+1), key))
+	}
+	if stats := q.Stats(); stats.Depth != 5 || stats.Spilled != 3 {
+		t.Errorf("Got stats %+v, wanted 3 of 5 spilled", stats)
+	}
+	items, _ := q.Next(context.Background(), 1, 0)
+	q.Done()
+	if items[0].Entry.Key != "a" {
+		t.Errorf("Got %q first, wanted a", items[0].Entry.Key)
+	}
+
+	// What is left is kept across a restart, in order.
+	if err := q.Close(); err != nil {
+		t.Fatalf("Failed to close queue: %v", err)
+	}
+	q, err = Open("peer", Options{Capacity: 2, Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to reopen queue: %v", err)
+	}
+	q.Push(write(6, "f"))
+	if diff := cmp.Diff(drain(t, q), []string{"b0", "c0", "d0", "e0", "f0"}); diff != "" {
+		t.Errorf("Bad items after a restart (-got,+want): %s", diff)
+	}
+	if err := q.Discard(); err != nil {
+		t.Errorf("Failed to discard queue: %v", err)
+	}
+}
+
+func TestQueueBatches(t *testing.T) {
+	ctx := context.Background()
+	q, _ := Open("peer", Options{Capacity: 10})
+	for i, key := range []string{"a", "b", "c"} {
+		q.Push(write(uint64(i+1), key))
+	}
+
+	items, _ := q.Next(ctx, 2, time.Hour)
+	if len(items) != 2 || items[0].Entry.Key != "a" || items[1].Entry.Key != "b" {
+		t.Errorf("Got batch %+v, wanted a and b", items)
+	}
+
+	// Writes to a key in the batch being delivered are not coalesced.
+	q.Push(write(4, "b"))
+	q.Done()
+	if depth := q.Stats().Depth; depth != 2 {
+		t.Errorf("Got depth %d after delivering a batch, wanted 2", depth)
+	}
+
+	// A batch short of the maximum waits for more, up to the linger.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Push(write(5, "e"))
+	}()
+	start := time.Now()
+	items, _ = q.Next(ctx, 10, 50*time.Millisecond)
+	if len(items) != 3 {
+		t.Errorf("Got a batch of %d, wanted 3", len(items))
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Got a batch after %v, wanted it to linger", waited)
+	}
+}
+
+func TestQueueCounts(t *testing.T) {
+	q, err := Open("peer", Options{Capacity: 1})
+	if err != nil {
+		t.Fatalf("Failed to open queue: %v", err)
+	}
+	ctx := context.Background()
+
+	// Counts are not held up by an item being delivered.
+	q.Push(write(1, "x"))
+	if _, ok := q.Next(ctx, 1, 0); !ok {
+		t.Fatalf("Queue closed")
+	}
+	q.Count(Alice, 1)
+	q.Count(Alice, 2)
+	q.Count("bob", 1)
+	counts, ok := q.Counts(ctx, time.Millisecond)
+	if !ok {
+		t.Fatalf("Queue closed")
+	}
+	if diff := cmp.Diff(counts, map[string]uint64{Alice: 3, "bob": 1}); diff != "" {
+		t.Errorf("Bad counts (-got,+want): %s", diff)
+	}
+	q.CountsDone(true)
+
+	done := make(chan bool)
+	go func() {
+		_, ok := q.Counts(ctx, 0)
+		done <- ok
+	}()
+	q.Close()
+	if ok := <-done; ok {
+		t.Errorf("Got counts from a closed queue")
+	}
+
+	// Counts not yet delivered are kept across a restart, including those
+	// that were being delivered when the queue closed.
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatalf("Failed to make a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err = Open("peer", Options{Capacity: 1, Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to open queue: %v", err)
+	}
+	q.Count(Alice, 2)
+	if _, ok := q.Counts(ctx, 0); !ok {
+		t.Fatalf("Queue closed")
+	}
+	q.Count(Alice, 1)
+	closed := make(chan error)
+	go func() {
+		closed <- q.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("Closed while counts were being delivered")
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.CountsDone(false)
+	if err := <-closed; err != nil {
+		t.Fatalf("Failed to close queue: %v", err)
+	}
+	q, err = Open("peer", Options{Capacity: 1, Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to reopen queue: %v", err)
+	}
+	counts, _ = q.Counts(ctx, 0)
+	if diff := cmp.Diff(counts, map[string]uint64{Alice: 3}); diff != "" {
+		t.Errorf("Bad counts after a restart (-got,+want): %s", diff)
+	}
+	if err := q.Discard(); err != nil {
+		t.Errorf("Failed to discard queue: %v", err)
+	}
+}
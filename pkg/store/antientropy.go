@@ -0,0 +1,200 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sort"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+const (
+	// MERKLE_FANOUT is how many children each node of a Merkle tree has.
+	MERKLE_FANOUT = 16
+	// MERKLE_DEPTH is how many levels a Merkle tree has below its root. Keys
+	// are hashed into MERKLE_FANOUT^MERKLE_DEPTH buckets at its leaves.
+	MERKLE_DEPTH = 2
+)
+
+// Tree is a Merkle tree of the entries of a store. Replicas holding the same
+// entries have the same tree, and where two trees differ leads to the buckets
+// of the keys that differ.
+type Tree struct {
+	// Levels holds the hashes of each level from the root down. Node i of a
+	// level has the nodes i*MERKLE_FANOUT up to (i+1)*MERKLE_FANOUT on the
+	// next. The last level has a hash of the entries of each bucket.
+	Levels [][]uint64 `json:"levels"`
+
+	// Clock is the clock of the store when the tree was taken. A replica that
+	// repairs every bucket where its tree differs has every write in it.
+	Clock clock.VectorClock `json:"clock,omitempty"`
+}
+
+// Tree returns the Merkle tree of the store.
+func (s *Store) Tree() Tree {
+	leaves := make([]uint64, buckets())
+	s.m.Lock()
+	if err := s.store.Iterate(func(key string, e Entry) IterAction {
+		leaves[bucketOf(key)] ^= fingerprint(e)
+		return CONTINUE
+	}); err != nil {
+		log.Println("Failed to iterate over store:", err)
+	}
+	vc := s.vc.Copy()
+	s.m.Unlock()
+
+	levels := [][]uint64{leaves}
+	for len(levels[0]) > 1 {
+		children := levels[0]
+		parents := make([]uint64, len(children)/MERKLE_FANOUT)
+		for i := range parents {
+			parents[i] = hashOf(children[i*MERKLE_FANOUT : (i+1)*MERKLE_FANOUT])
+		}
+		levels = append([][]uint64{parents}, levels...)
+	}
+	return Tree{Levels: levels, Clock: vc}
+}
+
+// Diff returns the buckets in which two trees differ, in order. It only
+// descends into the nodes that differ. Trees of another shape differ in every
+// bucket.
+func (t Tree) Diff(other Tree) []int {
+	if !t.sameShape(other) {
+		all := make([]int, buckets())
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	differ := []int{0}
+	for level := range t.Levels {
+		var next []int
+		for _, i := range differ {
+			if t.Levels[level][i] == other.Levels[level][i] {
+				continue
+			}
+			if level == len(t.Levels)-1 {
+				next = append(next, i)
+				continue
+			}
+			for c := i * MERKLE_FANOUT; c < (i+1)*MERKLE_FANOUT; c++ {
+				next = append(next, c)
+			}
+		}
+		differ = next
+	}
+	return differ
+}
+
+// sameShape returns true if both trees have the shape of this package's.
+func (t Tree) sameShape(other Tree) bool {
+	if len(t.Levels) != MERKLE_DEPTH+1 || len(other.Levels) != len(t.Levels) {
+		return false
+	}
+	for level := range t.Levels {
+		if len(t.Levels[level]) != len(other.Levels[level]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EntriesIn returns every entry whose key is in one of the buckets.
+func (s *Store) EntriesIn(bs []int) []Entry {
+	wanted := make(map[int]bool, len(bs))
+	for _, b := range bs {
+		wanted[b] = true
+	}
+
+	var entries []Entry
+	s.For(func(key string, e Entry) IterAction {
+		if wanted[bucketOf(key)] {
+			entries = append(entries, e)
+		}
+		return CONTINUE
+	})
+	return entries
+}
+
+// Repair imports an entry that anti-entropy found another replica has, one
+// version at a time. Unlike gossip it does not wait for the writes before it:
+// those may have been lost for good, and the ones that still matter are
+// repaired along with it. So the clock does not claim them until CaughtUp is
+// called once every entry is repaired. Nor is a repair an event here, since no
+// replica counts it. It returns true if any version was new to us.
+func (s *Store) Repair(e Entry) (repaired bool, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, v := range e.versions() {
+		v.Siblings = nil
+		if applied, err := s.applied(v); err != nil {
+			return repaired, err
+		} else if applied {
+			continue
+		}
+		if _, _, err := s.importEntry(v, nil, fromRepair); err != nil {
+			return repaired, err
+		}
+		repaired = true
+	}
+	return repaired, nil
+}
+
+// buckets returns how many buckets keys are hashed into.
+func buckets() int {
+	n := 1
+	for i := 0; i < MERKLE_DEPTH; i++ {
+		n *= MERKLE_FANOUT
+	}
+	return n
+}
+
+// bucketOf returns the bucket of a key.
+func bucketOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(buckets()))
+}
+
+// fingerprint hashes what replicas that converged agree on for an entry: its
+// key and the versions it holds, or the state of a typed value, whose version
+// depends on the order its updates arrived in.
+func fingerprint(e Entry) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(e.Key))
+	versions := append([]Entry(nil), e.versions()...)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version.Greater(versions[j].Version)
+	})
+	for _, v := range versions {
+		if v.CRDT != nil && !v.Deleted {
+			state, _ := json.Marshal(v.CRDT)
+			h.Write(state)
+			continue
+		}
+		var b [16]byte
+		binary.BigEndian.PutUint64(b[:], v.Version.Seq)
+		binary.BigEndian.PutUint32(b[8:], v.Version.IP)
+		binary.BigEndian.PutUint16(b[12:], v.Version.Port)
+		if v.Deleted {
+			b[14] = 1
+		}
+		h.Write(b[:])
+	}
+	return h.Sum64()
+}
+
+// hashOf hashes the hashes of a node's children.
+func hashOf(children []uint64) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	for _, c := range children {
+		binary.BigEndian.PutUint64(b[:], c)
+		h.Write(b[:])
+	}
+	return h.Sum64()
+}
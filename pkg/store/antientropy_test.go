@@ -0,0 +1,164 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAntiEntropy(t *testing.T) {
+	a := New(Alice, []string{Alice, Bob}, NopJournal())
+	b := New(Bob, []string{Alice, Bob}, NopJournal())
+	if diff := a.Tree().Diff(b.Tree()); len(diff) != 0 {
+		t.Errorf("Empty stores differ in buckets %v", diff)
+	}
+
+	// Bob never hears of Alice's writes. The first write to x is lost for
+	// good, but Bob can still repair from what Alice has.
+	a.Write(clock.VectorClock{}, "x", "1")
+	a.Write(clock.VectorClock{}, "x", "2")
+	a.Write(clock.VectorClock{}, "y", "1")
+	bob := uuid.New(Bob).Next()
+	a.ImportEntry(Entry{Key: "y", Value: "b", Version: bob, Clock: clock.VectorClock{Bob: 1},
+		DVV: &clock.DVV{Dot: clock.Dot{Node: Bob, Counter: 1}}})
+	b.Write(clock.VectorClock{}, "z", "1")
+
+	diff := b.Tree().Diff(a.Tree())
+	if diff2 := a.Tree().Diff(b.Tree()); !cmp.Equal(diff, diff2) {
+		t.Errorf("Diff is not symmetric: %v and %v", diff, diff2)
+	}
+	want := map[int]bool{bucketOf("x"): true, bucketOf("y"): true, bucketOf("z"): true}
+	if len(diff) != len(want) {
+		t.Errorf("Trees differ in buckets %v, wanted those of x, y and z", diff)
+	}
+	for _, i := range diff {
+		if !want[i] {
+			t.Errorf("Trees differ in bucket %d, wanted only those of x, y and z", i)
+		}
+	}
+
+	for _, e := range a.EntriesIn(diff) {
+		if _, err := b.Repair(e); err != nil {
+			t.Fatalf("Failed to repair %q: %v", e.Key, err)
+		}
+	}
+	for _, e := range b.EntriesIn(diff) {
+		if _, err := a.Repair(e); err != nil {
+			t.Fatalf("Failed to repair %q: %v", e.Key, err)
+		}
+	}
+
+	if diff := a.Tree().Diff(b.Tree()); len(diff) != 0 {
+		t.Errorf("Stores still differ in buckets %v after repair", diff)
+	}
+	shouldRead(t, b, clock.VectorClock{}, "x", "2")
+	shouldRead(t, a, clock.VectorClock{}, "z", "1")
+	if diff := cmp.Diff(siblingValues(t, b, "y"), []string{"1", "b"}); diff != "" {
+		t.Errorf("Bad siblings after repair (-got,+want): %s", diff)
+	}
+
+	// Repairing again changes nothing.
+	for _, e := range a.EntriesIn(diff) {
+		if repaired, err := b.Repair(e); err != nil || repaired {
+			t.Errorf("Repaired %q again: %v", e.Key, err)
+		}
+	}
+}
+
+func TestRepairThenGossip(t *testing.T) {
+	journal := make(chan Entry, 1)
+	a := New(Alice, []string{Alice, Bob}, journal)
+	b := New(Bob, []string{Alice, Bob}, NopJournal())
+
+	// Alice repairs a write of Bob's instead of importing its gossip, so Bob
+	// never hears that she has it.
+	b.Write(clock.VectorClock{}, "x", "1")
+	for _, e := range b.EntriesIn([]int{bucketOf("x")}) {
+		if _, err := a.Repair(e); err != nil {
+			t.Fatalf("Failed to repair %q: %v", e.Key, err)
+		}
+	}
+	a.Write(a.Clock(), "y", "1")
+	y := <-journal
+
+	// Her next write must not wait on an event Bob never hears of.
+	done := make(chan error)
+	go func() {
+		_, err := b.ImportEntry(y)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Import of a write made after a repair waited for the repair")
+	}
+	shouldRead(t, b, y.Clock, "y", "1")
+}
+
+func TestSyncThenGossip(t *testing.T) {
+	journal := make(chan Entry, 1)
+	a := New(Alice, []string{Alice, Bob}, journal)
+	b := New(Bob, []string{Alice, Bob}, NopJournal())
+
+	// Bob syncs Alice's write before its gossip arrives.
+	a.Write(clock.VectorClock{}, "x", "1")
+	x := <-journal
+	if _, err := b.Repair(x); err != nil {
+		t.Fatalf("Failed to repair %q: %v", x.Key, err)
+	}
+	imported, err := b.ImportBatch(Alice, []Import{{Entry: x}})
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if imported != 0 {
+		t.Errorf("Counted %d imports of a write Bob already had, wanted 0", imported)
+	}
+
+	// Alice counts only what Bob recorded, so they agree on his events.
+	a.BumpClockForNodes(map[string]uint64{Bob: uint64(imported)})
+	if diff := cmp.Diff(b.Clock(), clock.VectorClock{Alice: 1}); diff != "" {
+		t.Errorf("Bad clock on Bob (-got,+want): %s", diff)
+	}
+	if diff := cmp.Diff(a.Clock(), clock.VectorClock{Alice: 1}); diff != "" {
+		t.Errorf("Bad clock on Alice (-got,+want): %s", diff)
+	}
+}
+
+func TestRepairKeepsClock(t *testing.T) {
+	journal := make(chan Entry, 2)
+	a := New(Alice, []string{Alice, Bob}, journal)
+	b := New(Bob, []string{Alice, Bob}, NopJournal())
+
+	// Bob repairs Alice's second write but not the first it came after.
+	a.Write(clock.VectorClock{}, "x", "1")
+	<-journal
+	a.Write(a.Clock(), "y", "1")
+	y := <-journal
+	if _, err := b.Repair(y); err != nil {
+		t.Fatalf("Failed to repair %q: %v", y.Key, err)
+	}
+	if diff := cmp.Diff(b.Clock(), clock.VectorClock{}); diff != "" {
+		t.Errorf("Bad clock after a repair (-got,+want): %s", diff)
+	}
+
+	// Once the rest is repaired too, he has everything Alice had.
+	for _, e := range a.AllEntries() {
+		if _, err := b.Repair(e); err != nil {
+			t.Fatalf("Failed to repair %q: %v", e.Key, err)
+		}
+	}
+	if err := b.CaughtUp(a.Clock()); err != nil {
+		t.Fatalf("Failed to catch up: %v", err)
+	}
+	if diff := cmp.Diff(b.Clock(), clock.VectorClock{Alice: 2}); diff != "" {
+		t.Errorf("Bad clock after catching up (-got,+want): %s", diff)
+	}
+	shouldRead(t, b, b.Clock(), "x", "1")
+}
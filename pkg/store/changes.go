@@ -0,0 +1,359 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+const (
+	changesPrefix = "changes-"
+	changesSuffix = ".log"
+
+	// The change log is split into segments of CHANGE_SEGMENT_SIZE changes
+	// and compacted a whole segment at a time.
+	CHANGE_SEGMENT_SIZE = 1024
+)
+
+var (
+	ErrCompacted = errors.New("Changes after the cursor were compacted")
+)
+
+// Change is an entry committed to the store, numbered in the order this node
+// committed it. Sequence numbers are local to a node; replicas of a shard
+// commit the same entries in different orders.
+type Change struct {
+	Seq uint64 `json:"seq"`
+	Entry
+	At time.Time `json:"at"`
+}
+
+// changeHeader is the first record of a change log segment.
+type changeHeader struct {
+	// First is the sequence number of the first change in the segment, and
+	// Floor is at least as new as the clock of every change before it.
+	First uint64            `json:"first"`
+	Floor clock.VectorClock `json:"floor"`
+}
+
+type changeSegment struct {
+	changeHeader
+	changes []Change
+	f       *os.File
+}
+
+// changelog is every entry the store committed recently, whether written
+// here or imported from a replica, kept so that readers can resume from
+// where they left off. It is kept in memory and, if the store is persistent,
+// in its own segments next to the write-ahead log. Writes to it are not
+// synced; anything lost in a crash is recovered from the write-ahead log.
+type changelog struct {
+	dir    string
+	retain int
+	maxAge time.Duration
+	segs   []*changeSegment
+	last   uint64
+	high   clock.VectorClock // the newest of every change's clock
+}
+
+// newChangelog returns an empty change log that is only kept in memory.
+func newChangelog(opts Options) *changelog {
+	return &changelog{
+		retain: opts.ChangeRetention,
+		maxAge: opts.ChangeMaxAge,
+		segs:   []*changeSegment{{changeHeader: changeHeader{First: 1, Floor: clock.VectorClock{}}}},
+		high:   clock.VectorClock{},
+	}
+}
+
+// openChangelog reads the change log in opts.Dir. A torn record at the tail
+// of the last segment is truncated away.
+func openChangelog(opts Options) (*changelog, error) {
+	c := newChangelog(opts)
+	if opts.Dir == "" {
+		return c, nil
+	}
+	c.dir = opts.Dir
+	c.segs = nil
+
+	firsts, err := listSegments(c.dir, changesPrefix, changesSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var good int64
+	for i, first := range firsts {
+		seg, off, err := readChangeSegment(segmentPath(c.dir, changesPrefix, first, changesSuffix), i == len(firsts)-1)
+		if err != nil {
+			return nil, err
+		}
+		if off == 0 {
+			// The segment was cut short before its header was written.
+			seg.First, seg.Floor = uint64(first), c.high.Copy()
+		}
+		c.segs = append(c.segs, seg)
+		c.last = seg.First - 1
+		if n := len(seg.changes); n > 0 {
+			c.last = seg.changes[n-1].Seq
+		}
+		for _, ch := range seg.changes {
+			c.high.Max(ch.Clock.Copy())
+		}
+		good = off
+	}
+	if len(c.segs) == 0 {
+		return c, c.rotate(time.Now())
+	}
+	c.high.Max(c.segs[0].Floor.Copy())
+
+	// Continue appending to the last segment after its last intact record.
+	seg := c.segs[len(c.segs)-1]
+	f, err := os.OpenFile(segmentPath(c.dir, changesPrefix, int64(seg.First), changesSuffix), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if good == 0 {
+		if _, err := writeRecord(f, &seg.changeHeader); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	seg.f = f
+	log.Printf("Recovered change log up to %d\n", c.last)
+	return c, nil
+}
+
+// readChangeSegment reads a segment and returns the offset just past its last
+// intact record. Only the tail segment may end in a bad record, or even lack
+// its header, in which case the offset is zero.
+func readChangeSegment(path string, tail bool) (*changeSegment, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	seg := &changeSegment{}
+	n, err := readRecord(f, &seg.changeHeader)
+	if err != nil {
+		if !tail {
+			return nil, 0, err
+		}
+		log.Printf("Change log segment %s has no header (%v), truncating\n", path, err)
+		return seg, 0, nil
+	}
+	offset := int64(n)
+	for {
+		var ch Change
+		n, err := readRecord(f, &ch)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if !tail {
+				return nil, 0, err
+			}
+			log.Printf("Change log has a bad record at offset %d (%v), truncating\n", offset, err)
+			break
+		}
+		seg.changes = append(seg.changes, ch)
+		offset += int64(n)
+	}
+	return seg, offset, nil
+}
+
+// add records a committed entry as the change numbered seq. Changes that are
+// already recorded, as happens when the write-ahead log is replayed, are
+// ignored.
+func (c *changelog) add(seq uint64, e Entry, now time.Time) error {
+	if seq <= c.last {
+		return nil
+	}
+	if len(c.segs[len(c.segs)-1].changes) >= CHANGE_SEGMENT_SIZE {
+		if err := c.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	seg := c.segs[len(c.segs)-1]
+	ch := Change{Seq: seq, Entry: e, At: now}
+	if seg.f != nil {
+		if _, err := writeRecord(seg.f, &ch); err != nil {
+			return err
+		}
+	}
+	seg.changes = append(seg.changes, ch)
+	c.last = seq
+	c.high.Max(e.Clock.Copy())
+	return nil
+}
+
+// rotate starts a new segment and compacts the log.
+func (c *changelog) rotate(now time.Time) error {
+	seg := &changeSegment{changeHeader: changeHeader{First: c.last + 1, Floor: c.high.Copy()}}
+	if c.dir != "" {
+		if err := c.sync(); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(segmentPath(c.dir, changesPrefix, int64(seg.First), changesSuffix), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := writeRecord(f, &seg.changeHeader); err != nil {
+			f.Close()
+			return err
+		}
+		if n := len(c.segs); n > 0 && c.segs[n-1].f != nil {
+			if err := c.segs[n-1].f.Close(); err != nil {
+				log.Println("Failed to close sealed change log segment:", err)
+			}
+			c.segs[n-1].f = nil
+		}
+		seg.f = f
+	}
+	c.segs = append(c.segs, seg)
+	return c.compact(now)
+}
+
+// compact drops the oldest segments while the rest hold at least the number
+// of changes to retain, or while every change in them is too old. The
+// current segment is never dropped.
+func (c *changelog) compact(now time.Time) error {
+	for len(c.segs) > 1 {
+		oldest, next := c.segs[0], c.segs[1]
+		enough := c.retain > 0 && c.last-next.First+1 >= uint64(c.retain)
+		stale := c.maxAge > 0 && (len(oldest.changes) == 0 ||
+			now.Sub(oldest.changes[len(oldest.changes)-1].At) > c.maxAge)
+		if !enough && !stale {
+			return nil
+		}
+		if c.dir != "" {
+			if err := os.Remove(segmentPath(c.dir, changesPrefix, int64(oldest.First), changesSuffix)); err != nil {
+				return err
+			}
+		}
+		c.segs = c.segs[1:]
+		log.Printf("Compacted change log before %d\n", next.First)
+	}
+	return nil
+}
+
+// since returns up to limit changes after the sequence number after. Zero
+// starts from the oldest change kept.
+func (c *changelog) since(after uint64, limit int) ([]Change, error) {
+	if after == 0 {
+		after = c.segs[0].First - 1
+	} else if after+1 < c.segs[0].First {
+		return nil, ErrCompacted
+	}
+
+	var changes []Change
+	i := sort.Search(len(c.segs), func(i int) bool { return c.segs[i].First > after }) - 1
+	if i < 0 {
+		i = 0
+	}
+	for ; i < len(c.segs); i++ {
+		seg := c.segs[i].changes
+		j := sort.Search(len(seg), func(j int) bool { return seg[j].Seq > after })
+		for _, ch := range seg[j:] {
+			if limit > 0 && len(changes) >= limit {
+				return changes, nil
+			}
+			changes = append(changes, ch)
+		}
+	}
+	return changes, nil
+}
+
+// sinceClock returns up to limit changes that the clock has not seen, in the
+// order they were committed. Only the clocks of replicas are compared.
+func (c *changelog) sinceClock(vc clock.VectorClock, replicas []string, limit int) ([]Change, error) {
+	seen := vc.Subset(replicas)
+	switch c.segs[0].Floor.Subset(replicas).Compare(seen) {
+	case clock.Less, clock.Equal:
+	default:
+		return nil, ErrCompacted
+	}
+
+	var changes []Change
+	for _, seg := range c.segs {
+		for _, ch := range seg.changes {
+			switch ch.Clock.Subset(replicas).Compare(seen) {
+			case clock.Less, clock.Equal:
+				continue
+			}
+			if limit > 0 && len(changes) >= limit {
+				return changes, nil
+			}
+			changes = append(changes, ch)
+		}
+	}
+	return changes, nil
+}
+
+// sync flushes the current segment.
+func (c *changelog) sync() error {
+	if len(c.segs) == 0 {
+		return nil
+	}
+	if f := c.segs[len(c.segs)-1].f; f != nil {
+		return f.Sync()
+	}
+	return nil
+}
+
+// close flushes and closes the current segment.
+func (c *changelog) close() error {
+	seg := c.segs[len(c.segs)-1]
+	if seg.f == nil {
+		return nil
+	}
+	err := seg.f.Sync()
+	if cerr := seg.f.Close(); err == nil {
+		err = cerr
+	}
+	seg.f = nil
+	return err
+}
+
+// Changes returns up to limit changes this node committed after the
+// sequence number after, and the number of the last one. If after is zero
+// the changes start from the oldest kept. It fails with ErrCompacted if
+// changes after the cursor are no longer kept.
+func (s *Store) Changes(after uint64, limit int) (err error, changes []Change, last uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	changes, err = s.changes.since(after, limit)
+	last = after
+	if len(changes) > 0 {
+		last = changes[len(changes)-1].Seq
+	}
+	return
+}
+
+// ChangesSince is like Changes, but returns the changes that a clock has not
+// seen instead. Unlike sequence numbers, a clock can be used with any
+// replica of the shard.
+func (s *Store) ChangesSince(since clock.VectorClock, limit int) (err error, changes []Change, last uint64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	changes, err = s.changes.sinceClock(since, s.replicas, limit)
+	last = s.changes.last
+	if limit > 0 && len(changes) == limit {
+		last = changes[len(changes)-1].Seq
+	}
+	return
+}
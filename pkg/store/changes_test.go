@@ -0,0 +1,106 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// changeKeys summarizes changes as their sequence numbers and keys.
+func changeKeys(changes []Change) []string {
+	got := []string{}
+	for _, ch := range changes {
+		got = append(got, fmt.Sprintf("%d:%s", ch.Seq, ch.Key))
+	}
+	return got
+}
+
+func TestChanges(t *testing.T) {
+	s := New(Alice, []string{Alice, Bob}, NopJournal())
+	_, _, seen := s.Write(clock.VectorClock{}, "a", "1")
+	s.ImportEntry(Entry{Key: "b", Value: "2", Clock: clock.VectorClock{Bob: 1}})
+	s.Transact(clock.VectorClock{}, []Entry{{Key: "c", Value: "3"}, {Key: "d", Deleted: true}})
+
+	err, changes, last := s.Changes(0, 0)
+	if err != nil {
+		t.Fatalf("Failed to read changes: %v", err)
+	}
+	if diff := cmp.Diff(changeKeys(changes), []string{"1:a", "2:b", "3:c", "4:d"}); diff != "" {
+		t.Errorf("Bad changes (-got,+want): %s", diff)
+	}
+	if last != 4 || !changes[3].Deleted || !cmp.Equal(changes[2].Clock, changes[3].Clock) {
+		t.Errorf("Got last %d and transaction %+v", last, changes[2:])
+	}
+
+	_, changes, last = s.Changes(1, 2)
+	if diff := cmp.Diff(changeKeys(changes), []string{"2:b", "3:c"}); diff != "" {
+		t.Errorf("Bad page of changes (-got,+want): %s", diff)
+	}
+	if last != 3 {
+		t.Errorf("Got last %d, wanted 3", last)
+	}
+
+	_, changes, last = s.ChangesSince(seen, 0)
+	if diff := cmp.Diff(changeKeys(changes), []string{"2:b", "3:c", "4:d"}); diff != "" {
+		t.Errorf("Bad changes since a clock (-got,+want): %s", diff)
+	}
+	if last != 4 {
+		t.Errorf("Got last %d, wanted 4", last)
+	}
+}
+
+func TestChangesCompaction(t *testing.T) {
+	s := New(Alice, []string{Alice}, NopJournal())
+	s.changes = newChangelog(Options{ChangeRetention: 10})
+	_, _, early := s.Write(clock.VectorClock{}, "a", "1")
+	for i := 0; i < 2*CHANGE_SEGMENT_SIZE; i++ {
+		s.Write(clock.VectorClock{}, "a", "1")
+	}
+
+	if err, _, _ := s.Changes(1, 0); !errors.Is(err, ErrCompacted) {
+		t.Errorf("Got %v reading compacted changes, wanted ErrCompacted", err)
+	}
+	if err, _, _ := s.ChangesSince(early, 0); !errors.Is(err, ErrCompacted) {
+		t.Errorf("Got %v reading compacted changes by clock, wanted ErrCompacted", err)
+	}
+	err, changes, _ := s.Changes(0, 0)
+	if err != nil || len(changes) < 10 || changes[len(changes)-1].Seq != 2*CHANGE_SEGMENT_SIZE+1 {
+		t.Errorf("Got %d changes and %v from the oldest kept", len(changes), err)
+	}
+	if err, _, _ := s.ChangesSince(s.Clock(), 0); err != nil {
+		t.Errorf("Failed to read changes since the current clock: %v", err)
+	}
+}
+
+func TestChangesRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := mustOpen(t, dir, Options{})
+	s.Write(clock.VectorClock{}, "a", "1")
+	s.Write(clock.VectorClock{}, "b", "2")
+	s.Close()
+
+	s = mustOpen(t, dir, Options{})
+	s.Write(clock.VectorClock{}, "c", "3")
+	s.Close()
+
+	// A change log lost in a crash is rebuilt from the write-ahead log.
+	segs, _ := filepath.Glob(filepath.Join(dir, changesPrefix+"*"))
+	for _, seg := range segs {
+		os.Remove(seg)
+	}
+
+	s = mustOpen(t, dir, Options{})
+	defer s.Close()
+	_, changes, _ := s.Changes(0, 0)
+	if diff := cmp.Diff(changeKeys(changes), []string{"1:a", "2:b", "3:c"}); diff != "" {
+		t.Errorf("Bad changes after recovery (-got,+want): %s", diff)
+	}
+}
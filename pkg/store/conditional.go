@@ -0,0 +1,40 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+)
+
+var (
+	ErrPreconditionFailed = errors.New("Precondition failed")
+)
+
+// Precondition restricts a write or delete to a particular state of the key.
+// The zero value always holds.
+//
+// A precondition is checked against this replica's copy of the key once the
+// request's causal context is satisfied, and the write commits atomically with
+// the check. It is not a linearizable compare-and-set: two replicas can each
+// accept a write expecting the same version if neither has seen the other's
+// write yet.
+type Precondition struct {
+	// Version, if set, must be the version of the key's current entry.
+	Version *uuid.UUID
+	// IfAbsent requires that the key not exist.
+	IfAbsent bool
+}
+
+// check tests the precondition against the current entry for a key. The store
+// lock must be held.
+func (p Precondition) check(current Entry, exists bool, now time.Time) error {
+	live := exists && !current.Deleted && !current.expired(now)
+	if p.IfAbsent && live {
+		return ErrPreconditionFailed
+	}
+	if p.Version != nil && (!live || !current.Version.Equal(*p.Version)) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
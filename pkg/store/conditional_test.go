@@ -0,0 +1,50 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+func TestPrecondition(t *testing.T) {
+	s := New(Alice, []string{Alice}, NopJournal())
+
+	if err, _, _ := s.WriteWithOptions(clock.VectorClock{}, "x", "1", WriteOptions{
+		Precondition: Precondition{IfAbsent: true},
+	}); err != nil {
+		t.Errorf("Failed to create absent key: %v", err)
+	}
+	if err, _, _ := s.WriteWithOptions(clock.VectorClock{}, "x", "2", WriteOptions{
+		Precondition: Precondition{IfAbsent: true},
+	}); err != ErrPreconditionFailed {
+		t.Errorf("Got %v creating an existing key, wanted %v", err, ErrPreconditionFailed)
+	}
+
+	_, e, _, _ := s.Read(clock.VectorClock{}, "x")
+	stale := e.Version
+	if err, _, _ := s.WriteWithOptions(clock.VectorClock{}, "x", "2", WriteOptions{
+		Precondition: Precondition{Version: &stale},
+	}); err != nil {
+		t.Errorf("Failed to write expected version: %v", err)
+	}
+	if err, _, _ := s.WriteWithOptions(clock.VectorClock{}, "x", "3", WriteOptions{
+		Precondition: Precondition{Version: &stale},
+	}); err != ErrPreconditionFailed {
+		t.Errorf("Got %v writing a stale version, wanted %v", err, ErrPreconditionFailed)
+	}
+	shouldRead(t, s, clock.VectorClock{}, "x", "2")
+
+	_, e, _, _ = s.Read(clock.VectorClock{}, "x")
+	if err, deleted, _ := s.DeleteWithOptions(clock.VectorClock{}, "x", DeleteOptions{
+		Precondition: Precondition{Version: &e.Version},
+	}); err != nil || !deleted {
+		t.Errorf("Failed to delete expected version: %v", err)
+	}
+
+	// A deleted key is absent again.
+	if err, _, _ := s.WriteWithOptions(clock.VectorClock{}, "x", "4", WriteOptions{
+		Precondition: Precondition{IfAbsent: true},
+	}); err != nil {
+		t.Errorf("Failed to recreate deleted key: %v", err)
+	}
+}
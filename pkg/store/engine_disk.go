@@ -0,0 +1,350 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+const (
+	dataPrefix = "data-"
+	dataSuffix = ".log"
+
+	// A data file is sealed and a new one started once it reaches this size.
+	maxDataFileSize = 64 << 20
+
+	// Compaction runs once at least this many bytes are garbage and garbage
+	// outweighs live data.
+	minCompactGarbage = 16 << 20
+)
+
+// diskRecord is a single record in a data file. Either an entry was put or a
+// key was deleted.
+type diskRecord struct {
+	Entry  *Entry `json:"entry,omitempty"`
+	Delete string `json:"delete,omitempty"`
+}
+
+// location is where the newest record for a key lives.
+type location struct {
+	file   int64
+	offset int64
+	size   int
+}
+
+// diskEngine is a log structured StorageEngine in the style of Bitcask. Every
+// put and delete is appended to the active data file, and an in-memory index
+// (the keydir) remembers where the newest record for each key lives. Only
+// keys are kept in memory; values are read back from disk. Space held by
+// overwritten records is reclaimed by compaction.
+type diskEngine struct {
+	dir     string
+	files   map[int64]file
+	active  int64
+	size    int64
+	keydir  map[string]location
+	live    int64
+	garbage int64
+}
+
+// OpenDiskEngine opens (creating if necessary) a disk engine in dir.
+func OpenDiskEngine(dir string) (DurableEngine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &diskEngine{
+		dir:    dir,
+		files:  make(map[int64]file),
+		keydir: make(map[string]location),
+	}
+
+	segs, err := listSegments(dir, dataPrefix, dataSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for i, seg := range segs {
+		if err := d.load(seg, i == len(segs)-1); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+
+	if len(segs) == 0 {
+		if err := d.startFile(0); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Opened disk engine with %d keys\n", len(d.keydir))
+	return d, nil
+}
+
+// load indexes the records in a data file. A torn record at the end of the
+// last file is truncated away; the write-ahead log will replay it.
+func (d *diskEngine) load(seg int64, last bool) error {
+	f, err := os.OpenFile(segmentPath(d.dir, dataPrefix, seg, dataSuffix), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	d.files[seg] = f
+
+	var offset int64
+	for {
+		var rec diskRecord
+		n, err := readRecord(f, &rec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if !last {
+				return fmt.Errorf("data file %d: bad record at offset %d: %w", seg, offset, err)
+			}
+			log.Printf("Data file %d has a bad record at offset %d (%v), truncating\n", seg, offset, err)
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		if rec.Entry != nil {
+			d.index(rec.Entry.Key, location{file: seg, offset: offset, size: n})
+		} else {
+			d.unindex(rec.Delete)
+			d.garbage += int64(n)
+		}
+		offset += int64(n)
+	}
+
+	if last {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		d.active = seg
+		d.size = offset
+	}
+	return nil
+}
+
+// startFile makes a new, empty active data file.
+func (d *diskEngine) startFile(seg int64) error {
+	f, err := os.OpenFile(segmentPath(d.dir, dataPrefix, seg, dataSuffix), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	d.files[seg] = f
+	d.active = seg
+	d.size = 0
+	return nil
+}
+
+// index points a key at a new record, counting the old one as garbage.
+func (d *diskEngine) index(key string, loc location) {
+	d.unindex(key)
+	d.keydir[key] = loc
+	d.live += int64(loc.size)
+}
+
+func (d *diskEngine) unindex(key string) {
+	if old, ok := d.keydir[key]; ok {
+		d.live -= int64(old.size)
+		d.garbage += int64(old.size)
+		delete(d.keydir, key)
+	}
+}
+
+// append writes a record to the active file and returns where it went.
+func (d *diskEngine) append(rec *diskRecord) (location, error) {
+	if d.size >= maxDataFileSize {
+		if err := d.files[d.active].Sync(); err != nil {
+			return location{}, err
+		}
+		if err := d.startFile(d.active + 1); err != nil {
+			return location{}, err
+		}
+	}
+
+	n, err := writeRecord(d.files[d.active], rec)
+	if err != nil {
+		return location{}, err
+	}
+	loc := location{file: d.active, offset: d.size, size: n}
+	d.size += int64(n)
+	return loc, nil
+}
+
+func (d *diskEngine) read(loc location) (Entry, error) {
+	buf := make([]byte, loc.size)
+	if _, err := d.files[loc.file].ReadAt(buf, loc.offset); err != nil {
+		return Entry{}, err
+	}
+	var rec diskRecord
+	if _, err := readRecord(bytes.NewReader(buf), &rec); err != nil {
+		return Entry{}, err
+	}
+	if rec.Entry == nil {
+		return Entry{}, ErrCorruptRecord
+	}
+	return *rec.Entry, nil
+}
+
+func (d *diskEngine) Get(key string) (Entry, bool, error) {
+	loc, ok := d.keydir[key]
+	if !ok {
+		return Entry{}, false, nil
+	}
+	e, err := d.read(loc)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+func (d *diskEngine) Put(e Entry) error {
+	loc, err := d.append(&diskRecord{Entry: &e})
+	if err != nil {
+		return err
+	}
+	d.index(e.Key, loc)
+	return d.maybeCompact()
+}
+
+func (d *diskEngine) Delete(key string) error {
+	if _, ok := d.keydir[key]; !ok {
+		return nil
+	}
+	loc, err := d.append(&diskRecord{Delete: key})
+	if err != nil {
+		return err
+	}
+	d.unindex(key)
+	d.garbage += int64(loc.size)
+	return d.maybeCompact()
+}
+
+func (d *diskEngine) Iterate(body IterBody) error {
+	for key, loc := range d.keydir {
+		e, err := d.read(loc)
+		if err != nil {
+			return err
+		}
+		if body(key, e)&STOP != 0 {
+			break
+		}
+	}
+	return nil
+}
+
+func (d *diskEngine) Count() (int, error) {
+	return len(d.keydir), nil
+}
+
+func (d *diskEngine) Clear() error {
+	next := d.active + 1
+	if err := d.removeFiles(); err != nil {
+		return err
+	}
+	d.keydir = make(map[string]location)
+	d.live, d.garbage = 0, 0
+	return d.startFile(next)
+}
+
+func (d *diskEngine) Sync() error {
+	return d.files[d.active].Sync()
+}
+
+func (d *diskEngine) Close() error {
+	var err error
+	if f, ok := d.files[d.active]; ok {
+		err = f.Sync()
+	}
+	for _, f := range d.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	d.files = make(map[int64]file)
+	return err
+}
+
+// maybeCompact compacts the data files once enough of them is garbage.
+func (d *diskEngine) maybeCompact() error {
+	if d.garbage < minCompactGarbage || d.garbage < d.live {
+		return nil
+	}
+	return d.compact()
+}
+
+// compact copies every live record into fresh data files and removes the old
+// ones. It blocks the store for as long as it takes to copy live data, which
+// is amortized over the writes that produced the garbage. If the copy fails,
+// the new files are removed and the engine carries on with the old ones.
+func (d *diskEngine) compact() error {
+	log.Printf("Compacting disk engine: %d bytes live, %d bytes garbage\n", d.live, d.garbage)
+
+	prev := *d
+	d.files = make(map[int64]file)
+	d.keydir = make(map[string]location)
+	d.live, d.garbage = 0, 0
+	if err := d.copyLive(prev.files, prev.keydir); err != nil {
+		log.Println("Failed to compact disk engine:", err)
+		for seg, f := range d.files {
+			f.Close()
+			os.Remove(segmentPath(d.dir, dataPrefix, seg, dataSuffix))
+		}
+		*d = prev
+		return err
+	}
+
+	for seg, f := range prev.files {
+		f.Close()
+		if err := os.Remove(segmentPath(d.dir, dataPrefix, seg, dataSuffix)); err != nil {
+			return err
+		}
+	}
+	return syncDir(d.dir)
+}
+
+// copyLive copies the records the keydir points to in the old files into new
+// data files, and syncs them.
+func (d *diskEngine) copyLive(old map[int64]file, keydir map[string]location) error {
+	if err := d.startFile(d.active + 1); err != nil {
+		return err
+	}
+	for key, loc := range keydir {
+		buf := make([]byte, loc.size)
+		if _, err := old[loc.file].ReadAt(buf, loc.offset); err != nil {
+			return err
+		}
+		if d.size >= maxDataFileSize {
+			if err := d.startFile(d.active + 1); err != nil {
+				return err
+			}
+		}
+		if _, err := d.files[d.active].Write(buf); err != nil {
+			return err
+		}
+		d.index(key, location{file: d.active, offset: d.size, size: loc.size})
+		d.size += int64(loc.size)
+	}
+
+	// The new files must be durable before the old ones go away.
+	for _, f := range d.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFiles closes and deletes every data file.
+func (d *diskEngine) removeFiles() error {
+	for seg, f := range d.files {
+		f.Close()
+		if err := os.Remove(segmentPath(d.dir, dataPrefix, seg, dataSuffix)); err != nil {
+			return err
+		}
+	}
+	d.files = make(map[int64]file)
+	return nil
+}
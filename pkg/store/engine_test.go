@@ -0,0 +1,214 @@
+package store
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func engineKeys(t *testing.T, e StorageEngine) []string {
+	t.Helper()
+	var keys []string
+	if err := e.Iterate(func(key string, _ Entry) IterAction {
+		keys = append(keys, key)
+		return CONTINUE
+	}); err != nil {
+		t.Fatalf("Failed to iterate: %v", err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestEngines(t *testing.T) {
+	engines := map[string]func(dir string) (StorageEngine, error){
+		"memory": func(string) (StorageEngine, error) {
+			return NewMemoryEngine(), nil
+		},
+		"disk": func(dir string) (StorageEngine, error) {
+			return OpenDiskEngine(dir)
+		},
+	}
+
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			e, err := open(dir)
+			if err != nil {
+				t.Fatalf("Failed to open engine: %v", err)
+			}
+			defer e.Close()
+
+			e.Put(Entry{Key: "x", Value: "1"})
+			e.Put(Entry{Key: "y", Value: "2"})
+			e.Put(Entry{Key: "x", Value: "3", Clock: clock.VectorClock{Alice: 1}})
+			e.Put(Entry{Key: "z", Deleted: true})
+			e.Delete("y")
+			e.Delete("never-existed")
+
+			got, ok, err := e.Get("x")
+			if err != nil || !ok {
+				t.Fatalf("Failed to get x: %v", err)
+			}
+			if diff := cmp.Diff(got, Entry{Key: "x", Value: "3", Clock: clock.VectorClock{Alice: 1}}); diff != "" {
+				t.Errorf("Got bad entry (-got,+want): %s", diff)
+			}
+			if _, ok, _ := e.Get("y"); ok {
+				t.Errorf("Deleted key y is still present")
+			}
+			if count, _ := e.Count(); count != 2 {
+				t.Errorf("Got count %d, wanted 2", count)
+			}
+			if diff := cmp.Diff(engineKeys(t, e), []string{"x", "z"}); diff != "" {
+				t.Errorf("Iterated bad keys (-got,+want): %s", diff)
+			}
+
+			e.Clear()
+			if count, _ := e.Count(); count != 0 {
+				t.Errorf("Got count %d after clear, wanted 0", count)
+			}
+		})
+	}
+}
+
+func TestDiskEngine(t *testing.T) {
+	t.Run("reopens", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		e, err := OpenDiskEngine(dir)
+		if err != nil {
+			t.Fatalf("Failed to open engine: %v", err)
+		}
+		e.Put(Entry{Key: "x", Value: "1"})
+		e.Put(Entry{Key: "y", Value: "2"})
+		e.Delete("x")
+		e.Close()
+
+		e, err = OpenDiskEngine(dir)
+		if err != nil {
+			t.Fatalf("Failed to reopen engine: %v", err)
+		}
+		defer e.Close()
+		if diff := cmp.Diff(engineKeys(t, e), []string{"y"}); diff != "" {
+			t.Errorf("Reopened with bad keys (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("compacts", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		de, err := OpenDiskEngine(dir)
+		if err != nil {
+			t.Fatalf("Failed to open engine: %v", err)
+		}
+		e := de.(*diskEngine)
+		for i := 0; i < 10; i++ {
+			e.Put(Entry{Key: "x", Value: "over and over"})
+		}
+		e.Put(Entry{Key: "y", Value: "2"})
+		if err := e.compact(); err != nil {
+			t.Fatalf("Failed to compact: %v", err)
+		}
+		if e.garbage != 0 {
+			t.Errorf("Still have %d bytes of garbage after compaction", e.garbage)
+		}
+		e.Close()
+
+		segs, _ := listSegments(dir, dataPrefix, dataSuffix)
+		if diff := cmp.Diff(segs, []int64{1}); diff != "" {
+			t.Errorf("Kept bad data files (-got,+want): %s", diff)
+		}
+
+		de, err = OpenDiskEngine(dir)
+		if err != nil {
+			t.Fatalf("Failed to reopen engine: %v", err)
+		}
+		defer de.Close()
+		if got, _, _ := de.Get("x"); got.Value != "over and over" {
+			t.Errorf("Got x=%q after compaction", got.Value)
+		}
+		if diff := cmp.Diff(engineKeys(t, de), []string{"x", "y"}); diff != "" {
+			t.Errorf("Reopened with bad keys (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("keeps its files if compaction fails", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		de, err := OpenDiskEngine(dir)
+		if err != nil {
+			t.Fatalf("Failed to open engine: %v", err)
+		}
+		e := de.(*diskEngine)
+		for _, key := range []string{"x", "y", "z"} {
+			e.Put(Entry{Key: key, Value: "old"})
+			e.Put(Entry{Key: key, Value: key})
+		}
+		live, garbage := e.live, e.garbage
+
+		// Reading the second live record back fails.
+		e.files[0] = &faultyFile{File: e.files[0].(*os.File), reads: 1, writes: -1, syncs: -1}
+		if err := e.compact(); err == nil {
+			t.Fatalf("Compacted despite a failed read")
+		}
+		if e.live != live || e.garbage != garbage {
+			t.Errorf("Got %d bytes live and %d garbage, wanted %d and %d", e.live, e.garbage, live, garbage)
+		}
+		for _, key := range []string{"x", "y", "z"} {
+			if got, ok, err := e.Get(key); err != nil || !ok || got.Value != key {
+				t.Errorf("Got %s=%q (%t, %v) after failed compaction", key, got.Value, ok, err)
+			}
+		}
+		segs, _ := listSegments(dir, dataPrefix, dataSuffix)
+		if diff := cmp.Diff(segs, []int64{0}); diff != "" {
+			t.Errorf("Kept bad data files (-got,+want): %s", diff)
+		}
+
+		// It still works once reads do.
+		e.Put(Entry{Key: "w", Value: "w"})
+		if err := e.compact(); err != nil {
+			t.Fatalf("Failed to compact: %v", err)
+		}
+		e.Close()
+		de, err = OpenDiskEngine(dir)
+		if err != nil {
+			t.Fatalf("Failed to reopen engine: %v", err)
+		}
+		defer de.Close()
+		if diff := cmp.Diff(engineKeys(t, de), []string{"w", "x", "y", "z"}); diff != "" {
+			t.Errorf("Reopened with bad keys (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("backs a store", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{Engine: DiskEngine})
+		s.Write(clock.VectorClock{}, "x", "1")
+		s.Write(clock.VectorClock{}, "y", "2")
+		if err := s.Snapshot(); err != nil {
+			t.Fatalf("Failed to snapshot: %v", err)
+		}
+		s.Delete(clock.VectorClock{}, "y")
+		want := s.Clock()
+		s.Close()
+
+		s = mustOpen(t, dir, Options{Engine: DiskEngine})
+		defer s.Close()
+		shouldRead(t, s, clock.VectorClock{}, "x", "1")
+		if _, count, _ := s.NumKeys(clock.VectorClock{}); count != 1 {
+			t.Errorf("Got %d keys, wanted 1", count)
+		}
+		if diff := cmp.Diff(s.Clock(), want); diff != "" {
+			t.Errorf("Recovered bad clock (-got,+want): %s", diff)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// ExpiryGrace is how long past its expiry an entry written elsewhere is
+	// left for its origin to delete. After that any replica will delete it.
+	ExpiryGrace = 30 * time.Second
+)
+
+// expired returns true if the entry has an expiry that has passed.
+func (e Entry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// TTL returns how long the entry has left to live, or false if it does not
+// expire.
+func (e Entry) TTL(now time.Time) (time.Duration, bool) {
+	if e.ExpiresAt == nil {
+		return 0, false
+	}
+	if ttl := e.ExpiresAt.Sub(now); ttl > 0 {
+		return ttl, true
+	}
+	return 0, true
+}
+
+// numExpired counts the live entries that have expired but not yet been
+// deleted.
+func (s *Store) numExpired(now time.Time) (count int) {
+	for _, at := range s.expiries {
+		if !now.Before(at) {
+			count++
+		}
+	}
+	return
+}
+
+// ExpireEntries deletes entries whose expiry has passed. Expiry is a delete
+// like any other: the tombstone is committed and gossiped to other replicas.
+// An entry is expired by the replica it was written on, or by any replica
+// once ExpiryGrace has passed, so that replicas do not all race to commit the
+// same delete. Until then, expired entries are hidden from reads.
+func (s *Store) ExpireEntries(now time.Time) (expired int, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for key, at := range s.expiries {
+		if now.Before(at) {
+			continue
+		}
+
+		e, ok, err := s.store.Get(key)
+		if err != nil {
+			return expired, err
+		} else if !ok || e.Deleted {
+			continue
+		}
+		if !e.Version.OriginatedOn(s.addr) && now.Before(at.Add(ExpiryGrace)) {
+			continue
+		}
+
+		s.version = s.version.Next()
+		if _, err = s.commitWrite(Entry{Key: key, Deleted: true, Version: s.version}, fromLocal); err != nil {
+			return expired, err
+		}
+		log.Printf("Expired %q at %v\n", key, at)
+		expired++
+	}
+	return expired, nil
+}
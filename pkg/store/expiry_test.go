@@ -0,0 +1,66 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+
+	t.Run("expired entries are missing", func(t *testing.T) {
+		s := New(Alice, []string{Alice}, NopJournal())
+		s.WriteWithOptions(clock.VectorClock{}, "x", "1", WriteOptions{ExpiresAt: now.Add(-time.Second)})
+		s.WriteWithOptions(clock.VectorClock{}, "y", "2", WriteOptions{ExpiresAt: now.Add(time.Hour)})
+
+		if _, _, ok, _ := s.Read(clock.VectorClock{}, "x"); ok {
+			t.Errorf("Read expired key x")
+		}
+		shouldRead(t, s, clock.VectorClock{}, "y", "2")
+		if _, count, _ := s.NumKeys(clock.VectorClock{}); count != 1 {
+			t.Errorf("Counted %d keys, wanted 1", count)
+		}
+
+		// Writing without an expiry makes the key permanent again.
+		s.Write(clock.VectorClock{}, "x", "3")
+		shouldRead(t, s, clock.VectorClock{}, "x", "3")
+		if _, count, _ := s.NumKeys(clock.VectorClock{}); count != 2 {
+			t.Errorf("Counted %d keys, wanted 2", count)
+		}
+	})
+
+	t.Run("expiry commits a tombstone", func(t *testing.T) {
+		journal := make(chan Entry, 10)
+		s := New(Alice, []string{Alice, Bob}, journal)
+		s.WriteWithOptions(clock.VectorClock{}, "x", "1", WriteOptions{ExpiresAt: now.Add(-time.Second)})
+		<-journal
+
+		// Bob's entries are left for Bob to expire at first.
+		s.ImportEntry(Entry{
+			Key:       "y",
+			Value:     "2",
+			Clock:     clock.VectorClock{Bob: 1},
+			ExpiresAt: &now,
+		})
+
+		if n, err := s.ExpireEntries(now); err != nil || n != 1 {
+			t.Errorf("Expired %d entries (err %v), wanted 1", n, err)
+		}
+		if e := <-journal; e.Key != "x" || !e.Deleted {
+			t.Errorf("Journaled %+v, wanted a tombstone for x", e)
+		}
+
+		if n, err := s.ExpireEntries(now.Add(ExpiryGrace)); err != nil || n != 1 {
+			t.Errorf("Expired %d entries after grace (err %v), wanted 1", n, err)
+		}
+		if e := <-journal; e.Key != "y" || !e.Deleted {
+			t.Errorf("Journaled %+v, wanted a tombstone for y", e)
+		}
+
+		if n, _ := s.ExpireEntries(now.Add(ExpiryGrace)); n != 0 {
+			t.Errorf("Expired %d entries twice", n)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+// keyIndex is the set of keys in the engine, kept in sorted order so that
+// ranges of keys can be read without visiting the whole store.
+type keyIndex struct {
+	keys []string
+}
+
+// insert adds a key to the index if it is not already present.
+func (x *keyIndex) insert(key string) {
+	i := sort.SearchStrings(x.keys, key)
+	if i < len(x.keys) && x.keys[i] == key {
+		return
+	}
+	x.keys = append(x.keys, "")
+	copy(x.keys[i+1:], x.keys[i:])
+	x.keys[i] = key
+}
+
+// remove drops a key from the index if it is present.
+func (x *keyIndex) remove(key string) {
+	i := sort.SearchStrings(x.keys, key)
+	if i < len(x.keys) && x.keys[i] == key {
+		x.keys = append(x.keys[:i], x.keys[i+1:]...)
+	}
+}
+
+func (x *keyIndex) reset() {
+	x.keys = nil
+}
+
+// Range selects keys in order. Every bound is optional.
+type Range struct {
+	// Prefix restricts the range to keys that start with it.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Start is the first key in the range and End is the first key after it.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+
+	// After resumes a range just past a key, as returned by a previous scan.
+	After string `json:"after,omitempty"`
+
+	// Limit is the most entries to return. Zero or less means no limit.
+	Limit int `json:"limit,omitempty"`
+}
+
+// first returns the position of the first indexed key that may be in r.
+func (x *keyIndex) first(r Range) int {
+	lower := r.Start
+	if r.Prefix > lower {
+		lower = r.Prefix
+	}
+	if r.After != "" && r.After+"\x00" > lower {
+		// The smallest key greater than After.
+		lower = r.After + "\x00"
+	}
+	return sort.SearchStrings(x.keys, lower)
+}
+
+// contains returns false once key is past the end of r. Keys are visited in
+// order, so every later key is past the end as well.
+func (r Range) contains(key string) bool {
+	if r.End != "" && key >= r.End {
+		return false
+	}
+	return strings.HasPrefix(key, r.Prefix)
+}
+
+// Scan returns the live entries in a range in key order, and whether there
+// are more after them. Like Read, it waits until the store is current with
+// the given clock.
+func (s *Store) Scan(tcausal clock.VectorClock, r Range) (
+	err error,
+	entries []Entry,
+	more bool,
+	currentClock clock.VectorClock) {
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.copyClock(&currentClock)
+
+	if err = s.waitUntilCurrent(tcausal); err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, key := range s.index.keys[s.index.first(r):] {
+		if !r.contains(key) {
+			break
+		}
+		e, ok, gerr := s.store.Get(key)
+		if gerr != nil {
+			return gerr, nil, false, currentClock
+		} else if !ok || e.Deleted || e.expired(now) {
+			continue
+		}
+		if r.Limit > 0 && len(entries) == r.Limit {
+			more = true
+			break
+		}
+		entries = append(entries, e)
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func scanKeys(t *testing.T, s *Store, r Range) ([]string, bool) {
+	t.Helper()
+	err, entries, more, _ := s.Scan(clock.VectorClock{}, r)
+	if err != nil {
+		t.Fatalf("Failed to scan %+v: %v", r, err)
+	}
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	return keys, more
+}
+
+func TestScan(t *testing.T) {
+	s := New(Alice, []string{Alice}, NopJournal())
+	for _, key := range []string{"b", "a", "ab", "abc", "b1", "c", "ba"} {
+		s.Write(clock.VectorClock{}, key, "v")
+	}
+	s.Delete(clock.VectorClock{}, "b1")
+
+	tests := []struct {
+		name string
+		r    Range
+		want []string
+		more bool
+	}{{
+		name: "everything",
+		want: []string{"a", "ab", "abc", "b", "ba", "c"},
+	}, {
+		name: "prefix",
+		r:    Range{Prefix: "a"},
+		want: []string{"a", "ab", "abc"},
+	}, {
+		name: "start and end",
+		r:    Range{Start: "ab", End: "ba"},
+		want: []string{"ab", "abc", "b"},
+	}, {
+		name: "prefix past start",
+		r:    Range{Prefix: "b", Start: "a"},
+		want: []string{"b", "ba"},
+	}, {
+		name: "limit",
+		r:    Range{Limit: 2},
+		want: []string{"a", "ab"},
+		more: true,
+	}, {
+		name: "limit on last key",
+		r:    Range{Prefix: "a", Limit: 3},
+		want: []string{"a", "ab", "abc"},
+	}, {
+		name: "after",
+		r:    Range{After: "ab", Limit: 2},
+		want: []string{"abc", "b"},
+		more: true,
+	}, {
+		name: "after a missing key",
+		r:    Range{After: "bb"},
+		want: []string{"c"},
+	}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, more := scanKeys(t, s, tc.r)
+			if diff := cmp.Diff(got, tc.want); diff != "" {
+				t.Errorf("Bad keys (-got,+want): %s", diff)
+			}
+			if more != tc.more {
+				t.Errorf("Got more=%t, wanted %t", more, tc.more)
+			}
+		})
+	}
+}
+
+func TestIndexFollowsEngine(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := mustOpen(t, dir, Options{Engine: DiskEngine})
+	s.Write(clock.VectorClock{}, "y", "1")
+	s.Write(clock.VectorClock{}, "x", "2")
+	s.Close()
+
+	// The index is rebuilt from the engine and log on restart.
+	s = mustOpen(t, dir, Options{Engine: DiskEngine})
+	defer s.Close()
+	if got, _ := scanKeys(t, s, Range{}); !cmp.Equal(got, []string{"x", "y"}) {
+		t.Errorf("Got keys %v after restart, wanted [x y]", got)
+	}
+
+	// Collected tombstones leave the index.
+	s.Delete(clock.VectorClock{}, "x")
+	s.Acknowledge(Bob, s.Clock())
+	if _, err := s.CollectTombstones(); err != nil {
+		t.Fatalf("Failed to collect tombstones: %v", err)
+	}
+	if diff := cmp.Diff(s.index.keys, []string{"y"}); diff != "" {
+		t.Errorf("Bad index after collection (-got,+want): %s", diff)
+	}
+
+	s.ReplaceEntries([]Entry{{Key: "z", Value: "3"}})
+	if diff := cmp.Diff(s.index.keys, []string{"z"}); diff != "" {
+		t.Errorf("Bad index after replacement (-got,+want): %s", diff)
+	}
+}
@@ -1,5 +1,9 @@
 package store
 
+import (
+	"log"
+)
+
 // IterAction describes an action that should be taken for a given iteration.
 // Iteraction can continue or stop the loop.
 type IterAction int
@@ -18,10 +22,7 @@ func (s *Store) For(body IterBody) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	for key, entry := range s.store {
-		ret := body(key, entry)
-		if ret&STOP != 0 {
-			break
-		}
+	if err := s.store.Iterate(body); err != nil {
+		log.Println("Failed to iterate over store:", err)
 	}
 }
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"log"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+// Prune forgets every node that is not one of members: it drops them from the
+// store's clock and from the clocks of its entries. It is called once a view
+// change completes, when the store already holds every write of nodes that
+// left, so no causal context needs to wait for them any longer.
+func (s *Store) Prune(members []string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Op: opPrune, Keys: members}); err != nil {
+			log.Println("Failed to log pruning of the clock:", err)
+			return err
+		}
+	}
+	return s.prune(members)
+}
+
+// prune is Prune without the locking or logging.
+func (s *Store) prune(members []string) error {
+	keep := make(map[string]bool, len(members))
+	for _, m := range members {
+		keep[m] = true
+	}
+
+	var pruned []Entry
+	err := s.store.Iterate(func(key string, e Entry) IterAction {
+		if p, changed := e.pruned(members, keep); changed {
+			pruned = append(pruned, p)
+		}
+		return CONTINUE
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range pruned {
+		if err := s.put(e); err != nil {
+			return err
+		}
+	}
+
+	before := len(s.vc)
+	s.vc = s.vc.Prune(members)
+	s.horizon = s.horizon.Prune(members)
+	for node, vc := range s.acks {
+		if keep[node] {
+			s.acks[node] = vc.Prune(members)
+		} else {
+			delete(s.acks, node)
+		}
+	}
+	if dropped := before - len(s.vc); dropped > 0 {
+		log.Printf("Pruned %d nodes from the clock and %d entries\n", dropped, len(pruned))
+	}
+	s.vcCond.Broadcast()
+	return nil
+}
+
+// pruned returns the entry without the nodes that are not kept, and whether
+// anything changed. A version written on a node that left loses its dotted
+// version vector, as no context can cover its dot any longer, and is compared
+// by its clock from then on.
+func (e Entry) pruned(members []string, keep map[string]bool) (Entry, bool) {
+	changed := stale(e.Clock, keep)
+	e.Clock = e.Clock.Prune(members)
+	if e.DVV != nil {
+		if !keep[e.DVV.Dot.Node] {
+			e.DVV = nil
+			changed = true
+		} else if stale(e.DVV.Context, keep) {
+			e.DVV = &clock.DVV{Dot: e.DVV.Dot, Context: e.DVV.Context.Prune(members)}
+			changed = true
+		}
+	}
+	if len(e.Siblings) > 0 {
+		siblings := make([]Entry, len(e.Siblings))
+		for i, v := range e.Siblings {
+			var c bool
+			siblings[i], c = v.pruned(members, keep)
+			changed = changed || c
+		}
+		e.Siblings = siblings
+	}
+	return e, changed
+}
+
+// stale returns true if the clock has a node that is not kept.
+func stale(vc clock.VectorClock, keep map[string]bool) bool {
+	for node := range vc {
+		if !keep[node] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// hasNode returns true if the store's clock or any entry's clock has node.
+func hasNode(t *testing.T, s *Store, node string) bool {
+	t.Helper()
+	if _, ok := s.Clock()[node]; ok {
+		return true
+	}
+	for _, e := range s.AllEntries() {
+		for _, v := range append([]Entry{e}, e.Siblings...) {
+			if _, ok := v.Clock[node]; ok {
+				return true
+			}
+			if v.DVV != nil && (v.DVV.Dot.Node == node || v.DVV.Context[node] > 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestPrune(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := mustOpen(t, dir, Options{})
+	s.Write(clock.VectorClock{}, "x", "a")
+	carol := uuid.New(Carol).Next()
+	s.ImportEntry(Entry{Key: "x", Value: "c", Version: carol, Clock: clock.VectorClock{Carol: 1},
+		DVV: &clock.DVV{Dot: clock.Dot{Node: Carol, Counter: 1}}})
+	s.Write(clock.VectorClock{}, "y", "1")
+
+	if !hasNode(t, s, Carol) {
+		t.Fatalf("Carol is not in the clocks before pruning")
+	}
+
+	// Carol leaves the view.
+	if err := s.Prune([]string{Alice, Bob}); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if hasNode(t, s, Carol) {
+		t.Errorf("Carol is still in the clocks after pruning: %v", s.AllEntries())
+	}
+	shouldRead(t, s, clock.VectorClock{}, "y", "1")
+
+	// Carol's version is still replaced by a write that has seen it.
+	s.Close()
+	s = mustOpen(t, dir, Options{})
+	defer s.Close()
+	if hasNode(t, s, Carol) {
+		t.Errorf("Carol is in the clocks after recovery: %v", s.AllEntries())
+	}
+	if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"a", "c"}); diff != "" {
+		t.Errorf("Bad siblings after pruning (-got,+want): %s", diff)
+	}
+	s.Write(s.Clock(), "x", "d")
+	if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"d"}); diff != "" {
+		t.Errorf("Bad siblings after a write that saw them (-got,+want): %s", diff)
+	}
+}
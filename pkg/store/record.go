@@ -0,0 +1,83 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Records are framed on disk as a four byte little endian payload length, a
+// four byte CRC32 (Castagnoli) of the payload, and then the JSON payload.
+const (
+	recordHeaderSize = 8
+	maxRecordSize    = 64 << 20
+)
+
+var (
+	ErrCorruptRecord = errors.New("Corrupt record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// file is the part of an *os.File that records are written to and read back
+// from.
+type file interface {
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// writeRecord frames v as a record and writes it to w in a single call.
+func writeRecord(w io.Writer, v interface{}) (int, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[recordHeaderSize:], payload)
+	return w.Write(buf)
+}
+
+// readRecord reads the next record from r and decodes it into v. It returns the
+// number of bytes consumed. A clean end of input is io.EOF; a record cut short
+// by a crash is io.ErrUnexpectedEOF; a record that fails its checksum is
+// ErrCorruptRecord.
+func readRecord(r io.Reader, v interface{}) (int, error) {
+	var header [recordHeaderSize]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return n, io.EOF
+		}
+		return n, io.ErrUnexpectedEOF
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+
+	if length > maxRecordSize {
+		// A garbage length is most likely a torn header.
+		return recordHeaderSize, ErrCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if n, err := io.ReadFull(r, payload); err != nil {
+		return recordHeaderSize + n, io.ErrUnexpectedEOF
+	}
+	n := recordHeaderSize + int(length)
+
+	if crc32.Checksum(payload, crcTable) != sum {
+		return n, ErrCorruptRecord
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return n, ErrCorruptRecord
+	}
+	return n, nil
+}
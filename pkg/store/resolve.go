@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+// Resolution is how a store settles concurrent writes to a key.
+type Resolution int
+
+const (
+	// ResolveSiblings keeps every concurrent write until a later write that
+	// saw them replaces them.
+	ResolveSiblings Resolution = iota
+	// ResolveLWW keeps the write with the latest timestamp, breaking ties by
+	// version. Every replica picks the same write whatever order they arrive
+	// in.
+	ResolveLWW
+)
+
+// ParseResolution parses "siblings" or "lww".
+func ParseResolution(s string) (Resolution, error) {
+	switch strings.ToLower(s) {
+	case "", "siblings":
+		return ResolveSiblings, nil
+	case "lww":
+		return ResolveLWW, nil
+	}
+	return ResolveSiblings, fmt.Errorf("unknown conflict resolution %q", s)
+}
+
+// ParseResolutionPrefixes parses a comma separated list of prefix=resolution
+// pairs, such as "cache/=lww,carts/=siblings".
+func ParseResolutionPrefixes(s string) (map[string]Resolution, error) {
+	prefixes := make(map[string]Resolution)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("bad conflict resolution for a prefix %q", pair)
+		}
+		r, err := ParseResolution(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		prefixes[pair[:i]] = r
+	}
+	return prefixes, nil
+}
+
+// resolutionOf returns how concurrent writes to key are settled: by the
+// longest prefix of it that has a resolution, or by the store's default.
+func (s *Store) resolutionOf(key string) Resolution {
+	r, longest := s.resolution, -1
+	for prefix, pr := range s.prefixes {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			r, longest = pr, len(prefix)
+		}
+	}
+	return r
+}
+
+// wins returns true if e was written after other for last writer wins. A write
+// always has a later timestamp than every write its node had seen.
+func (e Entry) wins(other Entry) bool {
+	switch e.Timestamp.Compare(other.Timestamp) {
+	case clock.Greater:
+		return true
+	case clock.Less:
+		return false
+	}
+	return e.Version.Greater(other.Version)
+}
+
+// lastWriter settles a write gossiped from another replica with what we have
+// for its key by keeping only the latest. It returns false if what we have
+// is later.
+func (s *Store) lastWriter(e Entry) (Entry, bool, error) {
+	written := e.written()
+	existing, ok, err := s.store.Get(e.Key)
+	if err != nil || !ok {
+		return written, err == nil, err
+	}
+	for _, v := range existing.versions() {
+		if !written.wins(v) {
+			log.Printf("Import of %q lost to a later write\n", e.Key)
+			return existing, false, nil
+		}
+	}
+	return written, true, nil
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLastWriterWins(t *testing.T) {
+	t.Run("replicas converge", func(t *testing.T) {
+		aj, bj := make(chan Entry, 10), make(chan Entry, 10)
+		a := New(Alice, []string{Alice, Bob}, aj)
+		b := New(Bob, []string{Alice, Bob}, bj)
+		a.resolution, b.resolution = ResolveLWW, ResolveLWW
+
+		a.Write(clock.VectorClock{}, "x", "a")
+		b.Write(clock.VectorClock{}, "x", "b")
+
+		// Each imports the other's write after its own.
+		a.ImportEntry(<-bj)
+		b.ImportEntry(<-aj)
+
+		shouldRead(t, a, clock.VectorClock{}, "x", "b")
+		shouldRead(t, b, clock.VectorClock{}, "x", "b")
+		if diff := cmp.Diff(siblingValues(t, a, "x"), []string{"b"}); diff != "" {
+			t.Errorf("Bad versions (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("ties are broken by version", func(t *testing.T) {
+		alice, bob := uuid.New(Alice).Next(), uuid.New(Bob).Next()
+		first := Entry{Key: "x", Value: "a", Version: alice, Timestamp: clock.Timestamp{Wall: 1}, Clock: clock.VectorClock{Alice: 1}}
+		second := Entry{Key: "x", Value: "b", Version: bob, Timestamp: clock.Timestamp{Wall: 1}, Clock: clock.VectorClock{Bob: 1}}
+		want := "b"
+		if alice.Greater(bob) {
+			want = "a"
+		}
+
+		for _, order := range [][]Entry{{first, second}, {second, first}} {
+			s := New(Carol, []string{Alice, Bob, Carol}, NopJournal())
+			s.resolution = ResolveLWW
+			for _, e := range order {
+				s.ImportEntry(e)
+			}
+			shouldRead(t, s, clock.VectorClock{}, "x", want)
+		}
+	})
+
+	t.Run("prefixes choose the resolution", func(t *testing.T) {
+		prefixes, err := ParseResolutionPrefixes("cache/=lww,cache/carts/=siblings")
+		if err != nil {
+			t.Fatalf("Failed to parse prefixes: %v", err)
+		}
+		s := New(Alice, []string{Alice}, NopJournal())
+		s.prefixes = prefixes
+		for key, want := range map[string]Resolution{
+			"cache/x":       ResolveLWW,
+			"cache/carts/x": ResolveSiblings,
+			"x":             ResolveSiblings,
+		} {
+			if got := s.resolutionOf(key); got != want {
+				t.Errorf("Got resolution %d for %q, wanted %d", got, key, want)
+			}
+		}
+		if _, err := ParseResolutionPrefixes("cache/=newest"); err == nil {
+			t.Errorf("Parsed an unknown resolution")
+		}
+	})
+}
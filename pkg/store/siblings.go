@@ -0,0 +1,197 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+)
+
+// versions returns the concurrent versions of a key an entry holds: its
+// siblings, or the entry itself.
+func (e Entry) versions() []Entry {
+	if len(e.Siblings) > 0 {
+		return e.Siblings
+	}
+	e.Siblings = nil
+	return []Entry{e}
+}
+
+// hasVersion returns true if the entry holds the version v.
+func (e Entry) hasVersion(v uuid.UUID) bool {
+	for _, s := range e.versions() {
+		if s.Version.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces returns true if the entry is a later write to the key of old that a
+// replica may import without ever importing old: neither is a transaction,
+// and the entry does not keep old as a sibling.
+func (e Entry) Replaces(old Entry) bool {
+	return e.Txn == nil && old.Txn == nil && e.Key == old.Key && !e.hasVersion(old.Version)
+}
+
+// withSiblings settles a new local write with the siblings it keeps.
+func (e Entry) withSiblings() Entry {
+	if len(e.Siblings) == 0 {
+		return e
+	}
+	kept := e.Siblings
+	e.Siblings = nil
+	return settle(append([]Entry{e}, kept...))
+}
+
+// written returns the version of an entry made by the write that produced it,
+// which is the only one with the entry's clock.
+func (e Entry) written() Entry {
+	for _, v := range e.versions() {
+		if v.Clock.Compare(e.Clock) == clock.Equal {
+			return v
+		}
+	}
+	return e
+}
+
+// Context returns every event a version of a key includes: its dotted
+// version vector folded into a clock, or for versions written before they had
+// one, the clock of the node that wrote it.
+func (e Entry) Context() clock.VectorClock {
+	if e.DVV == nil {
+		return e.Clock
+	}
+	return e.DVV.Clock()
+}
+
+// seenBy returns true if a write with the causal context vc had seen the
+// version, so replaces it.
+func (e Entry) seenBy(vc clock.VectorClock, replicas []string) bool {
+	if e.DVV != nil {
+		return vc.Covers(e.DVV.Dot)
+	}
+	switch e.Clock.Subset(replicas).Compare(vc.Subset(replicas)) {
+	case clock.Less, clock.Equal:
+		return true
+	}
+	return false
+}
+
+// supersedes returns true if a version of the entry is the version v or was
+// written after it.
+func (e Entry) supersedes(v Entry, replicas []string) bool {
+	for _, mine := range e.versions() {
+		if v.seenBy(mine.Context(), replicas) {
+			return true
+		}
+	}
+	return false
+}
+
+// dotted stamps a local write with the dot of its event, and the context of
+// the versions of its key that it replaces, which are those it does not keep
+// as siblings.
+func (s *Store) dotted(e Entry, dot clock.Dot) (Entry, error) {
+	replaced := clock.VectorClock{}
+	existing, ok, err := s.store.Get(e.Key)
+	if err != nil {
+		return e, err
+	} else if ok {
+		for _, v := range existing.versions() {
+			if !e.hasVersion(v.Version) {
+				replaced.Max(v.Context().Copy())
+			}
+		}
+	}
+	e.DVV = &clock.DVV{Dot: dot, Context: replaced}
+	return e, nil
+}
+
+// settle combines concurrent versions of a key into one entry. The entry
+// reads as the live version with the latest Version, or the latest tombstone
+// if every version is deleted, so that every replica holding the same
+// siblings reads the same value. Its clock is the newest of theirs.
+func settle(versions []Entry) Entry {
+	if len(versions) == 1 {
+		e := versions[0]
+		e.Siblings = nil
+		return e
+	}
+
+	sorted := make([]Entry, len(versions))
+	for i, v := range versions {
+		v.Siblings = nil
+		sorted[i] = v
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Deleted != sorted[j].Deleted {
+			return !sorted[i].Deleted
+		}
+		return sorted[i].Version.Greater(sorted[j].Version)
+	})
+
+	e := sorted[0]
+	e.Clock = clock.VectorClock{}
+	for _, v := range sorted {
+		e.Clock.Max(v.Clock.Copy())
+	}
+	e.Siblings = sorted
+	return e
+}
+
+// survivors returns the versions of a key that a write made with the causal
+// context seen does not replace, because the writer had not seen them. A key
+// without siblings is always replaced, as it was before the write happened on
+// this replica; only once concurrent writes are found does the writer have to
+// show that it saw them.
+func (s *Store) survivors(key string, seen clock.VectorClock) ([]Entry, error) {
+	if s.resolutionOf(key) == ResolveLWW {
+		return nil, nil
+	}
+	existing, ok, err := s.store.Get(key)
+	if err != nil || !ok || len(existing.Siblings) == 0 {
+		return nil, err
+	}
+	var kept []Entry
+	for _, v := range existing.Siblings {
+		if !v.seenBy(seen, s.replicas) {
+			kept = append(kept, v)
+		}
+	}
+	return kept, nil
+}
+
+// reconcile merges an entry gossiped from another replica with what we have
+// for its key. The writer had seen every version its context covers: those it
+// did not keep as siblings were replaced. Versions the writer had not seen are
+// concurrent with it and are kept alongside it.
+func (s *Store) reconcile(e Entry) (Entry, error) {
+	existing, ok, err := s.store.Get(e.Key)
+	if err != nil || !ok {
+		return e, err
+	}
+
+	seen := e.written().Context()
+	written := e.Clock.Subset(s.replicas)
+	var merged []Entry
+	for _, v := range existing.versions() {
+		if e.hasVersion(v.Version) {
+			merged = append(merged, v)
+			continue
+		}
+		if v.seenBy(seen, s.replicas) {
+			// Replaced by the write.
+			continue
+		}
+		merged = append(merged, v)
+	}
+	for _, v := range e.versions() {
+		// The write itself is new to us. Its other siblings we must already
+		// have replaced if we no longer hold them.
+		if v.Clock.Subset(s.replicas).Compare(written) == clock.Equal && !existing.hasVersion(v.Version) {
+			merged = append(merged, v)
+		}
+	}
+	return settle(merged), nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// siblingValues returns the values of every version of a key, in order.
+func siblingValues(t *testing.T, s *Store, key string) []string {
+	t.Helper()
+	err, e, _, _ := s.Read(clock.VectorClock{}, key)
+	if err != nil {
+		t.Fatalf("Failed to read %q: %v", key, err)
+	}
+	values := []string{}
+	for _, v := range e.versions() {
+		if v.Deleted {
+			values = append(values, "deleted")
+		} else {
+			values = append(values, v.Value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestSiblings(t *testing.T) {
+	bob := uuid.New(Bob)
+
+	t.Run("concurrent writes are kept", func(t *testing.T) {
+		s := New(Alice, []string{Alice, Bob}, NopJournal())
+		s.Write(clock.VectorClock{}, "x", "a")
+		bob = bob.Next()
+		s.ImportEntry(Entry{Key: "x", Value: "b", Version: bob, Clock: clock.VectorClock{Bob: 1}})
+
+		if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"a", "b"}); diff != "" {
+			t.Errorf("Bad siblings (-got,+want): %s", diff)
+		}
+
+		// A write that has not seen the siblings joins them.
+		s.Write(clock.VectorClock{}, "x", "c")
+		if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"a", "b", "c"}); diff != "" {
+			t.Errorf("Bad siblings after a blind write (-got,+want): %s", diff)
+		}
+
+		// A write that has seen them replaces them.
+		s.Write(s.Clock(), "x", "d")
+		if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"d"}); diff != "" {
+			t.Errorf("Bad siblings after a write that saw them (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("causal writes replace", func(t *testing.T) {
+		s := New(Alice, []string{Alice, Bob}, NopJournal())
+		s.Write(clock.VectorClock{}, "x", "a")
+		bob = bob.Next()
+		s.ImportEntry(Entry{Key: "x", Value: "b", Version: bob, Clock: clock.VectorClock{Alice: 1, Bob: 1}})
+
+		if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"b"}); diff != "" {
+			t.Errorf("Bad siblings (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("concurrent delete keeps the write", func(t *testing.T) {
+		s := New(Alice, []string{Alice, Bob}, NopJournal())
+		s.Write(clock.VectorClock{}, "x", "a")
+		bob = bob.Next()
+		s.ImportEntry(Entry{Key: "x", Value: "b", Version: bob, Clock: clock.VectorClock{Bob: 1}})
+		s.Delete(clock.VectorClock{Alice: 1}, "x")
+
+		if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"b", "deleted"}); diff != "" {
+			t.Errorf("Bad siblings (-got,+want): %s", diff)
+		}
+		shouldRead(t, s, clock.VectorClock{}, "x", "b")
+	})
+
+	t.Run("sibling contexts replace only the sibling", func(t *testing.T) {
+		s := New(Alice, []string{Alice, Bob}, NopJournal())
+		s.Write(clock.VectorClock{}, "y", "1")
+		s.Write(clock.VectorClock{}, "x", "a")
+
+		// Bob had seen the write to y, but not that to x.
+		bob = bob.Next()
+		b := Entry{Key: "x", Value: "b", Version: bob, Clock: clock.VectorClock{Alice: 1, Bob: 1},
+			DVV: &clock.DVV{Dot: clock.Dot{Node: Bob, Counter: 1}}}
+		s.ImportEntry(b)
+
+		// Bob's version is replaced by a write that saw only it, though not
+		// everything Bob had seen.
+		if got := b.Context(); got.Compare(clock.VectorClock{Bob: 1}) != clock.Equal {
+			t.Errorf("Got context %v for Bob's version, wanted only its dot", got)
+		}
+		s.Write(b.Context(), "x", "c")
+		if diff := cmp.Diff(siblingValues(t, s, "x"), []string{"a", "c"}); diff != "" {
+			t.Errorf("Bad siblings (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("siblings gossip", func(t *testing.T) {
+		journal := make(chan Entry, 10)
+		a := New(Alice, []string{Alice, Bob}, journal)
+		b := New(Bob, []string{Alice, Bob}, NopJournal())
+		a.Write(clock.VectorClock{}, "x", "a")
+		b.Write(clock.VectorClock{}, "x", "b")
+
+		// Each learns of the other's write, then Alice writes without
+		// having seen Bob's.
+		b.ImportEntry(<-journal)
+		err, e, _, _ := b.Read(clock.VectorClock{}, "x")
+		if err != nil {
+			t.Fatalf("Failed to read x: %v", err)
+		}
+		a.ImportEntry(Entry{Key: "x", Value: "b", Version: e.Siblings[0].Version, Clock: clock.VectorClock{Bob: 1}})
+		a.Write(clock.VectorClock{Alice: 1}, "x", "c")
+		b.ImportEntry(<-journal)
+
+		if diff := cmp.Diff(siblingValues(t, b, "x"), []string{"b", "c"}); diff != "" {
+			t.Errorf("Bad siblings on Bob (-got,+want): %s", diff)
+		}
+		if diff := cmp.Diff(siblingValues(t, a, "x"), []string{"b", "c"}); diff != "" {
+			t.Errorf("Bad siblings on Alice (-got,+want): %s", diff)
+		}
+	})
+}
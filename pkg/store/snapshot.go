@@ -0,0 +1,260 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+)
+
+const (
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".snap"
+
+	// The number of snapshots kept on disk. Log segments are only removed once
+	// every kept snapshot covers them, so that an older snapshot can stand in
+	// for a damaged newer one.
+	snapshotsKept = 2
+)
+
+var (
+	ErrNotPersistent = errors.New("Store is not persistent")
+)
+
+// snapshotHeader is the first record of a snapshot file. It is followed by
+// Count entry records.
+type snapshotHeader struct {
+	// Segment is the first log segment that is not covered by the snapshot.
+	Segment int64             `json:"segment"`
+	Clock   clock.VectorClock `json:"clock"`
+	Version uuid.UUID         `json:"version"`
+	Count   int               `json:"count"`
+	Horizon clock.VectorClock `json:"horizon,omitempty"`
+
+	// Transactions across shards that are still in flight.
+	Prepared  []PreparedTxn `json:"prepared,omitempty"`
+	Decisions []Decision    `json:"decisions,omitempty"`
+	Committed []string      `json:"committed,omitempty"`
+
+	// InEngine is set if the entries were left in a durable engine rather than
+	// written to the snapshot.
+	InEngine bool `json:"in-engine,omitempty"`
+}
+
+// Snapshot writes a point-in-time image of the store to disk and compacts the
+// write-ahead log. The store is only locked long enough to copy its entries;
+// writers may proceed while the image is written out.
+func (s *Store) Snapshot() error {
+	s.snapMtx.Lock()
+	defer s.snapMtx.Unlock()
+
+	s.m.Lock()
+	w := s.wal
+	if w == nil {
+		s.m.Unlock()
+		return ErrNotPersistent
+	}
+	if w.isEmpty() {
+		// Nothing happened since the last snapshot.
+		s.m.Unlock()
+		return nil
+	}
+	seg, err := w.rotate()
+	if err != nil {
+		s.m.Unlock()
+		return err
+	}
+	// The change log is recovered from the write-ahead log, so it must be on
+	// disk before the log it was written alongside can be removed.
+	if err := s.changes.sync(); err != nil {
+		s.m.Unlock()
+		return err
+	}
+	header := snapshotHeader{
+		Segment: seg,
+		Clock:   s.vc.Copy(),
+		Version: s.version,
+		Horizon: s.horizon.Copy(),
+
+		Prepared:  s.allPrepared(),
+		Decisions: s.allDecisions(),
+		Committed: append([]string(nil), s.committed...),
+	}
+	var entries []Entry
+	if durable, ok := s.store.(DurableEngine); ok {
+		// The engine already holds the entries. It only has to be at least as
+		// new as the point we rotated the log at.
+		if err := durable.Sync(); err != nil {
+			s.m.Unlock()
+			return err
+		}
+		header.InEngine = true
+	} else {
+		entries = s.allEntries()
+	}
+	s.m.Unlock()
+
+	header.Count = len(entries)
+	if err := writeSnapshot(w.dir, header, entries); err != nil {
+		return err
+	}
+	log.Printf("Wrote snapshot of %d entries at t=%v\n", len(entries), header.Clock)
+
+	return pruneSnapshots(w)
+}
+
+// writeSnapshot writes the snapshot to a temporary file and renames it into
+// place once it is safely on disk.
+func writeSnapshot(dir string, header snapshotHeader, entries []Entry) error {
+	path := segmentPath(dir, snapshotPrefix, header.Segment, snapshotSuffix)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	buf := bufio.NewWriter(f)
+	if _, err := writeRecord(buf, &header); err != nil {
+		f.Close()
+		return err
+	}
+	for i := range entries {
+		if _, err := writeRecord(buf, &entries[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// pruneSnapshots removes all but the newest snapshots and every log segment
+// they all cover.
+func pruneSnapshots(w *wal) error {
+	snaps, err := listSegments(w.dir, snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		return err
+	}
+	if len(snaps) < snapshotsKept {
+		return nil
+	}
+
+	oldest := snaps[len(snaps)-snapshotsKept]
+	for _, seg := range snaps[:len(snaps)-snapshotsKept] {
+		if err := os.Remove(segmentPath(w.dir, snapshotPrefix, seg, snapshotSuffix)); err != nil {
+			return err
+		}
+	}
+	return w.removeBefore(oldest)
+}
+
+// loadSnapshot reads the newest intact snapshot in dir. It returns false if
+// there is none.
+func loadSnapshot(dir string) (snapshotHeader, []Entry, bool) {
+	snaps, err := listSegments(dir, snapshotPrefix, snapshotSuffix)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to list snapshots:", err)
+		}
+		return snapshotHeader{}, nil, false
+	}
+
+	for i := len(snaps) - 1; i >= 0; i-- {
+		path := segmentPath(dir, snapshotPrefix, snaps[i], snapshotSuffix)
+		header, entries, err := readSnapshot(path)
+		if err != nil {
+			log.Printf("Skipping bad snapshot %s: %v\n", path, err)
+			continue
+		}
+		log.Printf("Loaded snapshot of %d entries from %s\n", len(entries), path)
+		return header, entries, true
+	}
+	return snapshotHeader{}, nil, false
+}
+
+func readSnapshot(path string) (snapshotHeader, []Entry, error) {
+	var header snapshotHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if _, err := readRecord(r, &header); err != nil {
+		return header, nil, err
+	}
+	if header.Segment == 0 {
+		return header, nil, fmt.Errorf("header does not name a log segment")
+	}
+
+	entries := make([]Entry, header.Count)
+	for i := range entries {
+		if _, err := readRecord(r, &entries[i]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return header, nil, err
+		}
+	}
+	return header, entries, nil
+}
+
+// restore loads a snapshot into a freshly opened store.
+func (s *Store) restore(header snapshotHeader, entries []Entry) error {
+	if header.InEngine {
+		if _, ok := s.store.(DurableEngine); !ok {
+			return fmt.Errorf("snapshot at segment %d requires a durable storage engine", header.Segment)
+		}
+		// Replaying the log on top of the engine brings it back in line.
+	} else if err := s.replaceEntries(entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		s.hlc.Observe(e.Timestamp)
+	}
+	s.vc.Max(header.Clock)
+	s.horizon.Max(header.Horizon)
+	s.version = header.Version
+	now := time.Now()
+	for _, txn := range header.Prepared {
+		s.prepare(txn, now)
+	}
+	for _, d := range header.Decisions {
+		s.decisions[d.ID] = d.Participants
+	}
+	s.committed = header.Committed
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Run("recovers from snapshot and log", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{})
+		s.Write(clock.VectorClock{}, "x", "1")
+		s.Write(clock.VectorClock{}, "y", "2")
+		if err := s.Snapshot(); err != nil {
+			t.Fatalf("Failed to snapshot: %v", err)
+		}
+		s.Write(clock.VectorClock{}, "x", "3")
+		s.Delete(clock.VectorClock{}, "y")
+		want := s.Clock()
+		s.Close()
+
+		s = mustOpen(t, dir, Options{})
+		defer s.Close()
+		shouldRead(t, s, clock.VectorClock{}, "x", "3")
+		if _, _, ok, _ := s.Read(clock.VectorClock{}, "y"); ok {
+			t.Errorf("Deleted key y came back after recovery")
+		}
+		if diff := cmp.Diff(s.Clock(), want); diff != "" {
+			t.Errorf("Recovered bad clock (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("compacts the log", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{})
+		defer s.Close()
+		for i := 0; i < 4; i++ {
+			s.Write(clock.VectorClock{}, "x", "1")
+			if err := s.Snapshot(); err != nil {
+				t.Fatalf("Failed to snapshot: %v", err)
+			}
+		}
+
+		snaps, _ := listSegments(dir, snapshotPrefix, snapshotSuffix)
+		if diff := cmp.Diff(snaps, []int64{3, 4}); diff != "" {
+			t.Errorf("Kept wrong snapshots (-got,+want): %s", diff)
+		}
+		segs, _ := listSegments(dir, walPrefix, walSuffix)
+		if diff := cmp.Diff(segs, []int64{3, 4}); diff != "" {
+			t.Errorf("Kept wrong log segments (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("falls back to an older snapshot", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{})
+		s.Write(clock.VectorClock{}, "x", "1")
+		s.Snapshot()
+		s.Write(clock.VectorClock{}, "y", "2")
+		s.Snapshot()
+		s.Close()
+
+		// Damage the newest snapshot.
+		path := segmentPath(dir, snapshotPrefix, 2, snapshotSuffix)
+		if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+			t.Fatalf("Failed to damage snapshot: %v", err)
+		}
+
+		s = mustOpen(t, dir, Options{})
+		defer s.Close()
+		shouldRead(t, s, clock.VectorClock{}, "x", "1")
+		shouldRead(t, s, clock.VectorClock{}, "y", "2")
+	})
+
+	t.Run("requires persistence", func(t *testing.T) {
+		s := New(Alice, []string{Alice}, NopJournal())
+		if err := s.Snapshot(); err != ErrNotPersistent {
+			t.Errorf("Got %v, wanted %v", err, ErrNotPersistent)
+		}
+	})
+}
+
+func TestDelta(t *testing.T) {
+	a := New(Alice, []string{Alice, Bob}, NopJournal())
+	b := New(Bob, []string{Alice, Bob}, NopJournal())
+	a.Write(clock.VectorClock{}, "x", "1")
+	a.Write(a.Clock(), "y", "1")
+	for _, e := range a.AllEntries() {
+		b.Repair(e)
+	}
+	b.CaughtUp(a.Clock())
+
+	// Bob misses Alice's next writes, and writes concurrently himself.
+	seen := b.Clock()
+	a.Write(a.Clock(), "y", "2")
+	a.Write(a.Clock(), "z", "1")
+	bob := uuid.New(Bob).Next()
+	a.ImportEntry(Entry{Key: "w", Value: "b", Version: bob, Clock: clock.VectorClock{Bob: 5},
+		DVV: &clock.DVV{Dot: clock.Dot{Node: Bob, Counter: 5}}})
+
+	delta, vc := a.Delta(seen)
+	keys := []string{}
+	for _, e := range delta {
+		keys = append(keys, e.Key)
+	}
+	sort.Strings(keys)
+	if diff := cmp.Diff(keys, []string{"w", "y", "z"}); diff != "" {
+		t.Errorf("Bad delta (-got,+want): %s", diff)
+	}
+	if vc.Compare(a.Clock()) != clock.Equal {
+		t.Errorf("Got clock %v with the delta, wanted %v", vc, a.Clock())
+	}
+
+	if delta, _ := a.Delta(a.Clock()); len(delta) != 0 {
+		t.Errorf("Got %d entries in a delta since the current clock, wanted none", len(delta))
+	}
+}
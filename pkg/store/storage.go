@@ -4,9 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/crdt"
 	"github.com/spencer-p/key-value-store/pkg/uuid"
 )
 
@@ -20,44 +23,236 @@ type Entry struct {
 	Key     string            `json:"key"`
 	Value   string            `json:"value"`
 	Deleted bool              `json:"deleted"`
-	Clock   clock.VectorClock `json:"clock"`
+	Clock   clock.VectorClock `json:"clock,omitempty"`
 	Version uuid.UUID         `json:"version"`
 	//NodeHistory map[string]bool   `json:"history"`
+
+	// Timestamp is when the entry was written, by the hybrid logical clock of
+	// the node that wrote it.
+	Timestamp clock.Timestamp `json:"timestamp"`
+
+	// ExpiresAt is when the entry should be treated as deleted, if ever.
+	ExpiresAt *time.Time `json:"expires-at,omitempty"`
+
+	// Txn, if set, makes this entry a transaction that writes every entry in
+	// it as one event. The transaction itself has no key and is never stored.
+	Txn []Entry `json:"txn,omitempty"`
+
+	// TxnID names the transaction across shards a transaction commits, if any.
+	TxnID string `json:"txn-id,omitempty"`
+
+	// Siblings, if set, are the versions of the key written concurrently on
+	// different replicas, including this one. Each has its own clock.
+	Siblings []Entry `json:"siblings,omitempty"`
+
+	// DVV is the dotted version vector of the version: the event that wrote it
+	// and the versions of the key it replaced. Entries written before they had
+	// one are compared by Clock instead.
+	DVV *clock.DVV `json:"dvv,omitempty"`
+
+	// CRDT, if set, is the typed value of the key, which Value renders.
+	CRDT *crdt.Value `json:"crdt,omitempty"`
 }
 
 type Store struct {
 	addr     string
 	replicas []string
-	store    map[string]Entry
+	store    StorageEngine
+	deleted  int                  // number of tombstones in the engine
+	expiries map[string]time.Time // live keys that will expire
+	index    keyIndex             // every key in the engine, in order
 	m        *sync.RWMutex
 	vc       clock.VectorClock
 	vcCond   *sync.Cond
 	journal  chan<- Entry
 	version  uuid.UUID
+	wal      *wal
+	snapMtx  sync.Mutex
+
+	// acks holds the latest clock each other replica reported, and horizon is
+	// the point in time up to which tombstones have been collected.
+	acks    map[string]clock.VectorClock
+	horizon clock.VectorClock
+
+	// prepared holds transactions across shards this node promised to commit,
+	// and locks maps each of their keys to the transaction. decisions holds
+	// the participants of transactions this node coordinated and committed,
+	// and committed the transactions it most recently committed its part of,
+	// oldest first.
+	prepared  map[string]PreparedTxn
+	locks     map[string]string
+	decisions map[string][]string
+	committed []string
+
+	// watchers are told of every change committed to the keys they watch,
+	// and changes keeps them for readers that resume later.
+	watchers map[*Watcher]bool
+	changes  *changelog
+
+	// resolution settles concurrent writes to keys without a prefix in
+	// prefixes, and hlc timestamps every write.
+	resolution Resolution
+	prefixes   map[string]Resolution
+	hlc        *clock.HLC
+}
+
+// Options configures the durability of a store. The zero value is a purely
+// in-memory store.
+type Options struct {
+	// Dir is where the write-ahead log and snapshots live. If empty, nothing is
+	// persisted.
+	Dir string
+
+	// Sync is the policy for flushing the log to disk. SyncBatch flushes every
+	// SyncBatch records and SyncInterval flushes every SyncInterval.
+	Sync         SyncPolicy
+	SyncBatch    int
+	SyncInterval time.Duration
+
+	// Engine selects where entries are kept. The disk engine requires Dir.
+	Engine EngineKind
+
+	// Resolution is how concurrent writes are settled, except for keys with
+	// a prefix in ResolutionPrefixes. The longest prefix of a key decides.
+	Resolution         Resolution
+	ResolutionPrefixes map[string]Resolution
+
+	// ChangeRetention is the fewest recent changes to keep for readers of the
+	// change log, and ChangeMaxAge is how long to keep any change. Changes
+	// are only compacted if one of them is set.
+	ChangeRetention int
+	ChangeMaxAge    time.Duration
+
+	// MaxClockSkew is how far in the future a write from another node may be
+	// timestamped before it is rejected. Zero accepts any timestamp.
+	MaxClockSkew time.Duration
 }
 
 // New constructs an empty store that resides at the given address or unique ID.
 // The callback channel is issued all new modifications to the store (like a journal).
 func New(selfAddr string, replicas []string, callback chan<- Entry) *Store {
+	return newStore(selfAddr, replicas, callback, NewMemoryEngine())
+}
+
+func newStore(selfAddr string, replicas []string, callback chan<- Entry, engine StorageEngine) *Store {
 	var mtx sync.RWMutex
 	return &Store{
 		addr:     selfAddr,
 		replicas: replicas[:],
-		store:    make(map[string]Entry),
+		store:    engine,
+		expiries: make(map[string]time.Time),
 		m:        &mtx,
 		vc:       clock.VectorClock{},
 		vcCond:   sync.NewCond(&mtx),
 		journal:  callback,
 		version:  uuid.New(selfAddr),
+		acks:     make(map[string]clock.VectorClock),
+		horizon:  clock.VectorClock{},
+
+		prepared:  make(map[string]PreparedTxn),
+		locks:     make(map[string]string),
+		decisions: make(map[string][]string),
+		watchers:  make(map[*Watcher]bool),
+		changes:   newChangelog(Options{}),
+		hlc:       &clock.HLC{},
 	}
 }
 
+// Open constructs a store like New, but backs it with the engine and
+// write-ahead log in opts.Dir. Entries and the vector clock are recovered from
+// the newest snapshot and the log written since.
+func Open(selfAddr string, replicas []string, callback chan<- Entry, opts Options) (*Store, error) {
+	engine, err := openEngine(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := newStore(selfAddr, replicas, callback, engine)
+	s.resolution, s.prefixes = opts.Resolution, opts.ResolutionPrefixes
+	s.hlc.MaxSkew = opts.MaxClockSkew
+	if s.changes, err = openChangelog(opts); err != nil {
+		engine.Close()
+		return nil, err
+	}
+	if opts.Dir == "" {
+		return s, nil
+	}
+
+	if err := s.reindex(); err != nil {
+		engine.Close()
+		return nil, err
+	}
+
+	var first int64
+	if header, entries, ok := loadSnapshot(opts.Dir); ok {
+		if err := s.restore(header, entries); err != nil {
+			engine.Close()
+			return nil, err
+		}
+		first = header.Segment
+	}
+
+	w, err := openWAL(opts.Dir, first, opts, s.replay)
+	if err != nil {
+		engine.Close()
+		return nil, err
+	}
+	s.wal = w
+
+	count, err := s.store.Count()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	log.Printf("Recovered %d entries at t=%v\n", count, s.vc)
+	return s, nil
+}
+
+// Close flushes and closes the write-ahead log, if any, and the engine.
+func (s *Store) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err := s.store.Close()
+	if cerr := s.changes.close(); cerr != nil {
+		err = cerr
+	}
+	if s.wal != nil {
+		if werr := s.wal.close(); werr != nil {
+			err = werr
+		}
+		s.wal = nil
+	}
+	return err
+}
+
+// WriteOptions are optional parameters to a write.
+type WriteOptions struct {
+	// ExpiresAt, if set, is when the entry will be deleted.
+	ExpiresAt time.Time
+
+	// Precondition must hold for the write to be performed.
+	Precondition Precondition
+}
+
+// DeleteOptions are optional parameters to a delete.
+type DeleteOptions struct {
+	// Precondition must hold for the delete to be performed.
+	Precondition Precondition
+}
+
 // Write performs a new write to the store. It will block until the write can be applied
 // according to the vector clock passed.
 func (s *Store) Write(tcausal clock.VectorClock, key, value string) (
 	err error,
 	replaced bool,
 	currentClock clock.VectorClock) {
+	return s.WriteWithOptions(tcausal, key, value, WriteOptions{})
+}
+
+// WriteWithOptions is Write with optional parameters.
+func (s *Store) WriteWithOptions(tcausal clock.VectorClock, key, value string, opts WriteOptions) (
+	err error,
+	replaced bool,
+	currentClock clock.VectorClock) {
 
 	// Acquire access to the store
 	s.m.Lock()
@@ -71,15 +266,34 @@ func (s *Store) Write(tcausal clock.VectorClock, key, value string) (
 		return
 	}
 
+	// Check the write is wanted in this state
+	if err = s.checkLock(key); err != nil {
+		return
+	}
+	current, exists, err := s.store.Get(key)
+	if err != nil {
+		return
+	}
+	if err = opts.Precondition.check(current, exists, time.Now()); err != nil {
+		return
+	}
+
 	// Perform the write
 	s.vc.Max(tcausal)
 	s.version = s.version.Next()
-	replaced = s.commitWrite(Entry{
+	e := Entry{
 		Key:     key,
 		Value:   value,
 		Deleted: false,
 		Version: s.version,
-	}, true)
+	}
+	if !opts.ExpiresAt.IsZero() {
+		e.ExpiresAt = &opts.ExpiresAt
+	}
+	if e.Siblings, err = s.survivors(key, tcausal); err != nil {
+		return
+	}
+	replaced, err = s.commitWrite(e, fromLocal)
 	return
 }
 
@@ -87,41 +301,223 @@ func (s *Store) Write(tcausal clock.VectorClock, key, value string) (
 func (s *Store) ImportEntry(e Entry) (imported bool, err error) {
 	s.m.Lock()
 	defer s.m.Unlock()
+	imported, _, err = s.importEntry(e, e.Clock, fromGossip)
+	return imported, err
+}
+
+// ImportCoalesced imports the last of several writes made one after another on
+// origin, when the skipped writes before it were coalesced into it on the way.
+// It waits for what the first of them depended on.
+func (s *Store) ImportCoalesced(e Entry, origin string, skipped uint64) (imported bool, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	imported, _, err = s.importEntry(e, coalescedAfter(e, origin, skipped), fromGossip)
+	return imported, err
+}
+
+// Import is a write gossiped from another replica. Skipped counts the writes
+// made on its origin just before it that were coalesced into it.
+type Import struct {
+	Entry   Entry
+	Skipped uint64
+}
 
-	// If we already have it, we are good
-	if existing, ok := s.store[e.Key]; ok && existing.Version.Equal(e.Version) {
-		log.Printf("Import of %q already exists on this node. ACKing", e.Key)
-		return true, nil
+// ImportBatch imports a batch of writes made on origin, in the order origin
+// made them whatever order they are in, as ImportCoalesced would each. It
+// returns how many were new events here, leaving out writes we already had,
+// such as those a repair brought first. Those imported before an error stay
+// so.
+func (s *Store) ImportBatch(origin string, batch []Import) (imported int, err error) {
+	sorted := make([]Import, len(batch))
+	copy(sorted, batch)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Entry.Clock[origin] < sorted[j].Entry.Clock[origin]
+	})
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, im := range sorted {
+		_, event, err := s.importEntry(im.Entry, coalescedAfter(im.Entry, origin, im.Skipped), fromGossip)
+		if err != nil {
+			return imported, err
+		} else if event {
+			imported++
+		}
 	}
+	return imported, nil
+}
 
-	if err = s.waitForGossip(e.Clock); err != nil {
-		return false, err
+// coalescedAfter returns the clock a write made on origin depends on, when the
+// skipped writes before it were coalesced into it.
+func coalescedAfter(e Entry, origin string, skipped uint64) clock.VectorClock {
+	after := e.Clock.Copy()
+	if after[origin] > skipped {
+		after[origin] -= skipped
+	} else {
+		after[origin] = 0
 	}
+	return after
+}
 
-	// If we already have it, we are good
-	if existing, ok := s.store[e.Key]; ok && existing.Version.Equal(e.Version) {
-		log.Printf("Import of %q already exists on this node. ACKing", e.Key)
-		return true, nil
+// importEntry is ImportEntry without the locking. It waits for the writes the
+// clock after depends on to arrive first, unless it is nil. It also returns
+// whether the import was a new event here, which it is not if we already had
+// the write.
+func (s *Store) importEntry(e Entry, after clock.VectorClock, from source) (imported, event bool, err error) {
+	// Refuse writes from a node whose clock is too far ahead of ours, before
+	// they drag our clock along.
+	for _, m := range e.members() {
+		if err := s.hlc.Update(m.Timestamp); err != nil {
+			log.Printf("WARNING: Rejecting import of %s from a skewed clock: %v\n", e.describe(), err)
+			return false, false, err
+		}
 	}
 
-	// if i receive gossip. from the past.  and i do not have a more recent
-	// entry for said entry.  then.  i may. commit. said entry.
-	if e.Clock.Subset(s.replicas).Compare(s.vc.Subset(s.replicas)) == clock.Less {
-		if existing, ok := s.store[e.Key]; ok {
-			if !(existing.Clock.Subset(s.replicas).Compare(s.vc.Subset(s.replicas)) != clock.Greater) {
-				return false, nil
+	if after != nil {
+		if err = s.waitForGossip(after); err != nil {
+			return false, false, err
+		}
+	}
+
+	// If we already have it, we are good. A repair may have brought it
+	// without what it depends on, which we have now that it arrived by gossip.
+	if applied, err := s.applied(e); err != nil {
+		return false, false, err
+	} else if applied {
+		log.Printf("Import of %s already exists on this node. ACKing", e.describe())
+		if from != fromRepair {
+			if err := s.see(e.Clock); err != nil {
+				return false, false, err
+			}
+		}
+		return true, false, nil
+	}
+
+	members := make([]Entry, 0, len(e.members()))
+	for _, m := range e.members() {
+		_, ok, err := s.store.Get(m.Key)
+		if err != nil {
+			return false, false, err
+		}
+
+		// A late duplicate of an entry whose tombstone was already collected.
+		if !ok && s.seenByAll(e) {
+			log.Printf("Import of %s predates collected tombstones. ACKing", e.describe())
+			return true, false, nil
+		}
+
+		if m.CRDT != nil {
+			merged, ok, err := s.mergeValue(m)
+			if err != nil {
+				return false, false, err
+			} else if ok {
+				members = append(members, merged)
+				continue
+			}
+		}
+		if s.resolutionOf(m.Key) == ResolveLWW {
+			latest, wins, err := s.lastWriter(m)
+			if err != nil {
+				return false, false, err
+			} else if wins {
+				members = append(members, latest)
 			}
+			continue
 		}
+
+		// Keep whatever we have that the writer had not seen.
+		merged, err := s.reconcile(m)
+		if err != nil {
+			return false, false, err
+		}
+		if len(merged.Siblings) > 0 {
+			log.Printf("Import of %q is concurrent with %d other versions\n", m.Key, len(merged.Siblings)-1)
+		}
+		members = append(members, merged)
+	}
+	if len(members) == 0 {
+		// Every write lost, but the import is still an event here. A repair
+		// is not, and does not vouch for what the write depended on.
+		if from == fromRepair {
+			return true, false, nil
+		}
+		if err := s.bump(map[string]uint64{s.addr: 1}); err != nil {
+			return false, false, err
+		}
+		if err := s.see(e.Clock); err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	} else if e.Txn != nil {
+		e.Txn = members
+	} else {
+		e = members[0]
+	}
+
+	if from != fromRepair {
+		s.vc.Max(e.Clock)
+	}
+	if _, err = s.commitWrite(e, from); err != nil {
+		return false, false, err
 	}
 
-	s.vc.Max(e.Clock)
-	s.commitWrite(e, false)
+	return true, from != fromRepair, nil
+}
+
+// CaughtUp records that the store has every write a peer at the clock had,
+// once everything the peer sent to catch us up with it was repaired.
+func (s *Store) CaughtUp(peer clock.VectorClock) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.see(peer)
+}
+
+// see advances the clock to include vc, logging it first, for writes the store
+// has that no commit vouched for.
+func (s *Store) see(vc clock.VectorClock) error {
+	next := s.vc.Copy()
+	next.Max(vc)
+	if next.Compare(s.vc.Copy()) == clock.Equal {
+		return nil
+	}
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Op: opSeen, Clock: vc}); err != nil {
+			log.Println("Failed to log clock:", err)
+			return err
+		}
+	}
+	s.vc.Max(vc)
+	s.vcCond.Broadcast()
+	return nil
+}
 
+// applied returns true if the write that made the entry, or every entry of a
+// transaction, is already in the store or was replaced by a later one.
+func (s *Store) applied(e Entry) (bool, error) {
+	for _, m := range e.members() {
+		existing, ok, err := s.store.Get(m.Key)
+		if err != nil {
+			return false, err
+		} else if !ok {
+			return false, nil
+		}
+		if !existing.supersedes(m.written(), s.replicas) {
+			return false, nil
+		}
+	}
 	return true, nil
 }
 
 // Delete deletes a key, returning true if it was deleted.
 func (s *Store) Delete(tcausal clock.VectorClock, key string) (
+	err error,
+	deleted bool,
+	currentClock clock.VectorClock) {
+	return s.DeleteWithOptions(tcausal, key, DeleteOptions{})
+}
+
+// DeleteWithOptions is Delete with optional parameters.
+func (s *Store) DeleteWithOptions(tcausal clock.VectorClock, key string, opts DeleteOptions) (
 	err error,
 	deleted bool,
 	currentClock clock.VectorClock) {
@@ -132,49 +528,134 @@ func (s *Store) Delete(tcausal clock.VectorClock, key string) (
 		return
 	}
 
+	if err = s.checkLock(key); err != nil {
+		return
+	}
+	entry, exists, err := s.store.Get(key)
+	if err != nil {
+		return
+	}
+	if err = opts.Precondition.check(entry, exists, time.Now()); err != nil {
+		return
+	}
+
 	// Don't perform a delete on a key/value that doesn't exist
-	entry, exists := s.store[key]
-	if !exists || entry.Deleted {
+	if !exists || entry.Deleted || entry.expired(time.Now()) {
 		return
 	}
 
 	// Perform the delete if we have the object
 	s.vc.Max(tcausal)
 	s.version = s.version.Next()
-	deleted = s.commitWrite(Entry{Key: key, Deleted: true, Version: s.version}, true)
+	e := Entry{Key: key, Deleted: true, Version: s.version}
+	if e.Siblings, err = s.survivors(key, tcausal); err != nil {
+		return
+	}
+	deleted, err = s.commitWrite(e, fromLocal)
 	return
 }
 
-func (s *Store) commitWrite(e Entry, shouldJournal bool) (replaced bool) {
-	// Check if the entry previously existed
-	oldentry, exists := s.store[e.Key]
-	replaced = exists && oldentry.Deleted != true
+// source is where a write being committed came from.
+type source int
+
+const (
+	// fromLocal is a write made on this replica.
+	fromLocal source = iota
+	// fromGossip is a write gossiped by the replica that made it, which
+	// learns that we imported it from our import counts.
+	fromGossip
+	// fromRepair is a write repaired by anti-entropy or a sync. Nobody counts
+	// it, so it is not an event here: bumping our clock for it would leave
+	// our later writes waiting on an event no other replica hears of.
+	fromRepair
+)
 
-	// Update the clock & version in anticipation of the event
-	s.vc.Increment(s.addr)
-	s.vcCond.Broadcast() // let others know this update happened once we release the lock
+// commitWrite stores an entry on this replica. Local writes are stamped with
+// the clock of a new event, keep the siblings set on them alongside the new
+// version, and are journaled to the other replicas. Imported entries keep the
+// clock of the write that made them, and are an event here unless repaired.
+func (s *Store) commitWrite(e Entry, from source) (replaced bool, err error) {
+	local := from == fromLocal
+	// Check if the entry previously existed
+	oldentry, exists, err := s.store.Get(e.Key)
+	if err != nil {
+		return false, err
+	}
+	replaced = exists && oldentry.Deleted != true && !oldentry.expired(time.Now())
 
-	// Mark the clock
-	e.Clock = s.vc.Copy()
+	// Mark the clock with the event we are about to perform. Every entry of a
+	// transaction is part of the same event.
+	now := s.vc.Copy()
+	if from != fromRepair {
+		now.Increment(s.addr)
+	}
+	if local {
+		e.Clock = now
+		if e.Timestamp.IsZero() {
+			e.Timestamp = s.hlc.Now()
+		}
+		dot := clock.Dot{Node: s.addr, Counter: now[s.addr]}
+		for i := range e.Txn {
+			e.Txn[i].Clock = now.Copy()
+			e.Txn[i].Timestamp = e.Timestamp
+			if e.Txn[i], err = s.dotted(e.Txn[i], dot); err != nil {
+				return false, err
+			}
+			e.Txn[i] = e.Txn[i].withSiblings()
+			if len(e.Txn[i].Siblings) == 0 {
+				// It has the transaction's clock; see members.
+				e.Txn[i].Clock = nil
+			}
+		}
+		if e.Txn == nil {
+			if e, err = s.dotted(e, dot); err != nil {
+				return false, err
+			}
+			e = e.withSiblings()
+		}
+	}
 	/*if e.NodeHistory == nil {
 		e.NodeHistory = make(map[string]bool)
 	}
 	e.NodeHistory[s.addr] = true*/
 
-	// Perform the write
-	s.store[e.Key] = e
-	if !e.Deleted {
-		log.Printf("Committed %q=%q at t=%v\n", e.Key, e.Value, s.vc)
-	} else {
-		log.Printf("Committed delete of %q at t=%v\n", e.Key, s.vc)
+	// The log must have the entry before anyone can observe it
+	seq := s.changes.last + 1
+	if s.wal != nil {
+		if err = s.wal.append(walRecord{Op: opCommit, Entry: &e, Clock: now, Seq: seq}); err != nil {
+			log.Printf("Failed to log %s: %v\n", e.describe(), err)
+			return false, err
+		}
+	}
+
+	// Update the clock in anticipation of the event
+	if from != fromRepair {
+		s.vc.Increment(s.addr)
+	}
+	s.vcCond.Broadcast() // let others know this update happened once we release the lock
+
+	// Perform the write. The log already has it, so a failure here is
+	// repaired the next time the log is replayed.
+	for _, m := range e.members() {
+		if err = s.put(m); err != nil {
+			log.Printf("Failed to store %q: %v\n", m.Key, err)
+			return false, err
+		}
+		if !m.Deleted {
+			log.Printf("Committed %q=%q at t=%v\n", m.Key, m.Value, s.vc)
+		} else {
+			log.Printf("Committed delete of %q at t=%v\n", m.Key, s.vc)
+		}
+		s.notify(m)
 	}
+	s.record(seq, e.members())
 
 	// send the update to the journal
-	if shouldJournal {
+	if local {
 		s.journal <- e
 	}
 
-	return replaced
+	return replaced, nil
 }
 
 // Read returns the value for a key in the Store.
@@ -192,9 +673,10 @@ func (s *Store) Read(tcausal clock.VectorClock, key string) (
 		return
 	}
 
-	// Perform the read. Act like it doesn't exist if it was deleted.
-	e, ok = s.store[key]
-	if e.Deleted {
+	// Perform the read. Act like it doesn't exist if it was deleted or has
+	// expired.
+	e, ok, err = s.store.Get(key)
+	if e.Deleted || e.expired(time.Now()) {
 		ok = false
 	}
 	return
@@ -214,11 +696,10 @@ func (s *Store) NumKeys(tcausal clock.VectorClock) (
 	}
 
 	// count only not deleted keys
-	for k := range s.store {
-		if !s.store[k].Deleted {
-			count += 1
-		}
+	if count, err = s.store.Count(); err != nil {
+		return
 	}
+	count -= s.deleted + s.numExpired(time.Now())
 	return
 }
 
@@ -227,45 +708,174 @@ func (s *Store) SetReplicas(nodes []string) {
 	s.m.Lock()
 	defer s.m.Unlock()
 	s.replicas = nodes[:]
+	s.acks = make(map[string]clock.VectorClock)
 }
 
-// BumpClockForNode informs the store that another node has processed an event of ours.
-func (s *Store) BumpClockForNode(node string) {
+// BumpClockForNodes informs the store that other nodes have processed events
+// of ours, counts[node] on each. Either every event is counted or none is.
+func (s *Store) BumpClockForNodes(counts map[string]uint64) error {
 	s.m.Lock()
 	defer s.m.Unlock()
-	s.vc.Increment(node)
+	return s.bump(counts)
+}
+
+// bump counts events on nodes that changed nothing here, in a single record.
+// The events are not counted if they cannot be logged.
+func (s *Store) bump(counts map[string]uint64) error {
+	events := make(map[string]uint64)
+	for node, n := range counts {
+		if n > 0 {
+			events[node] = n
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Op: opBump, Counts: events}); err != nil {
+			return fmt.Errorf("failed to log clock bump for %v: %w", events, err)
+		}
+	}
+	for node, n := range events {
+		s.vc[node] += n
+	}
 	s.vcCond.Broadcast()
+	return nil
 }
 
 func (s *Store) String() string {
 	s.m.Lock()
 	defer s.m.Unlock()
-	return fmt.Sprintf("%v %+v", s.vc, s.store)
+	return fmt.Sprintf("%v %+v", s.vc, s.allEntries())
 }
 
 // AllEntries returns a slice of all entries in this store.
 func (s *Store) AllEntries() []Entry {
 	s.m.Lock()
 	defer s.m.Unlock()
-	entries := make([]Entry, len(s.store))
-	i := 0
-	for _, e := range s.store {
-		entries[i] = e
-		i++
+	return s.allEntries()
+}
+
+// Delta returns the entries with writes that a replica at the clock since has
+// not seen, along with the clock they are current as of.
+func (s *Store) Delta(since clock.VectorClock) ([]Entry, clock.VectorClock) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	since = since.Subset(s.replicas)
+	var entries []Entry
+	err := s.store.Iterate(func(key string, e Entry) IterAction {
+		switch e.Clock.Subset(s.replicas).Compare(since) {
+		case clock.Less, clock.Equal:
+		default:
+			entries = append(entries, e)
+		}
+		return CONTINUE
+	})
+	if err != nil {
+		log.Println("Failed to read entries since a clock:", err)
+	}
+	return entries, s.vc.Copy()
+}
+
+func (s *Store) allEntries() []Entry {
+	var entries []Entry
+	if count, err := s.store.Count(); err == nil {
+		entries = make([]Entry, 0, count)
+	}
+	err := s.store.Iterate(func(key string, e Entry) IterAction {
+		entries = append(entries, e)
+		return CONTINUE
+	})
+	if err != nil {
+		log.Println("Failed to read all entries:", err)
 	}
 	return entries
 }
 
 // ReplaceEntries atomically replaces all the entries with the given slice.
-func (s *Store) ReplaceEntries(entries []Entry) {
+func (s *Store) ReplaceEntries(entries []Entry) error {
 	s.m.Lock()
 	defer s.m.Unlock()
-	s.store = make(map[string]Entry)
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Op: opReset, Entries: entries}); err != nil {
+			return fmt.Errorf("failed to log replacement of entries: %w", err)
+		}
+	}
+	return s.replaceEntries(entries)
+}
+
+// replaceEntries is ReplaceEntries without the locking or logging.
+func (s *Store) replaceEntries(entries []Entry) error {
+	if err := s.store.Clear(); err != nil {
+		return err
+	}
+	s.deleted = 0
+	s.expiries = make(map[string]time.Time)
+	s.index.reset()
 	s.vc = clock.VectorClock{}
+	s.acks = make(map[string]clock.VectorClock)
+	s.horizon = clock.VectorClock{}
 	for _, e := range entries {
-		s.store[e.Key] = e
+		if err := s.put(e); err != nil {
+			return err
+		}
+		s.notify(e)
 		s.vc.Max(e.Clock)
 	}
+	return nil
+}
+
+// put stores an entry in the engine, keeping the bookkeeping up to date.
+func (s *Store) put(e Entry) error {
+	old, exists, err := s.store.Get(e.Key)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Put(e); err != nil {
+		return err
+	}
+	if exists {
+		s.account(&old, &e)
+	} else {
+		s.account(nil, &e)
+	}
+	return nil
+}
+
+// account updates the bookkeeping kept alongside the engine when the entry for
+// a key goes from old to new. Either may be nil.
+func (s *Store) account(old, new *Entry) {
+	if old != nil {
+		if old.Deleted {
+			s.deleted--
+		}
+		delete(s.expiries, old.Key)
+		if new == nil {
+			s.index.remove(old.Key)
+		}
+	}
+	if new != nil {
+		if old == nil {
+			s.index.insert(new.Key)
+		}
+		if new.Deleted {
+			s.deleted++
+		} else if new.ExpiresAt != nil {
+			s.expiries[new.Key] = *new.ExpiresAt
+		}
+	}
+}
+
+// reindex rebuilds the bookkeeping for entries already in the engine.
+func (s *Store) reindex() error {
+	s.deleted = 0
+	s.expiries = make(map[string]time.Time)
+	s.index.reset()
+	return s.store.Iterate(func(key string, e Entry) IterAction {
+		s.account(nil, &e)
+		return CONTINUE
+	})
 }
 
 // Clock returns the current vector clock.
@@ -312,6 +922,88 @@ func (s *Store) waitForGossip(incoming clock.VectorClock) error {
 	}
 }
 
+// replay applies a record recovered from the write-ahead log.
+func (s *Store) replay(rec walRecord) error {
+	switch rec.Op {
+	case opCommit:
+		if rec.Entry == nil {
+			return nil
+		}
+		// The record has the clock after the commit, which includes the
+		// entry's unless it was repaired.
+		if rec.Clock != nil {
+			s.vc.Max(rec.Clock)
+		} else {
+			s.vc.Max(rec.Entry.Clock)
+		}
+		s.recoverVersion(rec.Entry.Version)
+		for _, m := range rec.Entry.members() {
+			s.recoverVersion(m.Version)
+			s.hlc.Observe(m.Timestamp)
+			if err := s.put(m); err != nil {
+				return err
+			}
+		}
+		if rec.Entry.TxnID != "" {
+			if _, ok := s.prepared[rec.Entry.TxnID]; ok {
+				s.remember(rec.Entry.TxnID)
+			}
+			s.resolve(rec.Entry.TxnID)
+		}
+		if rec.Seq != 0 {
+			s.record(rec.Seq, rec.Entry.members())
+		}
+	case opBump:
+		if rec.Node != "" {
+			s.vc.Increment(rec.Node)
+		}
+		for node, n := range rec.Counts {
+			s.vc[node] += n
+		}
+	case opReset:
+		for i := range rec.Entries {
+			s.recoverVersion(rec.Entries[i].Version)
+		}
+		return s.replaceEntries(rec.Entries)
+	case opPurge:
+		return s.purge(rec.Keys, rec.Clock)
+	case opPrepare:
+		s.prepare(PreparedTxn{ID: rec.TxnID, Coordinator: rec.Node, Writes: rec.Entries}, time.Now())
+	case opAbort:
+		s.resolve(rec.TxnID)
+	case opDecide:
+		s.decisions[rec.TxnID] = rec.Keys
+	case opForget:
+		delete(s.decisions, rec.TxnID)
+	case opPrune:
+		return s.prune(rec.Keys)
+	case opSeen:
+		s.vc.Max(rec.Clock)
+	}
+	return nil
+}
+
+// recoverVersion advances the version counter past a version we issued before
+// a restart, so that new versions are never reused.
+func (s *Store) recoverVersion(v uuid.UUID) {
+	if v.OriginatedOn(s.addr) && v.Seq > s.version.Seq {
+		s.version.Seq = v.Seq
+	}
+}
+
+// record adds committed entries to the change log, numbered from seq. The
+// write-ahead log already has them, so a failure only costs readers of the
+// change log until the next restart.
+func (s *Store) record(seq uint64, entries []Entry) {
+	now := time.Now()
+	for i, e := range entries {
+		if err := s.changes.add(seq+uint64(i), e, now); err != nil {
+			log.Printf("Failed to add %q to the change log: %v\n", e.Key, err)
+			return
+		}
+	}
+}
+
 func (s *Store) copyClock(c *clock.VectorClock) {
 	*c = s.vc.Copy()
 }
@@ -1,8 +1,10 @@
 package store
 
 import (
+	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/spencer-p/key-value-store/pkg/clock"
 )
@@ -365,3 +367,93 @@ func TestCausality(t *testing.T) {
 		})
 	*/
 }
+
+func TestClockSkew(t *testing.T) {
+	s := New(Alice, []string{Alice, Bob}, NopJournal())
+	s.hlc.MaxSkew = time.Minute
+
+	ahead := clock.Timestamp{Wall: time.Now().Add(time.Hour).UnixNano()}
+	if _, err := s.ImportEntry(Entry{Key: "x", Value: "b", Clock: clock.VectorClock{Bob: 1}, Timestamp: ahead}); !errors.Is(err, clock.ErrClockSkew) {
+		t.Errorf("Got %v importing a write from an hour ahead, wanted ErrClockSkew", err)
+	}
+
+	// A write from a node slightly ahead is accepted, and later local
+	// writes are timestamped after it.
+	near := clock.Timestamp{Wall: time.Now().Add(time.Second).UnixNano()}
+	if _, err := s.ImportEntry(Entry{Key: "x", Value: "b", Clock: clock.VectorClock{Bob: 1}, Timestamp: near}); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	s.Write(s.Clock(), "x", "a")
+	err, e, _, _ := s.Read(clock.VectorClock{}, "x")
+	if err != nil || e.Timestamp.Compare(near) != clock.Greater {
+		t.Errorf("Got timestamp %v and %v, wanted one after %v", e.Timestamp, err, near)
+	}
+}
+
+func TestImportCoalesced(t *testing.T) {
+	journal := make(chan Entry, 10)
+	a := New(Alice, []string{Alice, Bob}, journal)
+	b := New(Bob, []string{Alice, Bob}, NopJournal())
+	a.Write(clock.VectorClock{}, "x", "1")
+	a.Write(a.Clock(), "x", "2")
+	first, second := <-journal, <-journal
+	if !second.Replaces(first) {
+		t.Fatalf("Second write to x does not replace the first")
+	}
+
+	// Only the second write arrives, with the first coalesced into it.
+	done := make(chan error)
+	go func() {
+		_, err := b.ImportCoalesced(second, Alice, 1)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Import of a coalesced write waited for the write it replaced")
+	}
+	shouldRead(t, b, a.Clock(), "x", "2")
+}
+
+func TestImportBatch(t *testing.T) {
+	journal := make(chan Entry, 10)
+	a := New(Alice, []string{Alice, Bob}, journal)
+	b := New(Bob, []string{Alice, Bob}, NopJournal())
+	a.Write(clock.VectorClock{}, "x", "1")
+	a.Write(a.Clock(), "x", "2")
+	a.Write(a.Clock(), "y", "1")
+	a.Write(a.Clock(), "z", "1")
+	x1, x2, y, z := <-journal, <-journal, <-journal, <-journal
+
+	// The batch arrives out of order, with the first write to x coalesced
+	// into the second.
+	done := make(chan error)
+	var imported int
+	go func() {
+		var err error
+		imported, err = b.ImportBatch(Alice, []Import{{Entry: z}, {Entry: x2, Skipped: 1}, {Entry: y}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Import of a batch out of order did not finish")
+	}
+	if imported != 3 {
+		t.Errorf("Imported %d writes, wanted 3", imported)
+	}
+	shouldRead(t, b, a.Clock(), "x", "2")
+	shouldRead(t, b, a.Clock(), "z", "1")
+
+	// The write coalesced away is already replaced.
+	if _, err := b.ImportEntry(x1); err != nil {
+		t.Errorf("Failed to import a replaced write: %v", err)
+	}
+	shouldRead(t, b, a.Clock(), "x", "2")
+}
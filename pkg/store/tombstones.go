@@ -0,0 +1,104 @@
+package store
+
+import (
+	"log"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+// Acknowledge records the clock another replica reported. Once every replica
+// has acknowledged a tombstone it can be collected.
+func (s *Store) Acknowledge(node string, vc clock.VectorClock) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.acks[node]; !ok {
+		s.acks[node] = clock.VectorClock{}
+	}
+	s.acks[node].Max(vc)
+}
+
+// CollectTombstones forgets every deleted entry that all replicas in the shard
+// have seen, returning how many were dropped.
+func (s *Store) CollectTombstones() (collected int, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	horizon, ok := s.ackedClock()
+	if !ok {
+		return 0, nil
+	}
+
+	var keys []string
+	err = s.store.Iterate(func(key string, e Entry) IterAction {
+		if !e.Deleted {
+			return CONTINUE
+		}
+		if cmp := e.Clock.Subset(s.replicas).Compare(horizon); cmp == clock.Less || cmp == clock.Equal {
+			keys = append(keys, key)
+		}
+		return CONTINUE
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	if s.wal != nil {
+		if err = s.wal.append(walRecord{Op: opPurge, Keys: keys, Clock: horizon}); err != nil {
+			log.Println("Failed to log tombstone collection:", err)
+			return 0, err
+		}
+	}
+	if err = s.purge(keys, horizon); err != nil {
+		return 0, err
+	}
+	log.Printf("Collected %d tombstones acknowledged as of %v\n", len(keys), horizon)
+	return len(keys), nil
+}
+
+// ackedClock returns the pairwise minimum of every replica's clock, i.e. the
+// latest point in time every replica has seen. It returns false if some
+// replica has not reported its clock yet.
+func (s *Store) ackedClock() (clock.VectorClock, bool) {
+	horizon := s.vc.Subset(s.replicas)
+	for _, r := range s.replicas {
+		if r == s.addr {
+			continue
+		}
+		ack, ok := s.acks[r]
+		if !ok {
+			return nil, false
+		}
+		horizon.Min(ack.Subset(s.replicas))
+	}
+	return horizon, true
+}
+
+// purge drops the entries for keys and advances the horizon.
+func (s *Store) purge(keys []string, horizon clock.VectorClock) error {
+	for _, key := range keys {
+		e, ok, err := s.store.Get(key)
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if err := s.store.Delete(key); err != nil {
+			return err
+		}
+		s.account(&e, nil)
+	}
+	s.horizon.Max(horizon)
+	return nil
+}
+
+// seenByAll returns true if an entry is from before a point every replica had
+// already seen. Such an entry was either applied or superseded everywhere, so
+// if we no longer have it, it was collected and must not be resurrected.
+func (s *Store) seenByAll(e Entry) bool {
+	if len(s.horizon) == 0 {
+		return false
+	}
+	cmp := e.Clock.Subset(s.replicas).Compare(s.horizon.Subset(s.replicas))
+	return cmp == clock.Less || cmp == clock.Equal
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+func TestCollectTombstones(t *testing.T) {
+	s := New(Alice, []string{Alice, Bob}, NopJournal())
+	s.Write(clock.VectorClock{}, "x", "1")
+	_, original, _, _ := s.Read(clock.VectorClock{}, "x")
+	s.Write(clock.VectorClock{}, "y", "2")
+	s.Delete(clock.VectorClock{}, "x")
+
+	collect := func(want int) {
+		t.Helper()
+		if got, err := s.CollectTombstones(); err != nil {
+			t.Errorf("Failed to collect tombstones: %v", err)
+		} else if got != want {
+			t.Errorf("Collected %d tombstones, wanted %d", got, want)
+		}
+	}
+
+	// Bob has not said anything yet
+	collect(0)
+
+	// Bob has not seen the delete yet
+	s.Acknowledge(Bob, clock.VectorClock{Alice: 2})
+	collect(0)
+
+	s.Acknowledge(Bob, clock.VectorClock{Alice: 3})
+	collect(1)
+	if got := len(s.AllEntries()); got != 1 {
+		t.Errorf("Have %d entries after collection, wanted 1", got)
+	}
+	if _, count, _ := s.NumKeys(clock.VectorClock{}); count != 1 {
+		t.Errorf("Counted %d keys after collection, wanted 1", count)
+	}
+
+	// A late duplicate of the original write must not bring x back.
+	if _, err := s.ImportEntry(original); err != nil {
+		t.Fatalf("Failed to import duplicate: %v", err)
+	}
+	if _, _, ok, _ := s.Read(clock.VectorClock{}, "x"); ok {
+		t.Errorf("Collected key x was resurrected by a duplicate")
+	}
+}
@@ -0,0 +1,264 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+var (
+	ErrKeyLocked  = errors.New("Key is locked by a prepared transaction")
+	ErrUnknownTxn = errors.New("Transaction is not prepared")
+)
+
+// MAX_COMMITTED_TXNS is how many of the transactions it committed its part of
+// a node remembers, to answer a coordinator that asks again.
+const MAX_COMMITTED_TXNS = 10000
+
+// PreparedTxn is this shard's part of a transaction across shards that has
+// been promised to the coordinator but not yet committed or aborted. Its keys
+// are locked against other writes on this node until it is resolved.
+type PreparedTxn struct {
+	ID          string  `json:"id"`
+	Coordinator string  `json:"coordinator"`
+	Writes      []Entry `json:"writes"`
+
+	// Prepared is when this node prepared the transaction, or recovered it.
+	Prepared time.Time `json:"-"`
+}
+
+// Decision is a coordinator's record that a transaction across shards
+// committed, kept until every participant has applied it.
+type Decision struct {
+	ID           string   `json:"id"`
+	Participants []string `json:"participants"`
+}
+
+// Prepare promises to commit writes as part of a transaction across shards,
+// once the store is current with the given clock. The promise is logged
+// before it is made, so it survives a crash. It fails with ErrKeyLocked if
+// another prepared transaction holds any of the keys. Preparing the same
+// transaction twice is a no-op.
+func (s *Store) Prepare(tcausal clock.VectorClock, txn PreparedTxn) (err error, currentClock clock.VectorClock) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.copyClock(&currentClock)
+
+	if err = validTxn(txn.Writes); err != nil {
+		return
+	}
+	if err = s.waitUntilCurrent(tcausal); err != nil {
+		return
+	}
+	if _, ok := s.prepared[txn.ID]; ok {
+		return
+	}
+	for _, w := range txn.Writes {
+		if err = s.checkLock(w.Key); err != nil {
+			return
+		}
+	}
+
+	writes := make([]Entry, len(txn.Writes))
+	for i, w := range txn.Writes {
+		writes[i] = Entry{Key: w.Key, Value: w.Value, Deleted: w.Deleted}
+	}
+	txn.Writes = writes
+	if s.wal != nil {
+		if err = s.wal.append(walRecord{Op: opPrepare, TxnID: txn.ID, Node: txn.Coordinator, Entries: writes}); err != nil {
+			log.Printf("Failed to log prepare of %s: %v\n", txn.ID, err)
+			return
+		}
+	}
+	s.vc.Max(tcausal)
+	s.prepare(txn, time.Now())
+	log.Printf("Prepared transaction %s of %d keys\n", txn.ID, len(writes))
+	return
+}
+
+// CommitPrepared commits a prepared transaction as one event, like Transact.
+// Committing a transaction again is a no-op, as is committing one this node
+// decided itself. Any other transaction that is not prepared fails with
+// ErrUnknownTxn: its writes were lost, and acking the commit would break the
+// transaction's atomicity.
+func (s *Store) CommitPrepared(id string) (err error, currentClock clock.VectorClock) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.copyClock(&currentClock)
+
+	txn, ok := s.prepared[id]
+	if !ok {
+		if _, decided := s.decisions[id]; !decided && !s.hasCommitted(id) {
+			err = ErrUnknownTxn
+		}
+		return
+	}
+
+	writes := make([]Entry, len(txn.Writes))
+	for i, w := range txn.Writes {
+		s.version = s.version.Next()
+		writes[i] = Entry{Key: w.Key, Value: w.Value, Deleted: w.Deleted, Version: s.version}
+	}
+	s.version = s.version.Next()
+	if _, err = s.commitWrite(Entry{Version: s.version, Txn: writes, TxnID: id}, fromLocal); err != nil {
+		return
+	}
+	s.remember(id)
+	s.resolve(id)
+	log.Printf("Committed prepared transaction %s\n", id)
+	return
+}
+
+// AbortPrepared forgets a prepared transaction without writing anything.
+func (s *Store) AbortPrepared(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.prepared[id]; !ok {
+		return nil
+	}
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Op: opAbort, TxnID: id}); err != nil {
+			log.Printf("Failed to log abort of %s: %v\n", id, err)
+			return err
+		}
+	}
+	s.resolve(id)
+	log.Printf("Aborted prepared transaction %s\n", id)
+	return nil
+}
+
+// InDoubt returns the transactions that were prepared before a time and are
+// still waiting on their coordinator.
+func (s *Store) InDoubt(before time.Time) []PreparedTxn {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var txns []PreparedTxn
+	for _, txn := range s.prepared {
+		if txn.Prepared.Before(before) {
+			txns = append(txns, txn)
+		}
+	}
+	return txns
+}
+
+// Decide durably records that a transaction across shards commits. Until it
+// is forgotten, the decision is what the coordinator answers participants
+// that ask about the transaction.
+func (s *Store) Decide(d Decision) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Op: opDecide, TxnID: d.ID, Keys: d.Participants}); err != nil {
+			log.Printf("Failed to log decision of %s: %v\n", d.ID, err)
+			return err
+		}
+	}
+	s.decisions[d.ID] = d.Participants
+	return nil
+}
+
+// Forget drops the decision for a transaction every participant has applied.
+func (s *Store) Forget(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.decisions[id]; !ok {
+		return nil
+	}
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Op: opForget, TxnID: id}); err != nil {
+			log.Printf("Failed to log forgetting %s: %v\n", id, err)
+			return err
+		}
+	}
+	delete(s.decisions, id)
+	return nil
+}
+
+// Decided returns true if the transaction was decided to commit and not yet
+// forgotten.
+func (s *Store) Decided(id string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, ok := s.decisions[id]
+	return ok
+}
+
+// Decisions returns every decision not yet forgotten.
+func (s *Store) Decisions() []Decision {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.allDecisions()
+}
+
+func (s *Store) allDecisions() []Decision {
+	var decisions []Decision
+	for id, participants := range s.decisions {
+		decisions = append(decisions, Decision{ID: id, Participants: participants})
+	}
+	return decisions
+}
+
+func (s *Store) allPrepared() []PreparedTxn {
+	var txns []PreparedTxn
+	for _, txn := range s.prepared {
+		txns = append(txns, txn)
+	}
+	return txns
+}
+
+// prepare records a prepared transaction and locks its keys.
+func (s *Store) prepare(txn PreparedTxn, now time.Time) {
+	txn.Prepared = now
+	s.prepared[txn.ID] = txn
+	for _, w := range txn.Writes {
+		s.locks[w.Key] = txn.ID
+	}
+}
+
+// resolve forgets a prepared transaction and unlocks its keys.
+// remember records that this node committed its part of a transaction,
+// forgetting the oldest beyond MAX_COMMITTED_TXNS.
+func (s *Store) remember(id string) {
+	s.committed = append(s.committed, id)
+	if n := len(s.committed) - MAX_COMMITTED_TXNS; n > 0 {
+		s.committed = append([]string(nil), s.committed[n:]...)
+	}
+}
+
+// hasCommitted returns true if this node remembers committing its part of a
+// transaction.
+func (s *Store) hasCommitted(id string) bool {
+	for i := len(s.committed) - 1; i >= 0; i-- {
+		if s.committed[i] == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) resolve(id string) {
+	txn, ok := s.prepared[id]
+	if !ok {
+		return
+	}
+	for _, w := range txn.Writes {
+		if s.locks[w.Key] == id {
+			delete(s.locks, w.Key)
+		}
+	}
+	delete(s.prepared, id)
+}
+
+// checkLock returns ErrKeyLocked if a prepared transaction holds key.
+func (s *Store) checkLock(key string) error {
+	if _, locked := s.locks[key]; locked {
+		return ErrKeyLocked
+	}
+	return nil
+}
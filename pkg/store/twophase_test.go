@@ -0,0 +1,119 @@
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+func TestPrepare(t *testing.T) {
+	journal := make(chan Entry, 10)
+	s := New(Alice, []string{Alice}, journal)
+
+	txn := PreparedTxn{ID: "t1", Coordinator: Bob, Writes: []Entry{
+		{Key: "x", Value: "1"},
+		{Key: "y", Deleted: true},
+	}}
+	if err, _ := s.Prepare(clock.VectorClock{}, txn); err != nil {
+		t.Fatalf("Failed to prepare: %v", err)
+	}
+
+	// Prepared keys cannot be written by anyone else.
+	if err, _, _ := s.Write(clock.VectorClock{}, "x", "2"); err != ErrKeyLocked {
+		t.Errorf("Got %v writing a locked key, wanted %v", err, ErrKeyLocked)
+	}
+	if err, _ := s.Prepare(clock.VectorClock{}, PreparedTxn{ID: "t2", Writes: []Entry{{Key: "y", Value: "1"}}}); err != ErrKeyLocked {
+		t.Errorf("Got %v preparing a locked key, wanted %v", err, ErrKeyLocked)
+	}
+	if _, _, ok, _ := s.Read(clock.VectorClock{}, "x"); ok {
+		t.Errorf("Prepared write is visible before commit")
+	}
+
+	if err, _ := s.CommitPrepared("t1"); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	if e := <-journal; e.TxnID != "t1" || len(e.Txn) != 2 {
+		t.Errorf("Journaled %+v, wanted the transaction", e)
+	}
+	shouldRead(t, s, clock.VectorClock{}, "x", "1")
+	if err, _, _ := s.Write(clock.VectorClock{}, "x", "2"); err != nil {
+		t.Errorf("Key is still locked after commit: %v", err)
+	}
+
+	// Committing again is a no-op.
+	if err, _ := s.CommitPrepared("t1"); err != nil {
+		t.Errorf("Failed to commit twice: %v", err)
+	}
+	shouldRead(t, s, clock.VectorClock{}, "x", "2")
+
+	// A transaction this node never prepared was lost, unless it decided it.
+	if err, _ := s.CommitPrepared("lost"); err != ErrUnknownTxn {
+		t.Errorf("Got %v committing an unknown transaction, wanted %v", err, ErrUnknownTxn)
+	}
+	s.Decide(Decision{ID: "mine", Participants: []string{Alice}})
+	if err, _ := s.CommitPrepared("mine"); err != nil {
+		t.Errorf("Failed to commit a decided transaction: %v", err)
+	}
+
+	s.Prepare(clock.VectorClock{}, PreparedTxn{ID: "t3", Writes: []Entry{{Key: "x", Value: "3"}}})
+	if err := s.AbortPrepared("t3"); err != nil {
+		t.Fatalf("Failed to abort: %v", err)
+	}
+	shouldRead(t, s, clock.VectorClock{}, "x", "2")
+	if err, _, _ := s.Write(clock.VectorClock{}, "x", "4"); err != nil {
+		t.Errorf("Key is still locked after abort: %v", err)
+	}
+}
+
+func TestPrepareRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := mustOpen(t, dir, Options{})
+	s.Prepare(clock.VectorClock{}, PreparedTxn{ID: "t1", Coordinator: Bob, Writes: []Entry{{Key: "x", Value: "1"}}})
+	s.Prepare(clock.VectorClock{}, PreparedTxn{ID: "t2", Coordinator: Bob, Writes: []Entry{{Key: "y", Value: "2"}}})
+	s.Decide(Decision{ID: "t3", Participants: []string{Alice, Bob}})
+	s.Decide(Decision{ID: "t4", Participants: []string{Bob}})
+	s.Forget("t4")
+	s.Write(clock.VectorClock{}, "z", "3")
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("Failed to snapshot: %v", err)
+	}
+	s.AbortPrepared("t2")
+	s.Close()
+
+	s = mustOpen(t, dir, Options{})
+	defer func() { s.Close() }()
+	inDoubt := s.InDoubt(time.Now().Add(time.Minute))
+	if len(inDoubt) != 1 || inDoubt[0].ID != "t1" || inDoubt[0].Coordinator != Bob {
+		t.Errorf("Recovered %+v in doubt, wanted t1", inDoubt)
+	}
+	if err, _, _ := s.Write(clock.VectorClock{}, "x", "2"); err != ErrKeyLocked {
+		t.Errorf("Got %v writing a recovered locked key, wanted %v", err, ErrKeyLocked)
+	}
+	if !s.Decided("t3") || s.Decided("t4") {
+		t.Errorf("Recovered decisions %+v, wanted t3", s.Decisions())
+	}
+
+	if err, _ := s.CommitPrepared("t1"); err != nil {
+		t.Fatalf("Failed to commit recovered transaction: %v", err)
+	}
+	shouldRead(t, s, clock.VectorClock{}, "x", "1")
+
+	// The commit is remembered across a restart, from the log and from a
+	// snapshot.
+	for _, snapshot := range []bool{false, true} {
+		if snapshot {
+			if err := s.Snapshot(); err != nil {
+				t.Fatalf("Failed to snapshot: %v", err)
+			}
+		}
+		s.Close()
+		s = mustOpen(t, dir, Options{})
+		if err, _ := s.CommitPrepared("t1"); err != nil {
+			t.Errorf("Failed to commit again after recovery (snapshot %v): %v", snapshot, err)
+		}
+	}
+}
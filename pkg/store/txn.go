@@ -0,0 +1,108 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+var (
+	ErrInvalidTxn = errors.New("Transaction is invalid")
+)
+
+// Transact writes and deletes several keys as one event. Readers of this
+// store, and of every replica it is gossiped to, see either all of the writes
+// or none of them. Each write is an Entry with a key and either a value or
+// Deleted set. It returns whether each key was replaced or deleted.
+//
+// Every key must belong to this store's shard; the store cannot tell, so the
+// caller must check.
+func (s *Store) Transact(tcausal clock.VectorClock, writes []Entry) (
+	err error,
+	replaced []bool,
+	currentClock clock.VectorClock) {
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.copyClock(&currentClock)
+
+	if err = validTxn(writes); err != nil || len(writes) == 0 {
+		return
+	}
+
+	if err = s.waitUntilCurrent(tcausal); err != nil {
+		return
+	}
+	for _, w := range writes {
+		if err = s.checkLock(w.Key); err != nil {
+			return
+		}
+	}
+
+	now := time.Now()
+	s.vc.Max(tcausal)
+	txn := make([]Entry, len(writes))
+	replaced = make([]bool, len(writes))
+	for i, w := range writes {
+		current, exists, gerr := s.store.Get(w.Key)
+		if gerr != nil {
+			return gerr, nil, currentClock
+		}
+		replaced[i] = exists && !current.Deleted && !current.expired(now)
+
+		s.version = s.version.Next()
+		txn[i] = Entry{
+			Key:     w.Key,
+			Value:   w.Value,
+			Deleted: w.Deleted,
+			Version: s.version,
+		}
+		if txn[i].Siblings, err = s.survivors(w.Key, tcausal); err != nil {
+			return err, nil, currentClock
+		}
+	}
+
+	s.version = s.version.Next()
+	_, err = s.commitWrite(Entry{Version: s.version, Txn: txn}, fromLocal)
+	return
+}
+
+// validTxn returns ErrInvalidTxn unless every write has a key that no other
+// write has, and either a value or Deleted set.
+func validTxn(writes []Entry) error {
+	seen := make(map[string]bool, len(writes))
+	for _, w := range writes {
+		if w.Key == "" || seen[w.Key] || (!w.Deleted && w.Value == "") {
+			return ErrInvalidTxn
+		}
+		seen[w.Key] = true
+	}
+	return nil
+}
+
+// members returns the entries an entry writes: those of its transaction, or
+// the entry itself. Members without a clock of their own were written at the
+// transaction's clock, which is not repeated for each of them.
+func (e Entry) members() []Entry {
+	if e.Txn == nil {
+		return []Entry{e}
+	}
+	members := make([]Entry, len(e.Txn))
+	for i, m := range e.Txn {
+		if m.Clock == nil {
+			m.Clock = e.Clock.Copy()
+		}
+		members[i] = m
+	}
+	return members
+}
+
+// describe names an entry in logs.
+func (e Entry) describe() string {
+	if e.Txn != nil {
+		return fmt.Sprintf("transaction of %d keys", len(e.Txn))
+	}
+	return fmt.Sprintf("%q", e.Key)
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTransact(t *testing.T) {
+	journal := make(chan Entry, 1)
+	alice := New(Alice, []string{Alice, Bob}, journal)
+	bob := New(Bob, []string{Alice, Bob}, NopJournal())
+
+	alice.Write(clock.VectorClock{}, "x", "0")
+	bob.ImportEntry(<-journal)
+
+	err, replaced, vc := alice.Transact(clock.VectorClock{}, []Entry{
+		{Key: "x", Value: "1"},
+		{Key: "y", Value: "2"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+	if diff := cmp.Diff(replaced, []bool{true, false}); diff != "" {
+		t.Errorf("Bad replaced (-got,+want): %s", diff)
+	}
+	// The whole transaction is one event.
+	if diff := cmp.Diff(vc, clock.VectorClock{Alice: 2}); diff != "" {
+		t.Errorf("Bad clock (-got,+want): %s", diff)
+	}
+
+	txn := <-journal
+	if len(txn.Txn) != 2 {
+		t.Fatalf("Journaled %d entries in the transaction, wanted 2", len(txn.Txn))
+	}
+	// The members share the transaction's clock rather than each carrying it.
+	for _, m := range txn.Txn {
+		if m.Clock != nil {
+			t.Errorf("Member %q carries its own clock %v", m.Key, m.Clock)
+		}
+	}
+	if imported, err := bob.ImportEntry(txn); err != nil || !imported {
+		t.Fatalf("Failed to import transaction: %t, %v", imported, err)
+	}
+	shouldRead(t, bob, vc, "x", "1")
+	shouldRead(t, bob, vc, "y", "2")
+
+	// Importing it again is a no-op.
+	if imported, _ := bob.ImportEntry(txn); !imported {
+		t.Errorf("Duplicate transaction was not acknowledged")
+	}
+
+	err, replaced, _ = alice.Transact(vc, []Entry{{Key: "x", Deleted: true}})
+	if err != nil || !replaced[0] {
+		t.Errorf("Failed to delete in a transaction: %v", err)
+	}
+	if _, _, ok, _ := alice.Read(clock.VectorClock{}, "x"); ok {
+		t.Errorf("Key x was not deleted")
+	}
+
+	for _, writes := range [][]Entry{
+		{{Key: "z", Value: "1"}, {Key: "z", Value: "2"}},
+		{{Key: "z"}},
+		{{Value: "1"}},
+	} {
+		if err, _, _ := alice.Transact(clock.VectorClock{}, writes); err != ErrInvalidTxn {
+			t.Errorf("Got %v for %v, wanted %v", err, writes, ErrInvalidTxn)
+		}
+	}
+}
+
+func TestTransactRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := mustOpen(t, dir, Options{})
+	s.Transact(clock.VectorClock{}, []Entry{
+		{Key: "x", Value: "1"},
+		{Key: "y", Value: "2"},
+	})
+	s.Close()
+
+	s = mustOpen(t, dir, Options{})
+	defer s.Close()
+	shouldRead(t, s, clock.VectorClock{}, "x", "1")
+	shouldRead(t, s, clock.VectorClock{}, "y", "2")
+	if diff := cmp.Diff(s.Clock(), clock.VectorClock{Alice: 1}); diff != "" {
+		t.Errorf("Recovered bad clock (-got,+want): %s", diff)
+	}
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/crdt"
+)
+
+var (
+	ErrWrongType = errors.New("Key holds a value of another type")
+)
+
+// Update applies an operation to the typed value of a key. If the key does
+// not exist, it is created as the empty value of the given kind first. It
+// fails with ErrWrongType if the key holds a plain value.
+//
+// Typed values never have siblings. The update merges every version of the
+// value this replica holds, and replicas merge each other's updates when they
+// import them.
+func (s *Store) Update(tcausal clock.VectorClock, key string, kind crdt.Kind, op crdt.Op) (
+	err error,
+	value crdt.Value,
+	currentClock clock.VectorClock) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.copyClock(&currentClock)
+
+	if err = s.waitUntilCurrent(tcausal); err != nil {
+		return
+	}
+	if err = s.checkLock(key); err != nil {
+		return
+	}
+	current, exists, err := s.store.Get(key)
+	if err != nil {
+		return
+	}
+
+	base, err := crdt.New(kind)
+	if exists && !current.Deleted && !current.expired(time.Now()) {
+		if current.CRDT == nil {
+			err = ErrWrongType
+			return
+		}
+		base, err = current.value()
+	}
+	if err != nil {
+		return
+	}
+
+	s.vc.Max(tcausal)
+	s.version = s.version.Next()
+	e := Entry{Key: key, Version: s.version, Timestamp: s.hlc.Now()}
+	value, err = base.Apply(op, crdt.Origin{Node: s.addr, Timestamp: e.Timestamp, Version: e.Version})
+	if err != nil {
+		return
+	}
+	e.setValue(value)
+	_, err = s.commitWrite(e, fromLocal)
+	return
+}
+
+// value returns the merge of every typed version of an entry.
+func (e Entry) value() (crdt.Value, error) {
+	v := e.CRDT.Copy()
+	for _, s := range e.Siblings {
+		if s.CRDT == nil || s.CRDT.Kind != v.Kind {
+			continue
+		}
+		merged, err := v.Merge(*s.CRDT)
+		if err != nil {
+			return crdt.Value{}, err
+		}
+		v = merged
+	}
+	return v, nil
+}
+
+// setValue sets the typed value of an entry, and its value as clients read it.
+func (e *Entry) setValue(v crdt.Value) {
+	e.CRDT = &v
+	e.Value = v.String()
+}
+
+// mergeValue merges a typed value gossiped from another replica into the one
+// we have for its key. It returns false if there is nothing to merge it with,
+// in which case the entry is imported like any other.
+func (s *Store) mergeValue(e Entry) (Entry, bool, error) {
+	existing, ok, err := s.store.Get(e.Key)
+	if err != nil || !ok {
+		return e, false, err
+	}
+	if existing.Deleted || existing.CRDT == nil || len(existing.Siblings) > 0 || existing.CRDT.Kind != e.CRDT.Kind {
+		return e, false, nil
+	}
+
+	v, err := existing.CRDT.Merge(*e.CRDT)
+	if err != nil {
+		return e, false, err
+	}
+	merged := e.written()
+	merged.setValue(v)
+	merged.Clock = existing.Clock.Copy()
+	merged.Clock.Max(e.Clock.Copy())
+	if merged.DVV != nil {
+		// The merged version includes both.
+		seen := merged.DVV.Context.Copy()
+		seen.Max(existing.Context().Copy())
+		merged.DVV = &clock.DVV{Dot: merged.DVV.Dot, Context: seen}
+	}
+	if existing.Timestamp.Compare(merged.Timestamp) == clock.Greater {
+		merged.Timestamp = existing.Timestamp
+	}
+	return merged, true, nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/crdt"
+)
+
+func TestUpdate(t *testing.T) {
+	t.Run("concurrent increments merge", func(t *testing.T) {
+		aj, bj := make(chan Entry, 10), make(chan Entry, 10)
+		a := New(Alice, []string{Alice, Bob}, aj)
+		b := New(Bob, []string{Alice, Bob}, bj)
+
+		a.Update(clock.VectorClock{}, "n", crdt.PNCounter, crdt.Op{Amount: 2})
+		a.Update(clock.VectorClock{}, "n", crdt.PNCounter, crdt.Op{Amount: 3})
+		b.Update(clock.VectorClock{}, "n", crdt.PNCounter, crdt.Op{Amount: -1})
+
+		b.ImportEntry(<-aj)
+		b.ImportEntry(<-aj)
+		a.ImportEntry(<-bj)
+
+		shouldRead(t, a, clock.VectorClock{}, "n", "4")
+		shouldRead(t, b, clock.VectorClock{}, "n", "4")
+	})
+
+	t.Run("set adds and removes merge", func(t *testing.T) {
+		aj, bj := make(chan Entry, 10), make(chan Entry, 10)
+		a := New(Alice, []string{Alice, Bob}, aj)
+		b := New(Bob, []string{Alice, Bob}, bj)
+
+		a.Update(clock.VectorClock{}, "s", crdt.ORSet, crdt.Op{Add: []string{"x", "y"}})
+		b.ImportEntry(<-aj)
+		a.Update(clock.VectorClock{}, "s", crdt.ORSet, crdt.Op{Remove: []string{"x"}})
+		b.Update(clock.VectorClock{}, "s", crdt.ORSet, crdt.Op{Add: []string{"z"}})
+		b.ImportEntry(<-aj)
+		a.ImportEntry(<-bj)
+
+		shouldRead(t, a, clock.VectorClock{}, "s", `["y","z"]`)
+		shouldRead(t, b, clock.VectorClock{}, "s", `["y","z"]`)
+	})
+
+	t.Run("plain values are not typed", func(t *testing.T) {
+		s := New(Alice, []string{Alice}, NopJournal())
+		s.Write(clock.VectorClock{}, "x", "a")
+		if err, _, _ := s.Update(clock.VectorClock{}, "x", crdt.PNCounter, crdt.Op{Amount: 1}); !errors.Is(err, ErrWrongType) {
+			t.Errorf("Got %v updating a plain value, wanted ErrWrongType", err)
+		}
+		s.Update(clock.VectorClock{}, "n", crdt.GCounter, crdt.Op{Amount: 1})
+		if err, _, _ := s.Update(clock.VectorClock{}, "n", crdt.PNCounter, crdt.Op{Amount: -1}); !errors.Is(err, crdt.ErrBadOp) {
+			t.Errorf("Got %v decrementing a G-counter, wanted ErrBadOp", err)
+		}
+	})
+}
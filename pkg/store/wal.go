@@ -0,0 +1,386 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+const (
+	walPrefix = "wal-"
+	walSuffix = ".log"
+)
+
+// SyncPolicy describes when the write-ahead log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways issues an fsync after every record.
+	SyncAlways SyncPolicy = iota
+	// SyncBatch issues an fsync after every SyncBatch records.
+	SyncBatch
+	// SyncInterval issues an fsync every SyncInterval if anything was written.
+	SyncInterval
+)
+
+// ParseSyncPolicy parses "always", "batch", or "interval".
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "interval":
+		return SyncInterval, nil
+	}
+	return SyncAlways, fmt.Errorf("unknown sync policy %q", s)
+}
+
+// walOp is the kind of mutation a log record describes.
+type walOp int
+
+const (
+	// opCommit records an entry committed by commitWrite.
+	opCommit walOp = iota + 1
+	// opBump records other nodes processing events of ours.
+	opBump
+	// opReset records the store being replaced wholesale by a view change.
+	opReset
+	// The op that merged a peer's whole state is no longer written, and its
+	// number is kept so that the ops after it keep theirs.
+	_
+	// opPurge records tombstones collected once every replica saw them.
+	opPurge
+	// opPrepare records a promise to commit part of a transaction across
+	// shards, and opAbort records the promise being released.
+	opPrepare
+	opAbort
+	// opDecide records that a transaction this node coordinated commits, and
+	// opForget records that every participant has committed it.
+	opDecide
+	opForget
+	// opPrune records the nodes that remain in the view once a view change
+	// completes, in Keys.
+	opPrune
+	// opSeen records a clock every write of which the store has, though no
+	// commit carried it: that of a peer once a sync from it finished, or of
+	// a write whose gossip arrived after a repair brought the write.
+	opSeen
+)
+
+// walRecord is a single mutation of the store as written to the log.
+type walRecord struct {
+	Op      walOp             `json:"op"`
+	Entry   *Entry            `json:"entry,omitempty"`
+	Node    string            `json:"node,omitempty"`
+	Entries []Entry           `json:"entries,omitempty"`
+	Keys    []string          `json:"keys,omitempty"`
+	Clock   clock.VectorClock `json:"clock,omitempty"`
+	TxnID   string            `json:"txn-id,omitempty"`
+
+	// Counts has the events a bump counts on each node. Older bumps count
+	// one on Node instead.
+	Counts map[string]uint64 `json:"counts,omitempty"`
+
+	// Seq numbers the first change a commit makes to the change log.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// wal is an append-only log of every mutation to a store. The log is split
+// into numbered segments so that segments covered by a snapshot can be
+// removed.
+type wal struct {
+	dir      string
+	seg      int64
+	f        file
+	policy   SyncPolicy
+	batch    int
+	interval time.Duration
+
+	m       sync.Mutex
+	size    int64
+	pending int
+	done    chan struct{}
+
+	// broken is set if a failed append could not be taken back out of the
+	// segment. Every later append fails with it rather than land behind a
+	// torn record.
+	broken error
+}
+
+// openWAL opens the log in dir, starting from segment first. Every intact
+// record is passed to apply in order. A torn or corrupt record at the tail of
+// the last segment is assumed to be the casualty of a crash and is truncated
+// away.
+func openWAL(dir string, first int64, opts Options, apply func(walRecord) error) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segs, err := listSegments(dir, walPrefix, walSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replay every segment the snapshot does not already cover.
+	last := first
+	var good int64
+	records := 0
+	for i, seg := range segs {
+		if seg < first {
+			continue
+		}
+		tail := i == len(segs)-1
+		n, off, err := replaySegment(segmentPath(dir, walPrefix, seg, walSuffix), tail, apply)
+		if err != nil {
+			return nil, err
+		}
+		records += n
+		last, good = seg, off
+	}
+	log.Printf("Replayed %d records from the write-ahead log\n", records)
+
+	f, err := os.OpenFile(segmentPath(dir, walPrefix, last, walSuffix), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop anything after the last intact record and continue from there.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	w := &wal{
+		dir:      dir,
+		seg:      last,
+		f:        f,
+		policy:   opts.Sync,
+		batch:    opts.SyncBatch,
+		interval: opts.SyncInterval,
+		size:     good,
+		done:     make(chan struct{}),
+	}
+	if w.batch <= 0 {
+		w.batch = 1
+	}
+	if w.policy == SyncInterval {
+		if w.interval <= 0 {
+			w.interval = time.Second
+		}
+		go w.syncEvery(w.interval)
+	}
+	return w, nil
+}
+
+// replaySegment applies every intact record in a segment and returns how many
+// there were and the offset just past the last one. Only the tail segment may
+// end in a bad record; anywhere else that means records were lost.
+func replaySegment(path string, tail bool, apply func(walRecord) error) (int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	records := 0
+	for {
+		var rec walRecord
+		n, err := readRecord(f, &rec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if !tail {
+				return records, offset, fmt.Errorf("%s: bad record at offset %d: %w", path, offset, err)
+			}
+			log.Printf("Write-ahead log has a bad record at offset %d (%v), truncating\n", offset, err)
+			break
+		}
+		if err := apply(rec); err != nil {
+			return records, offset, fmt.Errorf("%s: failed to apply record at offset %d: %w", path, offset, err)
+		}
+		offset += int64(n)
+		records++
+	}
+	return records, offset, nil
+}
+
+// append writes a record to the log, syncing according to the policy. A
+// record that could not be written or synced is taken back out of the log, so
+// that it is not replayed and the records after it are not lost behind it.
+func (w *wal) append(rec walRecord) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.broken != nil {
+		return w.broken
+	}
+
+	n, err := writeRecord(w.f, &rec)
+	if err == nil {
+		w.pending++
+		switch w.policy {
+		case SyncAlways:
+			err = w.sync()
+		case SyncBatch:
+			if w.pending >= w.batch {
+				err = w.sync()
+			}
+		}
+		if err != nil {
+			w.pending--
+		}
+	}
+	if err != nil {
+		if rerr := w.rewind(); rerr != nil {
+			log.Println("Failed to take a failed record back out of the write-ahead log:", rerr)
+			w.broken = fmt.Errorf("write-ahead log has a torn record: %w", rerr)
+		}
+		return err
+	}
+	w.size += int64(n)
+	return nil
+}
+
+// rewind drops anything written to the segment since the last record that
+// was appended. w.m must be held.
+func (w *wal) rewind() error {
+	if err := w.f.Truncate(w.size); err != nil {
+		return err
+	}
+	_, err := w.f.Seek(w.size, io.SeekStart)
+	return err
+}
+
+// rotate seals the current segment and starts appending to a new one. It
+// returns the number of the new segment; every record before it lives in an
+// older segment.
+func (w *wal) rotate() (int64, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(segmentPath(w.dir, walPrefix, w.seg+1, walSuffix), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.f.Close(); err != nil {
+		log.Println("Failed to close sealed log segment:", err)
+	}
+	w.f = f
+	w.seg++
+	w.size = 0
+	return w.seg, nil
+}
+
+// isEmpty returns true if nothing was written since the last rotation.
+func (w *wal) isEmpty() bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.size == 0
+}
+
+// removeBefore deletes every segment older than seg.
+func (w *wal) removeBefore(seg int64) error {
+	segs, err := listSegments(w.dir, walPrefix, walSuffix)
+	if err != nil {
+		return err
+	}
+	for _, old := range segs {
+		if old >= seg {
+			break
+		}
+		if err := os.Remove(segmentPath(w.dir, walPrefix, old, walSuffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync flushes pending records. w.m must be held.
+func (w *wal) sync() error {
+	if w.pending == 0 {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.pending = 0
+	return nil
+}
+
+func (w *wal) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.m.Lock()
+			if err := w.sync(); err != nil {
+				log.Println("Failed to sync write-ahead log:", err)
+			}
+			w.m.Unlock()
+		}
+	}
+}
+
+// close flushes and closes the log.
+func (w *wal) close() error {
+	if w.policy == SyncInterval {
+		close(w.done)
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err := w.sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// segmentPath names a numbered file in dir.
+func segmentPath(dir, prefix string, seg int64, suffix string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d%s", prefix, seg, suffix))
+}
+
+// listSegments returns the numbers of the files in dir named like segmentPath,
+// in ascending order.
+func listSegments(dir, prefix, suffix string) ([]int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []int64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		var seg int64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), "%d", &seg); err != nil {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
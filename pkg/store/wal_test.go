@@ -0,0 +1,201 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %v", err)
+	}
+	return dir
+}
+
+// errInjected is the error a faultyFile fails with.
+var errInjected = errors.New("injected failure")
+
+// faultyFile fails one read, write or sync. Reads, writes and syncs are how
+// many more of each succeed before one fails, or negative if they all do. A
+// failed write writes half of what it was given first.
+type faultyFile struct {
+	*os.File
+	reads, writes, syncs int
+}
+
+func (f *faultyFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.reads != 0 {
+		f.reads--
+		return f.File.ReadAt(b, off)
+	}
+	f.reads--
+	return 0, errInjected
+}
+
+func (f *faultyFile) Write(b []byte) (int, error) {
+	if f.writes != 0 {
+		f.writes--
+		return f.File.Write(b)
+	}
+	f.writes--
+	n, _ := f.File.Write(b[:len(b)/2])
+	return n, errInjected
+}
+
+func (f *faultyFile) Sync() error {
+	if f.syncs != 0 {
+		f.syncs--
+		return f.File.Sync()
+	}
+	f.syncs--
+	return errInjected
+}
+
+func mustOpen(t *testing.T, dir string, opts Options) *Store {
+	t.Helper()
+	opts.Dir = dir
+	s, err := Open(Alice, []string{Alice, Bob}, NopJournal(), opts)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	return s
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	t.Run("recovers entries and clock", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{})
+		s.Write(clock.VectorClock{}, "x", "1")
+		s.Write(clock.VectorClock{}, "y", "2")
+		s.Delete(clock.VectorClock{}, "x")
+		if _, err := s.ImportEntry(Entry{
+			Key:   "z",
+			Value: "3",
+			Clock: clock.VectorClock{Bob: 1},
+		}); err != nil {
+			t.Fatalf("Failed to import z: %v", err)
+		}
+		s.BumpClockForNodes(map[string]uint64{Bob: 2})
+		want := s.Clock()
+		if err := s.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+
+		s = mustOpen(t, dir, Options{})
+		defer s.Close()
+		if diff := cmp.Diff(s.Clock(), want); diff != "" {
+			t.Errorf("Recovered bad clock (-got,+want): %s", diff)
+		}
+		shouldRead(t, s, clock.VectorClock{}, "y", "2")
+		shouldRead(t, s, clock.VectorClock{}, "z", "3")
+		if _, _, ok, _ := s.Read(clock.VectorClock{}, "x"); ok {
+			t.Errorf("Deleted key x came back after recovery")
+		}
+
+		// Versions issued after recovery must not collide with old ones.
+		_, old, _, _ := s.Read(clock.VectorClock{}, "y")
+		s.Write(clock.VectorClock{}, "y", "4")
+		_, fresh, _, _ := s.Read(clock.VectorClock{}, "y")
+		if fresh.Version.Seq <= old.Version.Seq {
+			t.Errorf("Reused version %v after recovery (old was %v)", fresh.Version, old.Version)
+		}
+	})
+
+	t.Run("tolerates a torn last record", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{Sync: SyncBatch, SyncBatch: 10})
+		s.Write(clock.VectorClock{}, "x", "1")
+		s.Write(clock.VectorClock{}, "y", "2")
+		s.Close()
+
+		// Simulate a crash halfway through writing a record.
+		f, err := os.OpenFile(segmentPath(dir, walPrefix, 0, walSuffix), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open log: %v", err)
+		}
+		f.Write([]byte{0xff, 0x00, 0x00, 0x00, 0x12, 0x34})
+		f.Close()
+
+		s = mustOpen(t, dir, Options{})
+		shouldRead(t, s, clock.VectorClock{}, "x", "1")
+		shouldRead(t, s, clock.VectorClock{}, "y", "2")
+
+		// The log must still be appendable after the torn record is dropped.
+		s.Write(clock.VectorClock{}, "z", "3")
+		s.Close()
+
+		s = mustOpen(t, dir, Options{Sync: SyncInterval})
+		defer s.Close()
+		shouldRead(t, s, clock.VectorClock{}, "z", "3")
+		if diff := cmp.Diff(s.Clock(), clock.VectorClock{Alice: 3}); diff != "" {
+			t.Errorf("Recovered bad clock (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("takes back records it failed to write", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{Sync: SyncAlways})
+		s.Write(clock.VectorClock{}, "x", "1")
+
+		// One write is torn halfway, and one record fails to sync.
+		faulty := &faultyFile{File: s.wal.f.(*os.File), reads: -1, writes: 0, syncs: -1}
+		s.wal.f = faulty
+		if err, _, _ := s.Write(clock.VectorClock{}, "y", "2"); err == nil {
+			t.Errorf("Wrote y without logging it")
+		}
+		faulty.syncs = 0
+		if err, _, _ := s.Write(clock.VectorClock{}, "y", "3"); err == nil {
+			t.Errorf("Wrote y without syncing it")
+		}
+		s.Write(clock.VectorClock{}, "z", "4")
+		s.Close()
+
+		s = mustOpen(t, dir, Options{})
+		defer s.Close()
+		shouldRead(t, s, clock.VectorClock{}, "x", "1")
+		shouldRead(t, s, clock.VectorClock{}, "z", "4")
+		if _, _, ok, _ := s.Read(clock.VectorClock{}, "y"); ok {
+			t.Errorf("Failed write to y came back after recovery")
+		}
+		if diff := cmp.Diff(s.Clock(), clock.VectorClock{Alice: 2}); diff != "" {
+			t.Errorf("Recovered bad clock (-got,+want): %s", diff)
+		}
+	})
+
+	t.Run("refuses changes it cannot log", func(t *testing.T) {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+
+		s := mustOpen(t, dir, Options{})
+		defer s.Close()
+		s.Write(clock.VectorClock{}, "x", "1")
+		want := s.Clock()
+
+		// Every append fails once the segment is closed under the log.
+		s.wal.f.Close()
+		if err := s.BumpClockForNodes(map[string]uint64{Bob: 2}); err == nil {
+			t.Errorf("Bumped the clock without logging it")
+		}
+		if err := s.ReplaceEntries([]Entry{{Key: "y", Value: "2"}}); err == nil {
+			t.Errorf("Replaced entries without logging it")
+		}
+		if diff := cmp.Diff(s.Clock(), want); diff != "" {
+			t.Errorf("Clock changed (-got,+want): %s", diff)
+		}
+		shouldRead(t, s, clock.VectorClock{}, "x", "1")
+	})
+}
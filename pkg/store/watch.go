@@ -0,0 +1,100 @@
+package store
+
+import (
+	"github.com/spencer-p/key-value-store/pkg/clock"
+)
+
+// WATCH_BUFFER is how many changes a watcher may fall behind by before it is
+// dropped.
+const WATCH_BUFFER = 256
+
+// Watcher receives every change committed to a range of keys, whether it was
+// written here or imported from another replica. Its channel is closed when it
+// is stopped, or if it falls too far behind; a watcher that is dropped can
+// resume by watching again with the clock of the last change it saw.
+type Watcher struct {
+	C <-chan Entry
+
+	c chan Entry
+	r Range
+}
+
+// Watch starts watching for changes to keys in r. If since is not empty, the
+// current entry of every key in r that since has not seen is sent first, so
+// that a watcher that reconnects misses no key's latest state.
+func (s *Store) Watch(r Range, since clock.VectorClock) *Watcher {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var missed []Entry
+	if len(since) > 0 {
+		seen := since.Subset(s.replicas)
+		for i := s.index.first(r); i < len(s.index.keys); i++ {
+			key := s.index.keys[i]
+			if !r.contains(key) {
+				break
+			}
+			e, ok, err := s.store.Get(key)
+			if err != nil || !ok {
+				continue
+			}
+			switch e.Clock.Subset(s.replicas).Compare(seen) {
+			case clock.Less, clock.Equal:
+				continue
+			}
+			missed = append(missed, e)
+		}
+	}
+
+	c := make(chan Entry, len(missed)+WATCH_BUFFER)
+	for _, e := range missed {
+		c <- e
+	}
+	w := &Watcher{C: c, c: c, r: r}
+	s.watchers[w] = true
+	return w
+}
+
+// Unwatch stops a watcher and closes its channel. Stopping a watcher that was
+// already dropped is a no-op.
+func (s *Store) Unwatch(w *Watcher) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.watchers[w] {
+		delete(s.watchers, w)
+		close(w.c)
+	}
+}
+
+// notify sends a committed entry to every watcher of its key, dropping those
+// that have fallen behind rather than holding up the write.
+func (s *Store) notify(e Entry) {
+	for w := range s.watchers {
+		if !w.r.matches(e.Key) {
+			continue
+		}
+		if !w.send(e) {
+			delete(s.watchers, w)
+		}
+	}
+}
+
+// send queues an entry for the watcher without blocking. If the queue is
+// full, the watcher's channel is closed and false is returned.
+func (w *Watcher) send(e Entry) bool {
+	select {
+	case w.c <- e:
+		return true
+	default:
+		close(w.c)
+		return false
+	}
+}
+
+// matches returns true if key is in r, ignoring its limit.
+func (r Range) matches(key string) bool {
+	if key < r.Start || (r.After != "" && key <= r.After) {
+		return false
+	}
+	return r.contains(key)
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/spencer-p/key-value-store/pkg/clock"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// changes drains the changes a watcher has seen so far.
+func changes(w *Watcher) []string {
+	var got []string
+	for {
+		select {
+		case e, ok := <-w.C:
+			if !ok {
+				return append(got, "closed")
+			}
+			if e.Deleted {
+				got = append(got, e.Key+" deleted")
+			} else {
+				got = append(got, e.Key+"="+e.Value)
+			}
+		default:
+			return got
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := New(Alice, []string{Alice, Bob}, NopJournal())
+	key := s.Watch(Range{Start: "a", End: "a\x00"}, nil)
+	prefix := s.Watch(Range{Prefix: "b"}, nil)
+
+	s.Write(clock.VectorClock{}, "a", "1")
+	s.Write(clock.VectorClock{}, "ab", "2")
+	s.Write(clock.VectorClock{}, "b1", "3")
+	s.Delete(clock.VectorClock{}, "a")
+	s.ImportEntry(Entry{Key: "b2", Value: "4", Clock: clock.VectorClock{Bob: 1}})
+	s.Transact(clock.VectorClock{}, []Entry{{Key: "a", Value: "5"}, {Key: "b3", Value: "6"}})
+
+	if diff := cmp.Diff(changes(key), []string{"a=1", "a deleted", "a=5"}); diff != "" {
+		t.Errorf("Bad changes to key (-got,+want): %s", diff)
+	}
+	if diff := cmp.Diff(changes(prefix), []string{"b1=3", "b2=4", "b3=6"}); diff != "" {
+		t.Errorf("Bad changes to prefix (-got,+want): %s", diff)
+	}
+
+	s.Unwatch(key)
+	s.Write(clock.VectorClock{}, "a", "7")
+	if diff := cmp.Diff(changes(key), []string{"closed"}); diff != "" {
+		t.Errorf("Bad changes after unwatching (-got,+want): %s", diff)
+	}
+	s.Unwatch(prefix)
+}
+
+func TestWatchResume(t *testing.T) {
+	s := New(Alice, []string{Alice}, NopJournal())
+	_, _, seen := s.Write(clock.VectorClock{}, "a", "1")
+	s.Write(clock.VectorClock{}, "b", "2")
+	s.Write(clock.VectorClock{}, "c", "3")
+	s.Delete(clock.VectorClock{}, "c")
+
+	w := s.Watch(Range{}, seen)
+	defer s.Unwatch(w)
+	if diff := cmp.Diff(changes(w), []string{"b=2", "c deleted"}); diff != "" {
+		t.Errorf("Bad changes missed (-got,+want): %s", diff)
+	}
+}
+
+func TestWatchFallsBehind(t *testing.T) {
+	s := New(Alice, []string{Alice}, NopJournal())
+	w := s.Watch(Range{}, nil)
+	for i := 0; i <= WATCH_BUFFER; i++ {
+		s.Write(clock.VectorClock{}, "a", "1")
+	}
+
+	got := changes(w)
+	if len(got) != WATCH_BUFFER+1 || got[len(got)-1] != "closed" {
+		t.Errorf("Got %d changes ending in %q, wanted the watcher to be dropped", len(got), got[len(got)-1])
+	}
+	s.Unwatch(w)
+}
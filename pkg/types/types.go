@@ -1,20 +1,58 @@
 package types
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/spencer-p/key-value-store/pkg/clock"
+	"github.com/spencer-p/key-value-store/pkg/crdt"
 	"github.com/spencer-p/key-value-store/pkg/msg"
+	"github.com/spencer-p/key-value-store/pkg/outbox"
 	"github.com/spencer-p/key-value-store/pkg/store"
+	"github.com/spencer-p/key-value-store/pkg/uuid"
 )
 
 type View struct {
 	Members    []string `json:"view"`
 	ReplFactor int      `json:"repl-factor"`
+
+	// Epoch counts the view changes that led to this view.
+	Epoch uint64 `json:"epoch,omitempty"`
+}
+
+// CAUSAL_CONTEXT_HEADER carries a causal context in the compact encoding of
+// clock.Codec. A request that sends it, even empty, gets its response's
+// causal context in it too instead of in the body.
+const CAUSAL_CONTEXT_HEADER = "X-Causal-Context"
+
+type codecKey struct{}
+
+// WithCodec returns the request with the codec its compact causal contexts
+// are encoded in.
+func WithCodec(r *http.Request, codec clock.Codec) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), codecKey{}, codec))
+}
+
+// viewCodec returns the codec of a request, whether or not it asked for compact
+// causal contexts.
+func viewCodec(r *http.Request) (clock.Codec, bool) {
+	codec, ok := r.Context().Value(codecKey{}).(clock.Codec)
+	return codec, ok
+}
+
+// compactCodec returns the codec of a request that asked for compact causal
+// contexts.
+func compactCodec(r *http.Request) (clock.Codec, bool) {
+	if _, ok := r.Header[CAUSAL_CONTEXT_HEADER]; !ok {
+		return clock.Codec{}, false
+	}
+	return viewCodec(r)
 }
 
 type Response struct {
@@ -28,6 +66,36 @@ type Response struct {
 	Error    string `json:"error,omitempty"`
 	Exists   *bool  `json:"doesExist,omitempty"`
 	Replaced *bool  `json:"replaced,omitempty"`
+	TTL      *int64 `json:"ttl,omitempty"`
+
+	// Version of the value read, for conditional writes
+	Version *uuid.UUID `json:"version,omitempty"`
+
+	// When the value read was written, by the clock of the node that wrote it
+	Timestamp *clock.Timestamp `json:"timestamp,omitempty"`
+
+	// Type of the value, if it is a counter, set or map
+	Type crdt.Kind `json:"type,omitempty"`
+
+	// Every value of a key written concurrently on different replicas
+	Siblings []Sibling `json:"siblings,omitempty"`
+
+	// A page of keys in order, and where the next page starts if there is one
+	Keys   []Entry `json:"keys,omitempty"`
+	Cursor string  `json:"cursor,omitempty"`
+
+	// Shards that could not be reached while answering the request
+	MissingShards []int `json:"missing-shards,omitempty"`
+
+	// Results of a batch, in the order of its operations
+	Results []Result `json:"results,omitempty"`
+
+	// Changes committed by a node, in the order it committed them
+	Changes []store.Change `json:"changes,omitempty"`
+
+	// A transaction across shards and what became of it
+	TxnID     string `json:"txn-id,omitempty"`
+	TxnStatus string `json:"txn-status,omitempty"`
 
 	// Info about the state of shards
 	Shards   interface{} `json:"shards,omitempty"`
@@ -43,6 +111,30 @@ type Response struct {
 
 	// Internal view change data
 	StorageState []store.Entry `json:"state,omitempty"`
+
+	// Merkle tree of a replica's entries, for anti-entropy
+	Tree *store.Tree `json:"tree,omitempty"`
+
+	// Outbound gossip queued for each peer
+	Queues map[string]outbox.Stats `json:"queues,omitempty"`
+
+	// Whether a write was held for a replica that could not be reached, and
+	// the writes held for each such replica
+	Hinted bool                 `json:"hinted,omitempty"`
+	Hints  map[string]HintStats `json:"hints,omitempty"`
+}
+
+// HintStats describes the writes held on behalf of a node while it could not
+// be reached.
+type HintStats struct {
+	// Pending is how many are waiting to be handed off.
+	Pending int `json:"pending"`
+
+	// Stored, Delivered and Dropped count the writes held, those handed off,
+	// and those refused because too many were held or they could not be kept.
+	Stored    uint64 `json:"stored"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
 }
 
 type Shard struct {
@@ -61,6 +153,44 @@ type Input struct {
 
 	// Context the request thinks is current
 	CausalCtx clock.VectorClock `json:"causal-context"`
+
+	// Optional expiry of a write, either as a TTL in seconds or an absolute
+	// time.
+	TTL       *int64     `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires-at,omitempty"`
+
+	// Optional precondition of a write or delete: the version the key must
+	// currently have, or that the key must not exist.
+	Version  *uuid.UUID `json:"version,omitempty"`
+	IfAbsent bool       `json:"if-absent,omitempty"`
+
+	// Updates to a counter, set or map, and the type to create it as if the
+	// key does not exist.
+	Type    crdt.Kind         `json:"type,omitempty"`
+	Amount  *int64            `json:"amount,omitempty"`
+	Members []string          `json:"members,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Names   []string          `json:"names,omitempty"`
+
+	// Operations of a batch request.
+	Operations []Operation `json:"operations,omitempty"`
+
+	// A transaction across shards and the node coordinating it, used
+	// between nodes.
+	TxnID       string `json:"txn-id,omitempty"`
+	Coordinator string `json:"coordinator,omitempty"`
+
+	// Range of keys to scan, used between shards.
+	Range store.Range `json:"range"`
+
+	// Clock to read changes after.
+	Since clock.VectorClock `json:"since,omitempty"`
+
+	// Buckets of keys to repair, used between replicas.
+	Buckets []int `json:"buckets,omitempty"`
+
+	// The query string of the request.
+	Query url.Values `json:"-"`
 }
 
 // An Entry is a key value pair.
@@ -69,12 +199,111 @@ type Entry struct {
 	Value string `json:"value"`
 }
 
+// Operation is a single get, put, or delete in a batch.
+type Operation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+const (
+	OpGet    = "get"
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Result is the outcome of one operation in a batch. It holds what the
+// response to the same request on its own would have.
+type Result struct {
+	Status   int        `json:"status"`
+	Message  string     `json:"message,omitempty"`
+	Value    string     `json:"value,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Exists   *bool      `json:"doesExist,omitempty"`
+	Replaced *bool      `json:"replaced,omitempty"`
+	TTL      *int64     `json:"ttl,omitempty"`
+	Version  *uuid.UUID `json:"version,omitempty"`
+	Siblings []Sibling  `json:"siblings,omitempty"`
+}
+
+// Sibling is one of the values of a key written concurrently on different
+// replicas. A write whose causal context includes the sibling's replaces it.
+// The causal context only covers the versions of the key the sibling
+// replaced, and the dot names the write that made it.
+type Sibling struct {
+	Value     string            `json:"value,omitempty"`
+	Deleted   bool              `json:"deleted,omitempty"`
+	Version   uuid.UUID         `json:"version"`
+	Dot       *clock.Dot        `json:"dot,omitempty"`
+	CausalCtx clock.VectorClock `json:"causal-context"`
+}
+
+// SiblingsOf returns the siblings of an entry, if it has any.
+func SiblingsOf(e store.Entry) []Sibling {
+	var siblings []Sibling
+	for _, v := range e.Siblings {
+		s := Sibling{
+			Value:     v.Value,
+			Deleted:   v.Deleted,
+			Version:   v.Version,
+			CausalCtx: v.Context(),
+		}
+		if v.DVV != nil {
+			s.Dot = &v.DVV.Dot
+		}
+		siblings = append(siblings, s)
+	}
+	return siblings
+}
+
+// Event is a change to a key, as streamed to its watchers. The causal context
+// is the clock of the change, so a watcher can resume from it.
+type Event struct {
+	Key       string            `json:"key"`
+	Value     string            `json:"value,omitempty"`
+	Deleted   bool              `json:"deleted,omitempty"`
+	Version   uuid.UUID         `json:"version"`
+	CausalCtx clock.VectorClock `json:"causal-context"`
+}
+
 type GossipResponse struct {
 	Imported bool `json:"imported"`
+
+	// Count is how many writes of a batch were imported as new events. Writes
+	// the replica already had are acknowledged but not counted.
+	Count int `json:"count,omitempty"`
 }
 
+// GossipBatch is a batch of writes gossiped to a replica from Origin, in the
+// order they were made, or counts of the writes from Origin each other replica
+// imported.
+type GossipBatch struct {
+	Origin  string            `json:"origin"`
+	Writes  []GossipInput     `json:"writes,omitempty"`
+	Imports map[string]uint64 `json:"imports,omitempty"`
+}
+
+// GossipInput is a write gossiped to a replica. Skipped counts the writes
+// made on Origin just before it that were coalesced into it.
+type GossipInput struct {
+	store.Entry
+	Origin  string `json:"origin,omitempty"`
+	Skipped uint64 `json:"skipped,omitempty"`
+}
+
+// IncrementInput tells a replica that other replicas imported a write from
+// Origin. Imports, if set, counts the writes each replica imported; otherwise
+// every other replica imported one.
 type IncrementInput struct {
-	Origin string `json:"origin"`
+	Origin  string            `json:"origin"`
+	Imports map[string]uint64 `json:"imports,omitempty"`
+}
+
+// AckInput reports the clock of a replica so tombstones it has seen can be
+// collected.
+type AckInput struct {
+	Origin string            `json:"origin"`
+	Clock  clock.VectorClock `json:"clock"`
 }
 
 // WrapHTTP wraps an method that processes Inputs and writes a Response as an http
@@ -96,11 +325,29 @@ func WrapHTTP(next func(Input, *Response)) http.HandlerFunc {
 			return
 		}
 
+		// A compact causal context replaces any in the body
+		if codec, ok := compactCodec(r); ok {
+			vc, err := codec.Decode(r.Header.Get(CAUSAL_CONTEXT_HEADER))
+			if err != nil {
+				log.Println("Could not decode causal context:", err)
+				result.Error = msg.BadContext
+				result.Status = http.StatusBadRequest
+				result.Serve(w, r)
+				return
+			}
+			in.CausalCtx = vc
+		}
+
 		// default the causal context
 		if in.CausalCtx == nil {
 			in.CausalCtx = clock.VectorClock{}
 		}
 
+		// Nodes that left the view are forgotten by the stores
+		if codec, ok := viewCodec(r); ok {
+			in.CausalCtx = codec.Truncate(in.CausalCtx)
+		}
+
 		next(in, result)
 		result.Serve(w, r)
 	}
@@ -111,6 +358,7 @@ func WrapHTTP(next func(Input, *Response)) http.HandlerFunc {
 func ParseInput(r *http.Request, in *Input) (ok bool, err string) {
 	params := mux.Vars(r)
 	in.Key = params["key"]
+	in.Query = r.URL.Query()
 
 	dec := json.NewDecoder(r.Body)
 	if r.ContentLength > 0 {
@@ -124,16 +372,25 @@ func ParseInput(r *http.Request, in *Input) (ok bool, err string) {
 	return true, ""
 }
 
+// MAX_KEY_LENGTH is the longest key that may be stored.
+const MAX_KEY_LENGTH = 50
+
+// CheckKey returns why a key is invalid, or the empty string if it is valid.
+func CheckKey(key string) string {
+	if key == "" {
+		return msg.KeyMissing
+	} else if len(key) > MAX_KEY_LENGTH {
+		return msg.KeyTooLong
+	}
+	return ""
+}
+
 // ValidateKey catches invalid keys and returns an invalid request. If the key
 // is valid, the handler passes through.
 func ValidateKey(next func(Input, *Response)) func(Input, *Response) {
 	return func(in Input, res *Response) {
-		if in.Key == "" {
-			res.Error = msg.KeyMissing
-			res.Status = http.StatusBadRequest
-			return
-		} else if len(in.Key) > 50 {
-			res.Error = msg.KeyTooLong
+		if err := CheckKey(in.Key); err != "" {
+			res.Error = err
 			res.Status = http.StatusBadRequest
 			return
 		}
@@ -144,6 +401,11 @@ func ValidateKey(next func(Input, *Response)) func(Input, *Response) {
 
 // Serve writes a response struct to an http response.
 func (result *Response) Serve(w http.ResponseWriter, r *http.Request) {
+	if codec, ok := compactCodec(r); ok && result.CausalCtx != nil {
+		w.Header().Set(CAUSAL_CONTEXT_HEADER, codec.Encode(result.CausalCtx))
+		result.CausalCtx = nil
+	}
+
 	// Set header and error text if necessary
 	w.WriteHeader(result.Status)
 	if result.Status >= 400 && result.Message == "" {
@@ -37,8 +37,16 @@ func (u UUID) Next() (next UUID) {
 	return
 }
 
+// Greater orders UUIDs by sequence number, then by the address they
+// originated on. Every pair of distinct UUIDs is ordered one way or the other.
 func (u UUID) Greater(v UUID) bool {
-	return u.Seq > v.Seq || u.IP > v.IP || u.Port > v.Port
+	if u.Seq != v.Seq {
+		return u.Seq > v.Seq
+	}
+	if u.IP != v.IP {
+		return u.IP > v.IP
+	}
+	return u.Port > v.Port
 }
 
 func (u UUID) Equal(v UUID) bool {
@@ -0,0 +1,21 @@
+package uuid
+
+import (
+	"testing"
+)
+
+func TestGreater(t *testing.T) {
+	ids := []UUID{
+		{IP: 1, Port: 2, Seq: 1},
+		{IP: 2, Port: 1, Seq: 1},
+		{IP: 2, Port: 2, Seq: 1},
+		{IP: 1, Port: 1, Seq: 2},
+	}
+	for i, u := range ids {
+		for j, v := range ids {
+			if got, want := v.Greater(u), j > i; got != want {
+				t.Errorf("%+v.Greater(%+v) = %t, wanted %t", v, u, got, want)
+			}
+		}
+	}
+}